@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pschlump/news-aggregator/index"
+	"github.com/pschlump/news-aggregator/naLib"
+)
+
+// The admin API lets an operator start a run, rerun or reset archives and look at the state without shell
+// access.  It is served under /admin/ on HTTPAddr when an admin token is configured, and every request needs
+// "Authorization: Bearer <token>".
+//
+//	POST /admin/run                                start a run now
+//	POST /admin/rerun    {"Archives": ["a.zip"]}   queue archives to be processed again, and start a run
+//	POST /admin/reset    {"Archives": ["a.zip"]}   forget that the archives were downloaded, quarantined or queued
+//	GET  /admin/runs?n=20                          the run history, newest first
+//	GET  /admin/archives?name=a.zip&name=b.zip     the state of each archive
+//
+// Runs are only started by the run loop, so /admin/run and /admin/rerun need the "run" command with RunFreq or
+// RunSchedule; the run lease still keeps runs from overlapping.
+
+// runNow wakes the run loop for a run before the next scheduled one.
+var runNow = make(chan struct{}, 1)
+
+// looping is true while cmdRun is waiting for or doing scheduled runs.
+var looping atomic.Bool
+
+// triggerRun asks the run loop for a run now.  It returns false if there is no run loop.
+func triggerRun() bool {
+	if !looping.Load() {
+		return false
+	}
+	select {
+	case runNow <- struct{}{}:
+	default: // a run is already waiting to start
+	}
+	return true
+}
+
+// runReruns processes the archives queued with /admin/rerun, the same as the rerun command.  They are left in the
+// queue if the run fails, for example if the directory listing can not be fetched, and are tried again next time.
+func runReruns(store naLib.StateStore) {
+	ks := naLib.NewKeyspace(&gCfg)
+	var queued []string
+	err := store.Members(ks.Reruns(), func(fn string) error { queued = append(queued, fn); return nil })
+	if err != nil {
+		naLib.Log(naLib.LogRun).Error("unable to read the rerun queue", "error", err)
+		return
+	}
+	if len(queued) == 0 {
+		return
+	}
+	rr, err := RunMainProcess(shutdown.Ctx, store, RunOptions{Archives: queued, Force: true, Trigger: "rerun"})
+	if err != nil {
+		return
+	}
+	var done []string
+	for _, fn := range queued {
+		if !naLib.InArray(fn, rr.Interrupted) {
+			done = append(done, fn)
+		}
+	}
+	if err = store.Remove(ks.Reruns(), done); err != nil {
+		naLib.Log(naLib.LogRun).Error("unable to update the rerun queue", "error", err)
+	}
+	printRun(rr)
+}
+
+// ArchiveStatus is the state of one archive.
+type ArchiveStatus struct {
+	Archive     string
+	Downloaded  bool
+	Quarantined string `json:",omitempty"` // Why it was rejected
+	Interrupted bool   // Started but not finished, it is resumed at the next run
+	RerunQueued bool
+}
+
+// GetArchiveStatus looks up the state of the archive 'fn'.
+func GetArchiveStatus(store naLib.StateStore, fn string) (as ArchiveStatus, err error) {
+	ks := naLib.NewKeyspace(&gCfg)
+	as.Archive = fn
+	if as.Downloaded, err = store.IsMember(ks.Downloaded(), fn); err != nil {
+		return
+	}
+	if as.Quarantined, _, err = store.GetField(ks.Quarantine(), fn); err != nil {
+		return
+	}
+	if as.Interrupted, err = store.IsMember(ks.Interrupted(), fn); err != nil {
+		return
+	}
+	as.RerunQueued, err = store.IsMember(ks.Reruns(), fn)
+	return
+}
+
+// ResetArchives forgets everything about the archives, so the next run processes them as if they were new.
+// Documents that were already loaded are still skipped.
+func ResetArchives(store naLib.StateStore, names []string) (err error) {
+	ks := naLib.NewKeyspace(&gCfg)
+	for _, set := range []string{ks.Downloaded(), ks.Interrupted(), ks.Reruns()} {
+		if err = store.Remove(set, names); err != nil {
+			return
+		}
+	}
+	if err = store.RemoveFields(ks.Attempts(), names); err != nil {
+		return
+	}
+	return store.RemoveFields(ks.Quarantine(), names)
+}
+
+// adminError is the body of a failed admin request.
+type adminError struct {
+	Error string
+}
+
+// archivesRequest is the body of /admin/rerun and /admin/reset.
+type archivesRequest struct {
+	Archives []string
+}
+
+// AdminHandler returns the handler for the admin API, see the top of this file.
+func AdminHandler(store naLib.StateStore, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/run", adminRoute("POST", func(r *http.Request) (int, interface{}) {
+		if !triggerRun() {
+			return http.StatusConflict, adminError{"there is no run loop, runs can only be started with the run command and RunFreq or RunSchedule"}
+		}
+		return http.StatusAccepted, struct{ Triggered bool }{true}
+	}))
+	mux.HandleFunc("/admin/rerun", adminRoute("POST", func(r *http.Request) (int, interface{}) {
+		names, status, aerr := readArchives(r)
+		if aerr != nil {
+			return status, aerr
+		}
+		data, err := index.GetDirectory(r.Context(), gCfg.LoadUrl)
+		if err != nil {
+			return http.StatusBadGateway, adminError{fmt.Sprintf("unable to get the directory listing from %s: %s", gCfg.LoadUrl, err)}
+		}
+		fList, err := index.ParseDirectory(data)
+		if err != nil {
+			return http.StatusBadGateway, adminError{fmt.Sprintf("unable to parse the directory listing from %s: %s", gCfg.LoadUrl, err)}
+		}
+		for _, fn := range names {
+			if !naLib.InArray(fn, fList) {
+				return http.StatusBadRequest, adminError{fmt.Sprintf("%s is not in the directory listing at %s", fn, gCfg.LoadUrl)}
+			}
+		}
+		if _, err = store.AddNew(naLib.NewKeyspace(&gCfg).Reruns(), names); err != nil {
+			return http.StatusInternalServerError, adminError{err.Error()}
+		}
+		return http.StatusAccepted, struct {
+			Queued    []string
+			Triggered bool // false if there is no run loop, the archives are rerun by the next run command
+		}{names, triggerRun()}
+	}))
+	mux.HandleFunc("/admin/reset", adminRoute("POST", func(r *http.Request) (int, interface{}) {
+		names, status, aerr := readArchives(r)
+		if aerr != nil {
+			return status, aerr
+		}
+		if err := ResetArchives(store, names); err != nil {
+			return http.StatusInternalServerError, adminError{err.Error()}
+		}
+		return archiveStatuses(store, names)
+	}))
+	mux.HandleFunc("/admin/runs", adminRoute("GET", func(r *http.Request) (int, interface{}) {
+		n := 20
+		if s := r.URL.Query().Get("n"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil {
+				return http.StatusBadRequest, adminError{"n should be a number"}
+			}
+		}
+		runs, err := RunHistory(store, n)
+		if err != nil {
+			return http.StatusInternalServerError, adminError{err.Error()}
+		}
+		return http.StatusOK, runs
+	}))
+	mux.HandleFunc("/admin/archives", adminRoute("GET", func(r *http.Request) (int, interface{}) {
+		names := r.URL.Query()["name"]
+		if len(names) == 0 {
+			return http.StatusBadRequest, adminError{"give the archives as ?name=a.zip&name=b.zip"}
+		}
+		return archiveStatuses(store, names)
+	}))
+	return requireToken(token, mux)
+}
+
+// adminRoute checks the method, runs fn and sends what it returns as JSON.
+func adminRoute(method string, fn func(r *http.Request) (int, interface{})) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeJSON(w, http.StatusMethodNotAllowed, adminError{r.URL.Path + " needs " + method})
+			return
+		}
+		status, v := fn(r)
+		naLib.Log(naLib.LogHTTP).Info("admin request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "status", status)
+		writeJSON(w, status, v)
+	}
+}
+
+// requireToken only passes on requests with the bearer token.
+func requireToken(token string, h http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			naLib.Log(naLib.LogHTTP).Warn("admin request without the token", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeJSON(w, http.StatusUnauthorized, adminError{"missing or wrong admin token"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// readArchives reads the list of archives from the body of the request.
+func readArchives(r *http.Request) ([]string, int, *adminError) {
+	var req archivesRequest
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20)).Decode(&req); err != nil {
+		return nil, http.StatusBadRequest, &adminError{"the body should be {\"Archives\": [...]}, " + err.Error()}
+	}
+	if len(req.Archives) == 0 {
+		return nil, http.StatusBadRequest, &adminError{"no Archives given"}
+	}
+	return req.Archives, 0, nil
+}
+
+// archiveStatuses looks up the state of each archive.
+func archiveStatuses(store naLib.StateStore, names []string) (int, interface{}) {
+	list := make([]ArchiveStatus, 0, len(names))
+	for _, fn := range names {
+		as, err := GetArchiveStatus(store, fn)
+		if err != nil {
+			return http.StatusInternalServerError, adminError{err.Error()}
+		}
+		list = append(list, as)
+	}
+	return http.StatusOK, list
+}
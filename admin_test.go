@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pschlump/news-aggregator/naLib"
+)
+
+// adminRequest sends a request to h with the token "secret" and decodes the JSON reply into v.
+func adminRequest(t *testing.T, h http.Handler, method, path, body string, v interface{}) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Errorf("%s %s: unable to decode %q: %s", method, path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+// func AdminHandler(store naLib.StateStore, token string) http.Handler {
+func Test_AdminAuth(t *testing.T) {
+	store := testConfig(t, naLib.GlobalConfigType{})
+	h := AdminHandler(store, "secret")
+
+	for _, auth := range []string{"", "Bearer wrong", "secret", "Basic secret"} {
+		req := httptest.NewRequest("GET", "/admin/runs", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Test_AdminAuth: %q expected 401 got %d", auth, w.Code)
+		}
+	}
+	var runs []RunResult
+	if code := adminRequest(t, h, "GET", "/admin/runs", "", &runs); code != http.StatusOK {
+		t.Errorf("Test_AdminAuth: expected 200 with the token got %d", code)
+	}
+	if code := adminRequest(t, h, "GET", "/admin/run", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("Test_AdminAuth: expected 405 for GET /admin/run got %d", code)
+	}
+}
+
+// func triggerRun() bool {
+func Test_AdminRun(t *testing.T) {
+	store := testConfig(t, naLib.GlobalConfigType{})
+	h := AdminHandler(store, "secret")
+
+	if code := adminRequest(t, h, "POST", "/admin/run", "", nil); code != http.StatusConflict {
+		t.Errorf("Test_AdminRun: expected 409 with no run loop got %d", code)
+	}
+
+	looping.Store(true)
+	defer looping.Store(false)
+	var reply struct{ Triggered bool }
+	if code := adminRequest(t, h, "POST", "/admin/run", "", &reply); code != http.StatusAccepted || !reply.Triggered {
+		t.Errorf("Test_AdminRun: expected 202 got %d %+v", code, reply)
+	}
+	// a second request while the first is still waiting does not block
+	adminRequest(t, h, "POST", "/admin/run", "", nil)
+	select {
+	case <-runNow:
+	default:
+		t.Errorf("Test_AdminRun: the run loop was not woken")
+	}
+	select {
+	case <-runNow:
+		t.Errorf("Test_AdminRun: expected only one run to be waiting")
+	default:
+	}
+}
+
+// func runReruns(store naLib.StateStore) {
+func Test_AdminRerun(t *testing.T) {
+	store := testConfig(t, naLib.GlobalConfigType{RunHistory: 10})
+	ts := newTestSource(t, "1600000001.zip")
+	ts.set("1600000001.zip", testArchive(t, "a.xml"))
+	h := AdminHandler(store, "secret")
+	ks := naLib.NewKeyspace(&gCfg)
+
+	for _, body := range []string{"", `{"Archives": []}`, `{"Archives": ["1600000009.zip"]}`} {
+		if code := adminRequest(t, h, "POST", "/admin/rerun", body, nil); code != http.StatusBadRequest {
+			t.Errorf("Test_AdminRerun: %q expected 400 got %d", body, code)
+		}
+	}
+
+	var reply struct {
+		Queued    []string
+		Triggered bool
+	}
+	code := adminRequest(t, h, "POST", "/admin/rerun", `{"Archives": ["1600000001.zip"]}`, &reply)
+	if code != http.StatusAccepted || len(reply.Queued) != 1 || reply.Triggered {
+		t.Errorf("Test_AdminRerun: expected 202, queued and not triggered got %d %+v", code, reply)
+	}
+	var list []ArchiveStatus
+	adminRequest(t, h, "GET", "/admin/archives?name=1600000001.zip", "", &list)
+	if len(list) != 1 || !list[0].RerunQueued || list[0].Downloaded {
+		t.Errorf("Test_AdminRerun: expected the archive queued got %+v", list)
+	}
+
+	// the run loop processes the queue and empties it
+	runReruns(store)
+	adminRequest(t, h, "GET", "/admin/archives?name=1600000001.zip", "", &list)
+	if len(list) != 1 || list[0].RerunQueued || !list[0].Downloaded {
+		t.Errorf("Test_AdminRerun: expected the archive downloaded and the queue empty got %+v", list)
+	}
+	if n, _ := store.Len(ks.NewsXML()); n != 1 {
+		t.Errorf("Test_AdminRerun: expected 1 document loaded got %d", n)
+	}
+	var runs []RunResult
+	adminRequest(t, h, "GET", "/admin/runs?n=5", "", &runs)
+	if len(runs) != 1 || runs[0].Trigger != "rerun" {
+		t.Errorf("Test_AdminRerun: expected the rerun in the history got %+v", runs)
+	}
+}
+
+// func ResetArchives(store naLib.StateStore, names []string) (err error) {
+func Test_AdminReset(t *testing.T) {
+	store := testConfig(t, naLib.GlobalConfigType{})
+	h := AdminHandler(store, "secret")
+	ks := naLib.NewKeyspace(&gCfg)
+	store.AddNew(ks.Downloaded(), []string{"a.zip", "b.zip"})
+	store.SetField(ks.Quarantine(), "a.zip", "MaxRatio")
+
+	var list []ArchiveStatus
+	if code := adminRequest(t, h, "POST", "/admin/reset", `{"Archives": ["a.zip"]}`, &list); code != http.StatusOK {
+		t.Errorf("Test_AdminReset: expected 200 got %d", code)
+	}
+	if len(list) != 1 || list[0].Downloaded || list[0].Quarantined != "" {
+		t.Errorf("Test_AdminReset: expected a.zip forgotten got %+v", list)
+	}
+	if in, _ := store.IsMember(ks.Downloaded(), "b.zip"); !in {
+		t.Errorf("Test_AdminReset: b.zip should not have been reset")
+	}
+	if code := adminRequest(t, h, "GET", "/admin/archives", "", nil); code != http.StatusBadRequest {
+		t.Errorf("Test_AdminReset: expected 400 with no names got %d", code)
+	}
+}
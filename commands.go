@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pschlump/news-aggregator/naLib"
+	"github.com/pschlump/news-aggregator/pipeline"
+	"github.com/pschlump/radix.v2/util"
+)
+
+// Exit codes for the sub-commands.
+const (
+	ExitOK     = 0 // Success
+	ExitError  = 1 // The command failed, see the log
+	ExitUsage  = 2 // Unknown command, bad flags or arguments
+	ExitConfig = 3 // config-check found problems with the configuration
+)
+
+// Command is one of the sub-commands.
+type Command struct {
+	Name       string
+	Args       string // Arguments, for the usage message
+	Help       string
+	MinArgs    int  // Number of arguments that are required
+	NeedsStore bool // Open the StateStore before Run
+	DryRun     bool // Has a -dry-run, the flag is an error for the other commands
+	Graceful   bool // Finish the archives in progress on SIGINT or SIGTERM, see Shutdown
+	Run        func(store naLib.StateStore, args []string) int
+}
+
+// Commands is the list of sub-commands, in the order they are shown in the usage message.
+var Commands []Command
+
+func init() {
+	Commands = []Command{
+		{Name: "run", Graceful: true, Args: "[-dry-run [-download]]", Help: "process new archives, every RunFreq seconds if RunFreq > 0, else once", NeedsStore: true, DryRun: true, Run: cmdRun},
+		{Name: "once", Graceful: true, Args: "[-dry-run [-download]]", Help: "process new archives once and exit, or report what it would do", NeedsStore: true, DryRun: true, Run: cmdOnce},
+		{Name: "rerun", Graceful: true, Args: "[-dry-run] archive...", Help: "process the archives again, even if they have been downloaded", MinArgs: 1, NeedsStore: true, DryRun: true, Run: cmdRerun},
+		{Name: "replay", Graceful: true, Args: "archive...", Help: "push every document in the archives onto the list again, even if already loaded", MinArgs: 1, NeedsStore: true, Run: cmdReplay},
+		{Name: "list-remote", Help: "list the archives at LoadUrl and if they have been downloaded", NeedsStore: true, Run: cmdListRemote},
+		{Name: "list-state", Help: "list the downloaded and quarantined archives", NeedsStore: true, Run: cmdListState},
+		{Name: "status", Help: "show the state store, list length and backpressure", NeedsStore: true, Run: cmdStatus},
+		{Name: "inspect", Args: "archive", Help: "list the documents in an archive (a local file or a name at LoadUrl)", MinArgs: 1, NeedsStore: true, Run: cmdInspect},
+		{Name: "history", Args: "[-n 20] [run-id]", Help: "list the last runs, or show one run", NeedsStore: true, Run: cmdHistory},
+		{Name: "config-check", Help: "check the configuration and connect to the state store", Run: cmdConfigCheck},
+		{Name: "prune", Args: "[-dry-run] [-days n]", Help: "remove state older than RetentionDays, or expired keys", NeedsStore: true, DryRun: true, Run: cmdPrune},
+		{Name: "migrate-keys", Args: "[-dry-run]", Help: "rename keys from the old key layout, see naLib/keyspace.go", NeedsStore: true, DryRun: true, Run: cmdMigrateKeys},
+		{Name: "bloom-build", Help: "add the existing document keys to the Bloom filter", NeedsStore: true, Run: cmdBloomBuild},
+		{Name: "help", Help: "show this message", Run: func(naLib.StateStore, []string) int { Usage(); return ExitOK }},
+	}
+}
+
+// Usage prints the commands and flags.
+func Usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: %s [flags] [command [flags] [args]]\n\nCommands:\n", os.Args[0])
+	for _, c := range Commands {
+		fmt.Fprintf(w, "  %-14s %-22s %s\n", c.Name, c.Args, c.Help)
+	}
+	fmt.Fprintf(w, "\nExit codes: %d ok, %d error, %d usage, %d configuration problems\n\nFlags:\n", ExitOK, ExitError, ExitUsage, ExitConfig)
+	flag.PrintDefaults()
+}
+
+// RunCommand runs the sub-command in args[0] and returns the exit code for the program.  Flags can come after the
+// sub-command, news-aggregator prune -dry-run, but must be before its arguments.
+func RunCommand(args []string) int {
+	var cmd *Command
+	for ii := range Commands {
+		if Commands[ii].Name == args[0] {
+			cmd = &Commands[ii]
+		}
+	}
+	if cmd == nil {
+		naLib.Log(naLib.LogRun).Error("unknown command", "command", args[0])
+		Usage()
+		return ExitUsage
+	}
+	if err := flag.CommandLine.Parse(args[1:]); err != nil {
+		return ExitUsage
+	}
+	args = flag.Args()
+	if len(args) < cmd.MinArgs {
+		naLib.Log(naLib.LogRun).Error("missing arguments", "command", cmd.Name, "args", cmd.Args)
+		return ExitUsage
+	}
+	if *DryRun && !cmd.DryRun {
+		naLib.Log(naLib.LogRun).Error("the command does not have a dry run, it would make changes", "command", cmd.Name)
+		return ExitUsage
+	}
+
+	metrics = naLib.NewMetrics(&gCfg)
+	health = naLib.NewHealth(&gCfg)
+	var store naLib.StateStore
+	if cmd.NeedsStore {
+		var err error
+		store, err = naLib.NewStateStore(&gCfg)
+		if err != nil {
+			naLib.Log(naLib.LogState).Error("unable to open the state store", "backend", gCfg.StateBackend, "error", err)
+			return ExitError
+		}
+		defer store.Close()
+		backpressure = naLib.NewBackpressure(naLib.NewKeyspace(&gCfg).NewsXML(), &gCfg)
+		metrics.RegisterGauges(store, naLib.NewKeyspace(&gCfg).NewsXML(), backpressure)
+	}
+	if cmd.Graceful {
+		shutdown.Notify(time.Duration(gCfg.ShutdownGrace) * time.Second)
+		if !*DryRun { // the admin API could start a real run
+			StartServer(store)
+		}
+	}
+	return cmd.Run(store, args)
+}
+
+// printResult prints v as JSON with -json, otherwise it calls text to print it for people.
+func printResult(v interface{}, text func()) {
+	if *JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(v)
+		return
+	}
+	text()
+}
+
+// printRun prints the result of one pass.
+func printRun(rr RunResult) {
+	printResult(rr, func() {
+		if len(rr.Archives) == 0 {
+			fmt.Printf("No new files to process\n")
+			return
+		}
+		st := rr.Stats
+		fmt.Printf("Processed %d archives: %d downloaded, %d extracted, %d documents, %d loaded, %d failed\n",
+			len(rr.Archives), st.Downloaded, st.Extracted, st.Documents, st.Loaded, st.DownloadFailed+st.ExtractFailed+st.LoadFailed)
+		if len(rr.Resumed) > 0 {
+			fmt.Printf("Resumed %d interrupted archives: %s\n", len(rr.Resumed), rr.Resumed)
+		}
+		if len(rr.Interrupted) > 0 {
+			fmt.Printf("Interrupted %d archives, they will be resumed at the next run: %s\n", len(rr.Interrupted), rr.Interrupted)
+		}
+		if len(rr.Failed) > 0 {
+			fmt.Printf("Failed %d archives, they will be tried again at the next run: %s\n", len(rr.Failed), rr.Failed)
+		}
+	})
+}
+
+// cmdRun processes new archives on the schedule from RunSchedule or RunFreq, or when the admin API asks for a run,
+// pruning old state every PruneFreq seconds, until SIGINT or SIGTERM.  Archives queued with the admin API's rerun
+// are processed first.  With neither set, or with -dry-run, it is the same as once.
+func cmdRun(store naLib.StateStore, args []string) int {
+	lg := naLib.Log(naLib.LogRun)
+	sched, err := RunSchedule()
+	if err != nil {
+		lg.Error("bad schedule", "error", err)
+		return ExitConfig
+	}
+	if sched == nil || *DryRun {
+		lg.Debug("no RunFreq or RunSchedule, or a dry run, running just once")
+		return cmdOnce(store, args)
+	}
+	defer saveNextRun(store, time.Time{})
+	looping.Store(true)
+	defer looping.Store(false)
+
+	lastPrune := time.Now()
+	next, err := sched.First(time.Now())
+	for n := 1; err == nil && !shutdown.Stopping(); n++ {
+		saveNextRun(store, next)
+		health.Waiting(next)
+		lg.Debug("next run", "iteration", n, "at", next.Format(time.RFC3339))
+		trigger := "schedule"
+		select {
+		case <-time.After(time.Until(next)):
+		case <-runNow:
+			trigger = "admin"
+		case <-shutdown.Stop:
+			return ExitOK
+		}
+
+		health.RunStarted()
+		e := withRunLease(store, func() {
+			runReruns(store)
+			rr, e := RunMainProcess(shutdown.Ctx, store, RunOptions{Trigger: trigger})
+			if e == nil {
+				printRun(rr)
+			}
+		})
+		if e == ErrRunInProgress {
+			lg.Warn("skipping the run, another run is in progress", "at", next.Format(time.RFC3339))
+		}
+		if gCfg.PruneFreq > 0 && time.Since(lastPrune) >= time.Duration(gCfg.PruneFreq)*time.Second {
+			if _, isRedis := store.(*naLib.RedisStore); !isRedis || gCfg.RetentionDays > 0 {
+				cmdPrune(store, nil)
+			}
+			lastPrune = time.Now()
+		}
+		next, err = sched.Next(time.Now())
+	}
+	if err != nil {
+		lg.Error("bad schedule", "error", err)
+		return ExitConfig
+	}
+	return ExitOK
+}
+
+// cmdOnce processes new archives once.
+func cmdOnce(store naLib.StateStore, args []string) int {
+	return runOnce(store, RunOptions{Trigger: "once"})
+}
+
+// cmdRerun processes the archives in args again.  Documents that have already been loaded are still skipped, use
+// replay to push them again.
+func cmdRerun(store naLib.StateStore, args []string) int {
+	return runOnce(store, RunOptions{Archives: args, Force: true, Trigger: "rerun"})
+}
+
+func runOnce(store naLib.StateStore, opts RunOptions) int {
+	if *DryRun {
+		return runPlan(store, opts)
+	}
+	var rr RunResult
+	var err error
+	lerr := withRunLease(store, func() { rr, err = RunMainProcess(shutdown.Ctx, store, opts) })
+	if lerr == ErrRunInProgress {
+		naLib.Log(naLib.LogRun).Error("unable to run, another run is in progress")
+	}
+	if lerr != nil || err != nil {
+		return ExitError
+	}
+	printRun(rr)
+	if rr.Stats.DownloadFailed+rr.Stats.ExtractFailed+rr.Stats.LoadFailed > 0 {
+		return ExitError
+	}
+	return ExitOK
+}
+
+// cmdReplay downloads the archives in args and pushes all of their documents onto the list, including the ones
+// that have already been loaded, for a consumer that lost them.
+func cmdReplay(store naLib.StateStore, args []string) int {
+	name, err := TempDir(shutdown.Ctx)
+	if err != nil {
+		return ExitError
+	}
+	defer os.RemoveAll(name)
+	st := pipeline.Run(shutdown.Ctx, PipelineConfig(), args, DownloadStage(name, nil), ExtractStage(store, name, nil), ReplayStage(store, backpressure))
+	rr := RunResult{Archives: args, Stats: st}
+	printRun(rr)
+	if st.DownloadFailed+st.ExtractFailed+st.LoadFailed > 0 {
+		return ExitError
+	}
+	return ExitOK
+}
+
+// cmdPrune removes archive names older than RetentionDays (or -days) from Redis and puts a TTL on per-document keys
+// that do not have one.  With the bolt and memory StateBackends it deletes the keys whose TTL has passed instead.
+// This is the "prune" command and is also run every PruneFreq seconds by "run".
+func cmdPrune(store naLib.StateStore, args []string) int {
+	if _, isRedis := store.(*naLib.RedisStore); !isRedis {
+		return expireStore(store)
+	}
+	client, _ := redisClient(store, "prune")
+	days := gCfg.RetentionDays
+	if *Days > 0 {
+		days = *Days
+	}
+	if days <= 0 {
+		naLib.Log(naLib.LogState).Error("RetentionDays must be set in the configuration, or use -days, to prune")
+		return ExitUsage
+	}
+	pr, err := naLib.Prune(client, time.Duration(days)*24*time.Hour, *DryRun, &gCfg)
+	if err != nil {
+		naLib.Log(naLib.LogState).Error("prune failed", "done", pr.String(), "error", err)
+		return ExitError
+	}
+	printResult(pr, func() { fmt.Printf("Prune older than %d days: %s\n", days, pr) })
+	return ExitOK
+}
+
+// expireStore is prune for the bolt and memory StateBackends, which have no archive names or keys without a TTL to
+// clean up, only keys that have expired but are still on disk or in memory.
+func expireStore(store naLib.StateStore) int {
+	if *DryRun {
+		naLib.Log(naLib.LogState).Error("prune -dry-run needs the redis StateBackend", "backend", gCfg.StateBackend)
+		return ExitUsage
+	}
+	n, err := store.Expire()
+	if err != nil {
+		naLib.Log(naLib.LogState).Error("prune failed", "expired", n, "error", err)
+		return ExitError
+	}
+	printResult(struct{ Expired int }{n}, func() { fmt.Printf("Prune: deleted %d expired keys\n", n) })
+	return ExitOK
+}
+
+// cmdMigrateKeys renames keys written with the old key layout to the current one, see naLib.Keyspace.
+func cmdMigrateKeys(store naLib.StateStore, args []string) int {
+	client, ok := redisClient(store, "migrate-keys")
+	if !ok {
+		return ExitUsage
+	}
+	mr, err := naLib.MigrateKeys(client, *DryRun, &gCfg)
+	if err != nil {
+		naLib.Log(naLib.LogState).Error("migrate-keys failed", "done", mr.String(), "error", err)
+		return ExitError
+	}
+	printResult(mr, func() { fmt.Printf("Migrate keys: %s\n", mr) })
+	return ExitOK
+}
+
+// cmdBloomBuild adds the names from the per-document keys to the Bloom filter, so that DedupeBackend can be switched
+// from "keys" to "bloom" without loading the documents again.
+func cmdBloomBuild(store naLib.StateStore, args []string) int {
+	client, ok := redisClient(store, "bloom-build")
+	if !ok {
+		return ExitUsage
+	}
+	added, err := naLib.BuildBloom(client, &gCfg)
+	if err != nil {
+		naLib.Log(naLib.LogState).Error("bloom-build failed", "added", added, "error", err)
+		return ExitError
+	}
+	bi, err := naLib.GetBloomInfo(client, &gCfg)
+	if err != nil {
+		naLib.Log(naLib.LogState).Error("unable to read the Bloom filter", "error", err)
+		return ExitError
+	}
+	printResult(struct {
+		Added int
+		Bloom naLib.BloomInfo
+	}{added, bi}, func() { fmt.Printf("Bloom build: added %d names, %s\n", added, bi) })
+	return ExitOK
+}
+
+// redisClient returns the Redis client for the commands that only work with the "redis" StateBackend.
+func redisClient(store naLib.StateStore, cmd string) (util.Cmder, bool) {
+	rs, ok := store.(*naLib.RedisStore)
+	if !ok {
+		naLib.Log(naLib.LogRun).Error("command needs the redis StateBackend", "command", cmd, "backend", gCfg.StateBackend)
+		return nil, false
+	}
+	return rs.Client(), true
+}
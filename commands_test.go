@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pschlump/news-aggregator/naLib"
+)
+
+// func RunCommand(args []string) int {
+func Test_RunCommandDryRun(t *testing.T) {
+	store := testConfig(t, naLib.GlobalConfigType{})
+	defer func() { *DryRun = false }()
+
+	for _, args := range [][]string{
+		{"replay", "-dry-run", "1600000001.zip"},
+		{"bloom-build", "-dry-run"},
+		{"list-state", "-dry-run"},
+	} {
+		*DryRun = false
+		if code := RunCommand(args); code != ExitUsage {
+			t.Errorf("Test_RunCommandDryRun: %s expected exit %d got %d", args, ExitUsage, code)
+		}
+	}
+	*DryRun = true
+	if code := cmdPrune(store, nil); code != ExitUsage {
+		t.Errorf("Test_RunCommandDryRun: prune -dry-run with the memory store expected exit %d got %d", ExitUsage, code)
+	}
+}
@@ -0,0 +1,330 @@
+package consumer
+
+//
+// A reliable consumer for the NEWS_XML list.  Reading the list with RPOP loses the document if the consumer
+// crashes before it is done with it.  Instead each document is moved by a Lua script onto a processing list that
+// belongs to the consumer, and only removed from there when it is acknowledged:
+//
+//	NEWS_XML  --deliver-->  NEWS_XML:processing:<name>  --Ack-->  (gone)
+//	    ^                            |
+//	    +------ Nack / timeout ------+----- MaxAttempts failures -->  NEWS_XML:dead
+//
+// A document that is not acknowledged within VisibilityTimeout, because the consumer that had it crashed or is
+// stuck, is put back on the queue by Reap, which any consumer can run.  After MaxAttempts deliveries a document
+// goes to the dead-letter list instead, so one bad document can not stop the consumers.  Delivery is at least
+// once: a document can be processed again if a consumer is slower than VisibilityTimeout, so handlers should be
+// idempotent.
+//
+// The script that moves a document also gives it a message ID from the counter NEWS_XML:ids and records the
+// delivery time, so there is never a document on a processing list without a delivery time.  On the processing
+// list the document is stored as "<id>:<data>", so two copies of the same document are tracked on their own.
+// The number of deliveries is kept by the sha1 of the data, since a document that is put back on the queue gets a
+// new ID when it is delivered again.  When the queue is empty the consumer waits with BLMOVE from the queue to
+// itself, which leaves the list as it was, and then runs the script again.
+//
+// With Redis Cluster give Queue a hash tag, {news}NEWS_XML, so that all of the keys are in the same slot.
+//
+// Needs Redis 6.2 or later for BLMOVE.
+//
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/pschlump/radix.v2/redis"
+	"github.com/pschlump/radix.v2/util"
+)
+
+// Config for a Consumer.  Zero values are replaced with the defaults.
+type Config struct {
+	Queue             string        // The list the aggregator pushes onto, RedisKeyNewsXML with its prefix
+	Name              string        // Unique name for this consumer, names its processing list
+	VisibilityTimeout time.Duration // How long a document can be processed before it is given to another consumer, default 5 minutes
+	MaxAttempts       int           // Deliveries before a document goes to the dead-letter list, default 5
+	BlockTimeout      time.Duration // How long each BLMOVE waits, default 5 seconds - must be less than the Redis read timeout
+	DeadLetter        string        // Dead-letter list, default Queue+":dead"
+	Logger            *slog.Logger  // Where Run logs reaps and dead-lettered documents, default slog.Default()
+}
+
+// ErrNoName is returned by New if Config.Name is not set.
+var ErrNoName = errors.New("consumer: Config.Queue and Config.Name must be set")
+
+// Message is one document received from the queue.
+type Message struct {
+	ID       string // Unique for each delivery, from the queue's ID counter
+	Data     []byte
+	Attempts int // Number of times this document has been delivered, including this time
+}
+
+// Consumer reads documents from the queue.  Receive, Ack and Nack should be called from one goroutine; Reap can be
+// called from any.
+type Consumer struct {
+	client     util.Cmder
+	cfg        Config
+	processing string // This consumer's processing list
+	deliveries string // Hash of message ID -> delivery time in ms, for this consumer
+	attempts   string // Hash of sha1 of the data -> deliveries, shared by all consumers
+	consumers  string // Set of consumer names, so Reap can find every processing list
+	ids        string // Counter for the message IDs, shared by all consumers
+}
+
+// New returns a Consumer for cfg reading with 'client', usually a *naLib.RedisConn or a radix pool.
+func New(client util.Cmder, cfg Config) (*Consumer, error) {
+	if cfg.Queue == "" || cfg.Name == "" {
+		return nil, ErrNoName
+	}
+	if cfg.VisibilityTimeout <= 0 {
+		cfg.VisibilityTimeout = 5 * time.Minute
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.BlockTimeout <= 0 {
+		cfg.BlockTimeout = 5 * time.Second
+	}
+	if cfg.DeadLetter == "" {
+		cfg.DeadLetter = cfg.Queue + ":dead"
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	c := &Consumer{
+		client:     client,
+		cfg:        cfg,
+		processing: processingList(cfg.Queue, cfg.Name),
+		deliveries: processingList(cfg.Queue, cfg.Name) + ":deliveries",
+		attempts:   cfg.Queue + ":attempts",
+		consumers:  cfg.Queue + ":consumers",
+		ids:        cfg.Queue + ":ids",
+	}
+	err := client.Cmd("SADD", c.consumers, cfg.Name).Err
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func processingList(queue, name string) string { return queue + ":processing:" + name }
+
+// item is how a document is stored on a processing list, with its message ID in front.
+func item(id string, data []byte) []byte {
+	return append([]byte(id+":"), data...)
+}
+
+// parseItem splits an entry from a processing list into the message ID and the document.  An entry without an ID,
+// left by an older version that moved the document with BLMOVE, has an empty ID.
+func parseItem(it []byte) (id string, data []byte) {
+	n := bytes.IndexByte(it, ':')
+	if n <= 0 {
+		return "", it
+	}
+	if _, err := strconv.ParseUint(string(it[:n]), 10, 64); err != nil {
+		return "", it
+	}
+	return string(it[:n]), it[n+1:]
+}
+
+// Receive waits for the next document.  It returns with ctx.Err() when ctx is canceled.  The document stays on
+// this consumer's processing list until Ack or Nack is called.
+func (c *Consumer) Receive(ctx context.Context) (msg *Message, err error) {
+	for msg == nil && err == nil {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		msg, err = c.receive()
+	}
+	return
+}
+
+// receive delivers the next document, waiting up to BlockTimeout if the queue is empty.  msg is nil if it timed out
+// or another consumer took the document.
+func (c *Consumer) receive() (msg *Message, err error) {
+	if msg, err = c.deliver(); msg != nil || err != nil {
+		return
+	}
+	r := c.client.Cmd("BLMOVE", c.cfg.Queue, c.cfg.Queue, "RIGHT", "RIGHT", c.cfg.BlockTimeout.Seconds())
+	if r.Err != nil || r.IsType(redis.Nil) {
+		return nil, r.Err
+	}
+	return c.deliver()
+}
+
+// deliver runs deliverScript, msg is nil if the queue is empty.
+func (c *Consumer) deliver() (*Message, error) {
+	r := util.LuaEval(c.client, deliverScript, 5, c.cfg.Queue, c.processing, c.deliveries, c.attempts, c.ids,
+		time.Now().UnixNano()/int64(time.Millisecond))
+	if r.Err != nil || r.IsType(redis.Nil) {
+		return nil, r.Err
+	}
+	l, err := r.Array()
+	if err != nil || len(l) != 3 {
+		return nil, fmt.Errorf("consumer: unexpected reply from the deliver script: %v %v", r, err)
+	}
+	msg := &Message{}
+	if msg.ID, err = l[0].Str(); err != nil {
+		return nil, err
+	}
+	if msg.Data, err = l[1].Bytes(); err != nil {
+		return nil, err
+	}
+	if msg.Attempts, err = l[2].Int(); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// deliverScript moves the oldest document from the queue KEYS[1] onto the processing list KEYS[2] with a new ID from
+// the counter KEYS[5], records the delivery time ARGV[1] in KEYS[3] and counts the delivery in KEYS[4].  It returns
+// the ID, the document and the number of deliveries, or nil if the queue is empty.
+const deliverScript = `
+local data = redis.call('RPOP', KEYS[1])
+if not data then
+	return false
+end
+local id = tostring(redis.call('INCR', KEYS[5]))
+redis.call('LPUSH', KEYS[2], id .. ':' .. data)
+redis.call('HSET', KEYS[3], id, ARGV[1])
+local n = redis.call('HINCRBY', KEYS[4], redis.sha1hex(data), 1)
+return {id, data, n}
+`
+
+// Ack removes a document that has been processed.
+func (c *Consumer) Ack(msg *Message) error {
+	return util.LuaEval(c.client, ackScript, 3, c.processing, c.deliveries, c.attempts, item(msg.ID, msg.Data), msg.ID, msg.Data).Err
+}
+
+// ackScript removes ARGV[1] from the processing list KEYS[1], its ID ARGV[2] from KEYS[2] and the count for its
+// document ARGV[3] from KEYS[3].
+const ackScript = `
+redis.call('LREM', KEYS[1], 1, ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[2])
+redis.call('HDEL', KEYS[3], redis.sha1hex(ARGV[3]))
+return 1
+`
+
+// Nack returns a document that could not be processed.  It goes to the back of the queue to be tried again, or to
+// the dead-letter list if it has been delivered MaxAttempts times.  dead is true if it went to the dead-letter list.
+func (c *Consumer) Nack(msg *Message) (dead bool, err error) {
+	n, err := util.LuaEval(c.client, requeueScript, 5, c.processing, c.deliveries, c.attempts, c.cfg.Queue, c.cfg.DeadLetter,
+		item(msg.ID, msg.Data), msg.ID, c.cfg.MaxAttempts, "LPUSH", msg.Data).Int()
+	return n == 2, err
+}
+
+// requeueScript moves ARGV[1] off of the processing list KEYS[1] and removes its ID ARGV[2] from KEYS[2].  If its
+// document ARGV[5] has been delivered ARGV[3] times it is pushed onto the dead-letter list KEYS[5] and 2 is returned,
+// otherwise it is put back on the queue KEYS[4] with ARGV[4] (LPUSH for the back of the queue, RPUSH for the front)
+// and 1 is returned.  0 is returned if it was not on the processing list.
+const requeueScript = `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HDEL', KEYS[2], ARGV[2])
+local sum = redis.sha1hex(ARGV[5])
+local n = tonumber(redis.call('HGET', KEYS[3], sum) or '0')
+if n >= tonumber(ARGV[3]) then
+	redis.call('HDEL', KEYS[3], sum)
+	redis.call('LPUSH', KEYS[5], ARGV[5])
+	return 2
+end
+redis.call(ARGV[4], KEYS[4], ARGV[5])
+return 1
+`
+
+// ReapResult is what Reap did.
+type ReapResult struct {
+	Requeued   int // Documents put back on the queue
+	DeadLetter int // Documents moved to the dead-letter list
+}
+
+func (rr ReapResult) String() string {
+	return fmt.Sprintf("requeued %d, dead-lettered %d", rr.Requeued, rr.DeadLetter)
+}
+
+// Reap looks at the processing list of every consumer of the queue, and any document that has been there longer
+// than VisibilityTimeout is put back on the front of the queue (or on the dead-letter list after MaxAttempts).
+// Every document is given its delivery time by the same script that moves it, so one with no delivery time is
+// from an older version that used BLMOVE and is treated as timed out.
+func (c *Consumer) Reap() (rr ReapResult, err error) {
+	names, err := c.client.Cmd("SMEMBERS", c.consumers).List()
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-c.cfg.VisibilityTimeout).UnixNano() / int64(time.Millisecond)
+	for _, name := range names {
+		processing := processingList(c.cfg.Queue, name)
+		items, e := c.client.Cmd("LRANGE", processing, 0, -1).ListBytes()
+		if e != nil {
+			return rr, e
+		}
+		for _, it := range items {
+			id, data := parseItem(it)
+			if id != "" {
+				at, _ := c.client.Cmd("HGET", processing+":deliveries", id).Int64()
+				if at > cutoff {
+					continue
+				}
+			}
+			n, e := util.LuaEval(c.client, requeueScript, 5, processing, processing+":deliveries", c.attempts, c.cfg.Queue, c.cfg.DeadLetter,
+				it, id, c.cfg.MaxAttempts, "RPUSH", data).Int()
+			if e != nil {
+				return rr, e
+			}
+			switch n {
+			case 1:
+				rr.Requeued++
+			case 2:
+				rr.DeadLetter++
+			}
+		}
+	}
+	return
+}
+
+// HandlerFunc processes one document.  Returning an error Nacks the document.
+type HandlerFunc func(ctx context.Context, msg *Message) error
+
+// Run receives documents and calls handler for each one until ctx is canceled, acknowledging the ones that succeed.
+// Reap is run every VisibilityTimeout/2.  The error is ctx.Err() when canceled, or the Redis error that stopped it.
+func (c *Consumer) Run(ctx context.Context, handler HandlerFunc) error {
+	lg := c.cfg.Logger.With("consumer", c.cfg.Name, "queue", c.cfg.Queue)
+	lastReap := time.Time{}
+	for {
+		if time.Since(lastReap) >= c.cfg.VisibilityTimeout/2 {
+			rr, err := c.Reap()
+			if err != nil {
+				lg.ErrorContext(ctx, "reap failed", "error", err)
+			} else if rr.Requeued+rr.DeadLetter > 0 {
+				lg.InfoContext(ctx, "reaped documents", "requeued", rr.Requeued, "dead_lettered", rr.DeadLetter)
+			}
+			lastReap = time.Now()
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		msg, err := c.receive()
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			continue
+		}
+		if err = handler(ctx, msg); err != nil {
+			dead, e := c.Nack(msg)
+			if e != nil {
+				return e
+			}
+			if dead {
+				lg.WarnContext(ctx, "moved a document to the dead-letter list", "id", msg.ID, "dead_letter", c.cfg.DeadLetter, "attempts", msg.Attempts, "error", err)
+			}
+			continue
+		}
+		if err = c.Ack(msg); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pschlump/news-aggregator/naLib"
+)
+
+// func New(client util.Cmder, cfg Config) (*Consumer, error) {
+func Test_New(t *testing.T) {
+	if _, err := New(nil, Config{Queue: "NEWS_XML"}); err != ErrNoName {
+		t.Errorf("New error- expected ErrNoName, got %v", err)
+	}
+}
+
+// func (c *Consumer) Receive(ctx context.Context) (msg *Message, err error) {
+// func (c *Consumer) Ack(msg *Message) error {
+// func (c *Consumer) Nack(msg *Message) (dead bool, err error) {
+// func (c *Consumer) Reap() (rr ReapResult, err error) {
+//
+// test depends on connecting to Redis and the ../cfg.json file
+func Test_Consumer(t *testing.T) {
+	gCfg := naLib.GlobalConfigType{
+		RedisHost: "127.0.0.1",
+		RedisPort: "6379",
+	}
+	naLib.ReadConfigFile("../cfg.json", &gCfg)
+
+	client, err := naLib.RedisClient(gCfg.RedisHost, gCfg.RedisPort, gCfg.RedisAuth)
+	if err != nil {
+		t.Errorf("RedisClient error- failed to connect- %s\n", err)
+		return
+	}
+	defer client.Close()
+
+	queue := "Test_Consumer:NEWS_XML"
+	keys := []interface{}{queue, queue + ":dead", queue + ":attempts", queue + ":consumers", queue + ":ids",
+		processingList(queue, "c1"), processingList(queue, "c1") + ":deliveries",
+		processingList(queue, "c2"), processingList(queue, "c2") + ":deliveries"}
+	client.Cmd("DEL", keys...)
+	defer client.Cmd("DEL", keys...)
+
+	c1, err := New(client, Config{Queue: queue, Name: "c1", VisibilityTimeout: time.Hour, MaxAttempts: 2, BlockTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("New error- %s", err)
+	}
+	client.Cmd("LPUSH", queue, "doc-1", "doc-2")
+
+	// oldest first, and an Ack removes it from the processing list
+	ctx := context.Background()
+	msg, err := c1.Receive(ctx)
+	if err != nil || string(msg.Data) != "doc-1" || msg.Attempts != 1 {
+		t.Fatalf("Receive error- expected doc-1 attempt 1, got %+v, %v", msg, err)
+	}
+	if n, _ := client.Cmd("LLEN", processingList(queue, "c1")).Int(); n != 1 {
+		t.Errorf("Receive error- expected 1 on the processing list, got %d", n)
+	}
+	if err = c1.Ack(msg); err != nil {
+		t.Errorf("Ack error- %s", err)
+	}
+	if n, _ := client.Cmd("LLEN", processingList(queue, "c1")).Int(); n != 0 {
+		t.Errorf("Ack error- expected empty processing list, got %d", n)
+	}
+
+	// Nack puts it back, and after MaxAttempts it goes to the dead-letter list
+	msg, _ = c1.Receive(ctx)
+	if dead, err := c1.Nack(msg); dead || err != nil {
+		t.Errorf("Nack error- first failure should requeue, got %v %v", dead, err)
+	}
+	msg, _ = c1.Receive(ctx)
+	if string(msg.Data) != "doc-2" || msg.Attempts != 2 {
+		t.Errorf("Receive error- expected doc-2 attempt 2, got %+v", msg)
+	}
+	if dead, err := c1.Nack(msg); !dead || err != nil {
+		t.Errorf("Nack error- second failure should dead-letter, got %v %v", dead, err)
+	}
+	if s, _ := client.Cmd("RPOP", queue+":dead").Str(); s != "doc-2" {
+		t.Errorf("Nack error- expected doc-2 on the dead-letter list, got %s", s)
+	}
+
+	// a consumer that crashes with a document is reaped by another after the visibility timeout
+	client.Cmd("LPUSH", queue, "doc-3")
+	c2, _ := New(client, Config{Queue: queue, Name: "c2", VisibilityTimeout: 10 * time.Millisecond, BlockTimeout: time.Second})
+	if msg, _ = c2.Receive(ctx); string(msg.Data) != "doc-3" {
+		t.Fatalf("Receive error- expected doc-3, got %+v", msg)
+	}
+	time.Sleep(20 * time.Millisecond)
+	rr, err := c1.Reap()
+	if err != nil || rr.Requeued != 0 {
+		t.Errorf("Reap error- c1 has a 1 hour timeout, expected nothing requeued, got %s, %v", rr, err)
+	}
+	rr, err = c2.Reap()
+	if err != nil || rr.Requeued != 1 {
+		t.Errorf("Reap error- expected 1 requeued, got %s, %v", rr, err)
+	}
+
+	// Run handles it, and stops when the context is canceled
+	ctx, cancel := context.WithTimeout(ctx, 1500*time.Millisecond)
+	defer cancel()
+	var got []string
+	err = c1.Run(ctx, func(ctx context.Context, msg *Message) error {
+		got = append(got, string(msg.Data))
+		if msg.Attempts < 2 {
+			return errors.New("try again")
+		}
+		return nil
+	})
+	if err != context.DeadlineExceeded || len(got) != 1 || got[0] != "doc-3" {
+		t.Errorf("Run error- expected doc-3 once then timeout, got %s, %v", got, err)
+	}
+}
+
+// func parseItem(it []byte) (id string, data []byte) {
+func Test_ParseItem(t *testing.T) {
+	tests := []struct {
+		it, id, data string
+	}{
+		{"12:<doc>a</doc>", "12", "<doc>a</doc>"},
+		{"12:a:b", "12", "a:b"},
+		{"<doc>a:b</doc>", "", "<doc>a:b</doc>"}, // from BLMOVE, before there were IDs
+		{":a", "", ":a"},
+		{"x1:a", "", "x1:a"},
+	}
+	for _, test := range tests {
+		if id, data := parseItem([]byte(test.it)); id != test.id || string(data) != test.data {
+			t.Errorf("parseItem error- %q expected %q %q got %q %q", test.it, test.id, test.data, id, data)
+		}
+	}
+}
+
+// Two copies of the same document are delivered with their own IDs, and an Ack of one does not make Reap think
+// the other has timed out.
+//
+// test depends on connecting to Redis and the ../cfg.json file
+func Test_ConsumerDuplicate(t *testing.T) {
+	gCfg := naLib.GlobalConfigType{
+		RedisHost: "127.0.0.1",
+		RedisPort: "6379",
+	}
+	naLib.ReadConfigFile("../cfg.json", &gCfg)
+
+	client, err := naLib.RedisClient(gCfg.RedisHost, gCfg.RedisPort, gCfg.RedisAuth)
+	if err != nil {
+		t.Errorf("RedisClient error- failed to connect- %s\n", err)
+		return
+	}
+	defer client.Close()
+
+	queue := "Test_ConsumerDuplicate:NEWS_XML"
+	keys := []interface{}{queue, queue + ":dead", queue + ":attempts", queue + ":consumers", queue + ":ids",
+		processingList(queue, "c1"), processingList(queue, "c1") + ":deliveries"}
+	client.Cmd("DEL", keys...)
+	defer client.Cmd("DEL", keys...)
+
+	c1, err := New(client, Config{Queue: queue, Name: "c1", VisibilityTimeout: time.Hour, BlockTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("New error- %s", err)
+	}
+	client.Cmd("LPUSH", queue, "doc-1", "doc-1")
+
+	ctx := context.Background()
+	m1, err := c1.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive error- %s", err)
+	}
+	m2, err := c1.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive error- %s", err)
+	}
+	if m1.ID == m2.ID || string(m1.Data) != "doc-1" || string(m2.Data) != "doc-1" {
+		t.Errorf("Receive error- expected two deliveries of doc-1 with different IDs, got %+v %+v", m1, m2)
+	}
+	if n, _ := client.Cmd("HLEN", processingList(queue, "c1")+":deliveries").Int(); n != 2 {
+		t.Errorf("Receive error- expected 2 delivery times, got %d", n)
+	}
+	if err = c1.Ack(m1); err != nil {
+		t.Errorf("Ack error- %s", err)
+	}
+	if rr, err := c1.Reap(); err != nil || rr.Requeued+rr.DeadLetter != 0 {
+		t.Errorf("Reap error- the second copy is still in its visibility timeout, got %s, %v", rr, err)
+	}
+	if s, _ := client.Cmd("LINDEX", processingList(queue, "c1"), 0).Str(); s != string(item(m2.ID, m2.Data)) {
+		t.Errorf("Ack error- expected only %s on the processing list, got %s", item(m2.ID, m2.Data), s)
+	}
+
+	// an entry left on the processing list by an older version has no ID and is reaped
+	client.Cmd("LPUSH", processingList(queue, "c1"), "doc-2")
+	if rr, err := c1.Reap(); err != nil || rr.Requeued != 1 {
+		t.Errorf("Reap error- expected the entry without an ID requeued, got %s, %v", rr, err)
+	}
+	if s, _ := client.Cmd("RPOP", queue).Str(); s != "doc-2" {
+		t.Errorf("Reap error- expected doc-2 back on the queue, got %s", s)
+	}
+}
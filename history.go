@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pschlump/news-aggregator/naLib"
+)
+
+// Each run saves a RunResult in the run history list, newest first, capped at RunHistory records.  The history
+// command and /admin/runs read it back.
+
+// runTally counts what the stages of one run did for the run history.  A nil *runTally counts nothing, for the
+// replay command.
+type runTally struct {
+	lock    sync.Mutex
+	pushed  int64
+	skipped int64
+	errors  []string
+	last    map[string]string // Last error for each archive that failed
+}
+
+// loaded counts the documents in a batch that were pushed and the ones skipped as already loaded.
+func (t *runTally) loaded(isNew []bool) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, n := range isNew {
+		if n {
+			t.pushed++
+		} else {
+			t.skipped++
+		}
+	}
+}
+
+// failed records an archive that could not be downloaded, extracted or loaded.
+func (t *runTally) failed(archive string, err error) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.errors = append(t.errors, fmt.Sprintf("%s: %s", archive, err))
+	if t.last == nil {
+		t.last = make(map[string]string)
+	}
+	t.last[archive] = err.Error()
+}
+
+// lastError returns the last error recorded for 'archive'.
+func (t *runTally) lastError(archive string) string {
+	if t == nil {
+		return ""
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.last[archive]
+}
+
+// result returns the counts and errors, with runErr, why the run stopped, first.
+func (t *runTally) result(runErr error) (pushed, skipped int64, errors []string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if runErr != nil {
+		errors = append(errors, runErr.Error())
+	}
+	return t.pushed, t.skipped, append(errors, t.errors...)
+}
+
+// saveRun adds the run to the run history and trims it to RunHistory records.  A failure is logged and does not
+// fail the run.
+func saveRun(store naLib.StateStore, rr RunResult) {
+	if gCfg.RunHistory <= 0 {
+		return
+	}
+	lg := naLib.Log(naLib.LogState)
+	data, err := json.Marshal(rr)
+	if err != nil {
+		lg.Error("unable to encode the run record", "run_id", rr.RunID, "error", err)
+		return
+	}
+	key := naLib.NewKeyspace(&gCfg).RunHistory()
+	if err = store.Enqueue(key, [][]byte{data}); err == nil {
+		_, err = store.Trim(key, gCfg.RunHistory)
+	}
+	if err != nil {
+		lg.Error("unable to save the run record", "run_id", rr.RunID, "error", err)
+	}
+}
+
+// RunHistory returns up to n of the newest run records, newest first.
+func RunHistory(store naLib.StateStore, n int) ([]RunResult, error) {
+	list, err := store.Recent(naLib.NewKeyspace(&gCfg).RunHistory(), n)
+	if err != nil {
+		return nil, err
+	}
+	runs := make([]RunResult, 0, len(list))
+	for _, data := range list {
+		var rr RunResult
+		if err = json.Unmarshal(data, &rr); err != nil {
+			return nil, fmt.Errorf("bad run record %q: %s", data, err)
+		}
+		runs = append(runs, rr)
+	}
+	return runs, nil
+}
+
+// cmdHistory lists the last -n runs, or shows one run in full if its run id is given.  Only the last RunHistory
+// runs are kept.
+func cmdHistory(store naLib.StateStore, args []string) int {
+	n := *Count
+	if len(args) > 0 {
+		n = gCfg.RunHistory
+	}
+	runs, err := RunHistory(store, n)
+	if err != nil {
+		naLib.Log(naLib.LogState).Error("unable to read the run history", "error", err)
+		return ExitError
+	}
+	if len(args) == 0 {
+		printResult(runs, func() {
+			fmt.Printf("%-22s %-8s %-19s %8s %6s %5s %6s %8s %8s %6s\n", "RUN ID", "TRIGGER", "STARTED", "DURATION", "FOUND", "NEW", "DONE", "PUSHED", "SKIPPED", "ERRORS")
+			for _, rr := range runs {
+				fmt.Printf("%-22s %-8s %-19s %8s %6d %5d %6d %8d %8d %6d\n", rr.RunID, rr.Trigger, rr.Started.Local().Format("2006-01-02 15:04:05"),
+					rr.Finished.Sub(rr.Started).Round(time.Second), rr.Found, rr.New, len(rr.Archives)-len(rr.Interrupted), rr.Pushed, rr.Skipped, len(rr.Errors))
+			}
+		})
+		return ExitOK
+	}
+	for _, rr := range runs {
+		if rr.RunID != args[0] {
+			continue
+		}
+		printResult(rr, func() {
+			fmt.Printf("Run %s (%s) from %s\n", rr.RunID, rr.Trigger, rr.Source)
+			fmt.Printf("Started %s, finished %s, took %s\n", rr.Started.Local().Format(time.RFC3339), rr.Finished.Local().Format(time.RFC3339), rr.Finished.Sub(rr.Started).Round(time.Millisecond))
+			fmt.Printf("Archives: %d found, %d new, %d processed, %d failed\n", rr.Found, rr.New, len(rr.Archives)-len(rr.Interrupted), len(rr.Failed))
+			fmt.Printf("Documents: %d pushed, %d skipped as already loaded\n", rr.Pushed, rr.Skipped)
+			for _, fn := range rr.Archives {
+				fmt.Printf("  %s\n", fn)
+			}
+			if len(rr.Interrupted) > 0 {
+				fmt.Printf("Interrupted: %s\n", rr.Interrupted)
+			}
+			if len(rr.Failed) > 0 {
+				fmt.Printf("Failed: %s\n", rr.Failed)
+			}
+			for _, e := range rr.Errors {
+				fmt.Printf("Error: %s\n", e)
+			}
+		})
+		return ExitOK
+	}
+	naLib.Log(naLib.LogState).Error("the run is not in the history", "run_id", args[0])
+	return ExitError
+}
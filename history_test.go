@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pschlump/news-aggregator/naLib"
+	"github.com/pschlump/news-aggregator/pipeline"
+)
+
+// func saveRun(store naLib.StateStore, rr RunResult) {
+// func RunHistory(store naLib.StateStore, n int) ([]RunResult, error) {
+func Test_RunHistory(t *testing.T) {
+	store := testConfig(t, naLib.GlobalConfigType{RunHistory: 3})
+
+	started := time.Date(2026, 3, 2, 18, 0, 0, 0, time.UTC)
+	var saved []RunResult
+	for i := 0; i < 5; i++ {
+		rr := RunResult{
+			RunID:       "run-" + string(rune('a'+i)),
+			Trigger:     "schedule",
+			Source:      "example.com",
+			Started:     started.Add(time.Duration(i) * time.Hour),
+			Finished:    started.Add(time.Duration(i)*time.Hour + 90*time.Second),
+			Found:       20,
+			New:         2,
+			Archives:    []string{"1600000019.zip", "1600000020.zip"},
+			Interrupted: []string{"1600000020.zip"},
+			Failed:      []string{},
+			Pushed:      1500,
+			Skipped:     3,
+			Errors:      []string{"1600000020.zip: canceled"},
+			Stats:       pipeline.Stats{Archives: 2, Downloaded: 2, Extracted: 1, Documents: 1503, Loaded: 1503, Canceled: true, Unfinished: []string{"1600000020.zip"}},
+		}
+		saveRun(store, rr)
+		saved = append(saved, rr)
+	}
+
+	runs, err := RunHistory(store, 10)
+	if err != nil {
+		t.Fatalf("Test_RunHistory: %s", err)
+	}
+	if len(runs) != 3 {
+		t.Fatalf("Test_RunHistory: expected the history trimmed to 3 got %d", len(runs))
+	}
+	for i, rr := range runs {
+		if ex := saved[4-i]; !reflect.DeepEqual(rr, ex) {
+			t.Errorf("Test_RunHistory: record %d expected\n%+v\ngot\n%+v", i, ex, rr)
+		}
+	}
+	if runs, _ = RunHistory(store, 1); len(runs) != 1 || runs[0].RunID != "run-e" {
+		t.Errorf("Test_RunHistory: expected the newest run got %+v", runs)
+	}
+
+	// with RunHistory 0 nothing is saved
+	gCfg.RunHistory = 0
+	saveRun(store, RunResult{RunID: "run-f"})
+	if runs, _ = RunHistory(store, 10); len(runs) != 3 || runs[0].RunID != "run-e" {
+		t.Errorf("Test_RunHistory: expected no record saved with RunHistory 0 got %+v", runs)
+	}
+}
+
+// func cmdHistory(store naLib.StateStore, args []string) int {
+func Test_CmdHistory(t *testing.T) {
+	store := testConfig(t, naLib.GlobalConfigType{RunHistory: 10})
+	saveRun(store, RunResult{
+		RunID:    "run-a",
+		Archives: []string{"a.zip", "b.zip", "c.zip"},
+		Failed:   []string{"b.zip", "c.zip"},
+		Stats:    pipeline.Stats{DownloadFailed: 3, LoadFailed: 1}, // b.zip was retried, c.zip failed to load
+	})
+
+	r, w, _ := os.Pipe()
+	stdout := os.Stdout
+	os.Stdout = w
+	code := cmdHistory(store, []string{"run-a"})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := ioutil.ReadAll(r)
+
+	if code != ExitOK || !strings.Contains(string(out), "3 processed, 2 failed") || !strings.Contains(string(out), "Failed: [b.zip c.zip]") {
+		t.Errorf("Test_CmdHistory: expected 2 failed archives got %d\n%s", code, out)
+	}
+}
+
+// func (t *runTally) result(runErr error) (pushed, skipped int64, errors []string) {
+func Test_RunTally(t *testing.T) {
+	var none *runTally
+	none.loaded([]bool{true})
+	none.failed("a.zip", errors.New("ignored"))
+
+	tally := &runTally{}
+	tally.loaded([]bool{true, false, true})
+	tally.failed("a.zip", errors.New("404 Not Found"))
+	pushed, skipped, errs := tally.result(errors.New("canceled"))
+	if pushed != 2 || skipped != 1 || !reflect.DeepEqual(errs, []string{"canceled", "a.zip: 404 Not Found"}) {
+		t.Errorf("Test_RunTally: expected 2 1 [canceled a.zip: 404 Not Found] got %d %d %q", pushed, skipped, errs)
+	}
+}
@@ -1,6 +1,7 @@
 package index
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
 	"net/http"
@@ -10,10 +11,10 @@ import (
 
 var ErrUnableToGetIndex = errors.New("Unable to get directory index")
 
-// data, err := index.GetDirectory(gCfg.LoadUrl)
-func GetDirectory(URL string) (data []byte, err error) {
+// data, err := index.GetDirectory(ctx, gCfg.LoadUrl)
+func GetDirectory(ctx context.Context, URL string) (data []byte, err error) {
 	var status int
-	status, data = HTTPGet(URL)
+	status, data = HTTPGet(ctx, URL)
 	if status != http.StatusOK {
 		err = ErrUnableToGetIndex
 	}
@@ -23,7 +24,7 @@ func GetDirectory(URL string) (data []byte, err error) {
 var matchLine *regexp.Regexp
 
 func init() {
-	matchLine = regexp.MustCompile(`<tr><td><a href="([0-9][0-9]*.zip)">`)
+	matchLine = regexp.MustCompile(`<tr><td><a href="([0-9][0-9]*\.(zip|tar|tgz|tar\.gz|gz|tar\.bz2|bz2|tar\.xz|xz))">`)
 }
 
 // ParseDirectory takes a directory listing from a file server and extracts the list of file names.
@@ -44,8 +45,13 @@ func ParseDirectory(data []byte) (fns []string, err error) {
 }
 
 // TODO: may be better to have a streaming return on this - but ... this is simple for testing.
-func HTTPGet(URL string) (status int, rv []byte) {
-	res, err := http.Get(URL)
+// The request is canceled if ctx is canceled.
+func HTTPGet(ctx context.Context, URL string) (status int, rv []byte) {
+	req, err := http.NewRequestWithContext(ctx, "GET", URL, nil)
+	if err != nil {
+		return 500, []byte("")
+	}
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return 500, []byte("")
 	} else {
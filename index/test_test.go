@@ -1,6 +1,7 @@
 package index
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -36,7 +37,7 @@ func Test_GetDirectory(t *testing.T) {
 		log.Fatal(http.ListenAndServe(":19191", nil))
 	}()
 
-	data, err := GetDirectory(gCfg.LoadUrl + "/")
+	data, err := GetDirectory(context.Background(), gCfg.LoadUrl+"/")
 
 	// fmt.Printf("err=%s, [%s]\n", err, data)
 	if err != nil {
@@ -80,3 +81,20 @@ func Test_ParseDirectory(t *testing.T) {
 	}
 
 }
+
+func Test_ParseDirectoryTarballs(t *testing.T) {
+	data := []byte(`<tr><td><a href="1471622300928.tar.gz">1471622300928.tar.gz</a></td></tr>
+<tr><td><a href="1471622300929.tgz">1471622300929.tgz</a></td></tr>
+<tr><td><a href="1471622300930.xml.bz2">1471622300930.xml.bz2</a></td></tr>
+<tr><td><a href="1471622300931.xz">1471622300931.xz</a></td></tr>
+<tr><td><a href="1471622300932.txt">1471622300932.txt</a></td></tr>`)
+
+	fns, err := ParseDirectory(data)
+
+	if err != nil {
+		t.Errorf("Test_ParseDirectoryTarballs")
+	}
+	if len(fns) != 3 || fns[0] != "1471622300928.tar.gz" || fns[1] != "1471622300929.tgz" || fns[2] != "1471622300931.xz" {
+		t.Errorf("Test_ParseDirectoryTarballs: got %s", fns)
+	}
+}
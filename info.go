@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pschlump/news-aggregator/index"
+	"github.com/pschlump/news-aggregator/naLib"
+	"github.com/pschlump/news-aggregator/unzip"
+)
+
+// The commands that report on the remote directory, the state and the configuration.
+
+// RemoteArchive is one archive in the directory listing at LoadUrl.
+type RemoteArchive struct {
+	Name       string
+	Downloaded bool
+}
+
+// cmdListRemote lists the archives at LoadUrl and if each one has already been downloaded.
+func cmdListRemote(store naLib.StateStore, args []string) int {
+	data, err := index.GetDirectory(shutdown.Ctx, gCfg.LoadUrl)
+	if err != nil {
+		naLib.Log(naLib.LogDownload).Error("unable to get the directory listing", "url", gCfg.LoadUrl, "error", err)
+		return ExitError
+	}
+	fList, err := index.ParseDirectory(data)
+	if err != nil {
+		naLib.Log(naLib.LogDownload).Error("unable to parse the directory listing", "url", gCfg.LoadUrl, "error", err)
+		return ExitError
+	}
+	key := naLib.NewKeyspace(&gCfg).Downloaded()
+	list := make([]RemoteArchive, 0, len(fList))
+	for _, fn := range fList {
+		found, err := store.IsMember(key, fn)
+		if err != nil {
+			naLib.Log(naLib.LogState).Error("unable to check if the archive was downloaded", "archive", fn, "error", err)
+			return ExitError
+		}
+		list = append(list, RemoteArchive{Name: fn, Downloaded: found})
+	}
+	printResult(list, func() {
+		for _, ra := range list {
+			state := "new"
+			if ra.Downloaded {
+				state = "downloaded"
+			}
+			fmt.Printf("%-30s %s\n", ra.Name, state)
+		}
+	})
+	return ExitOK
+}
+
+// StateList is the output of list-state.
+type StateList struct {
+	Downloaded  []string
+	Quarantined map[string]string // Archive name -> reason
+}
+
+// cmdListState lists the archives that have been downloaded and the ones that were quarantined.
+func cmdListState(store naLib.StateStore, args []string) int {
+	ks := naLib.NewKeyspace(&gCfg)
+	sl := StateList{Quarantined: make(map[string]string)}
+	err := store.Members(ks.Downloaded(), func(fn string) error {
+		sl.Downloaded = append(sl.Downloaded, fn)
+		return nil
+	})
+	if err == nil {
+		err = store.Fields(ks.Quarantine(), func(fn, reason string) error {
+			sl.Quarantined[fn] = reason
+			return nil
+		})
+	}
+	if err != nil {
+		naLib.Log(naLib.LogState).Error("unable to read the state", "error", err)
+		return ExitError
+	}
+	sort.Strings(sl.Downloaded)
+	printResult(sl, func() {
+		fmt.Printf("Downloaded (%d):\n", len(sl.Downloaded))
+		for _, fn := range sl.Downloaded {
+			fmt.Printf("\t%s\n", fn)
+		}
+		fmt.Printf("Quarantined (%d):\n", len(sl.Quarantined))
+		for fn, reason := range sl.Quarantined {
+			fmt.Printf("\t%-30s %s\n", fn, reason)
+		}
+	})
+	return ExitOK
+}
+
+// Status is the output of the status command.
+type Status struct {
+	StateBackend   string
+	DedupeBackend  string
+	Queue          string // The list the documents are pushed onto
+	QueueLength    int
+	OutputHigh     int    `json:",omitempty"`
+	OutputPolicy   string `json:",omitempty"`
+	Downloaded     int    // Archives in the downloaded set
+	Quarantined    int
+	Schedule       string           `json:",omitempty"` // RunSchedule, or the RunFreq interval
+	NextRun        *time.Time       `json:",omitempty"`
+	NextRunSource  string           `json:",omitempty"` // "running process" or "configuration"
+	RedisLastError string           `json:",omitempty"`
+	RedisLastOk    *time.Time       `json:",omitempty"`
+	Bloom          *naLib.BloomInfo `json:",omitempty"`
+}
+
+// cmdStatus shows the state store, the length of the list and the number of archives processed.
+func cmdStatus(store naLib.StateStore, args []string) int {
+	ks := naLib.NewKeyspace(&gCfg)
+	st := Status{
+		StateBackend:  gCfg.StateBackend,
+		DedupeBackend: gCfg.DedupeBackend,
+		Queue:         ks.NewsXML(),
+	}
+	if gCfg.OutputHighWater > 0 {
+		st.OutputHigh, st.OutputPolicy = gCfg.OutputHighWater, gCfg.OutputOverflowPolicy
+	}
+	if gCfg.RunSchedule != "" {
+		st.Schedule = gCfg.RunSchedule
+	} else if gCfg.RunFreq > 0 {
+		st.Schedule = fmt.Sprintf("every %d seconds", gCfg.RunFreq)
+	}
+	if next, source := NextRun(store); !next.IsZero() {
+		st.NextRun, st.NextRunSource = &next, source
+	}
+	var err error
+	if st.QueueLength, err = store.Len(ks.NewsXML()); err == nil {
+		if st.Downloaded, err = store.Count(ks.Downloaded()); err == nil {
+			st.Quarantined, err = store.Count(ks.Quarantine())
+		}
+	}
+	if client, ok := store.(*naLib.RedisStore); ok {
+		if rc, ok := client.Client().(*naLib.RedisConn); ok {
+			rc.Ping()
+			lastErr, lastOk := rc.Status()
+			if lastErr != nil {
+				st.RedisLastError = lastErr.Error()
+			}
+			if !lastOk.IsZero() {
+				st.RedisLastOk = &lastOk
+			}
+		}
+		if gCfg.DedupeBackend == naLib.DedupeBloom {
+			if bi, e := naLib.GetBloomInfo(client.Client(), &gCfg); e == nil {
+				st.Bloom = &bi
+			}
+		}
+	}
+	if err != nil {
+		naLib.Log(naLib.LogState).Error("unable to read the state", "error", err)
+		return ExitError
+	}
+	printResult(st, func() {
+		fmt.Printf("State:        %s, dedupe with %s\n", st.StateBackend, st.DedupeBackend)
+		fmt.Printf("Queue:        %s, %d documents\n", st.Queue, st.QueueLength)
+		if st.OutputHigh > 0 {
+			fmt.Printf("Backpressure: %s at %d documents\n", st.OutputPolicy, st.OutputHigh)
+		}
+		fmt.Printf("Archives:     %d downloaded, %d quarantined\n", st.Downloaded, st.Quarantined)
+		if st.Schedule != "" {
+			fmt.Printf("Schedule:     %s\n", st.Schedule)
+		}
+		if st.NextRun != nil {
+			fmt.Printf("Next run:     %s (from the %s)\n", st.NextRun.Format(time.RFC3339), st.NextRunSource)
+		}
+		if st.RedisLastError != "" {
+			fmt.Printf("Redis:        %s\n", st.RedisLastError)
+		}
+		if st.Bloom != nil {
+			fmt.Printf("Bloom filter: %s\n", st.Bloom)
+		}
+	})
+	return ExitOK
+}
+
+// Inspection is the output of the inspect command.
+type Inspection struct {
+	Archive    string
+	Format     string
+	Downloaded bool
+	Documents  []InspectedDocument
+	TotalBytes int64
+	Error      string `json:",omitempty"` // Why the archive would be quarantined
+}
+
+// InspectedDocument is one document in an inspected archive.
+type InspectedDocument struct {
+	Name  string
+	Bytes int64
+}
+
+// cmdInspect lists the documents in an archive without loading them.  The archive is a local file, or if there is
+// no file with that name it is downloaded from LoadUrl.
+func cmdInspect(store naLib.StateStore, args []string) int {
+	fn, fpfn := filepath.Base(args[0]), args[0]
+	if _, err := os.Stat(fpfn); err != nil {
+		dir, err := TempDir(shutdown.Ctx)
+		if err != nil {
+			return ExitError
+		}
+		defer os.RemoveAll(dir)
+		fpfn, err = naLib.DownloadFile(shutdown.Ctx, args[0], dir, &gCfg)
+		if err != nil {
+			naLib.Log(naLib.LogDownload).Error("unable to download", "archive", args[0], "error", err)
+			return ExitError
+		}
+	}
+
+	in := Inspection{Archive: fn}
+	in.Downloaded, _ = store.IsMember(naLib.NewKeyspace(&gCfg).Downloaded(), fn)
+	if fp, err := os.Open(fpfn); err == nil {
+		head, _ := bufio.NewReader(fp).Peek(512)
+		in.Format = unzip.DetectFormat(head).String()
+		fp.Close()
+	}
+	err := unzip.WalkLimited(shutdown.Ctx, fpfn, ArchiveLimits(), func(name string, rd io.Reader) error {
+		n, err := io.Copy(ioutil.Discard, rd)
+		in.Documents = append(in.Documents, InspectedDocument{Name: name, Bytes: n})
+		in.TotalBytes += n
+		return err
+	})
+	if err != nil {
+		in.Error = err.Error()
+	}
+	printResult(in, func() {
+		fmt.Printf("%s: %s, %d documents, %d bytes, downloaded %v\n", in.Archive, in.Format, len(in.Documents), in.TotalBytes, in.Downloaded)
+		for _, d := range in.Documents {
+			fmt.Printf("\t%10d %s\n", d.Bytes, d.Name)
+		}
+		if in.Error != "" {
+			fmt.Printf("Error: %s\n", in.Error)
+		}
+	})
+	if in.Error != "" {
+		return ExitError
+	}
+	return ExitOK
+}
+
+// ConfigCheck is the output of config-check.
+type ConfigCheck struct {
+	Config   string // The configuration file
+	Problems []string
+}
+
+// cmdConfigCheck checks the configuration with naLib.CheckConfig and then opens the state store, which connects to
+// Redis with the "redis" StateBackend.
+func cmdConfigCheck(_ naLib.StateStore, args []string) int {
+	cc := ConfigCheck{Config: *Cfg, Problems: naLib.CheckConfig(&gCfg)}
+	if len(cc.Problems) == 0 {
+		store, err := naLib.NewStateStore(&gCfg)
+		if err != nil {
+			cc.Problems = append(cc.Problems, fmt.Sprintf("Unable to open %s state store: %s", gCfg.StateBackend, err))
+		} else {
+			store.Close()
+		}
+	}
+	printResult(cc, func() {
+		if len(cc.Problems) == 0 {
+			fmt.Printf("%s: ok\n", cc.Config)
+			return
+		}
+		for _, p := range cc.Problems {
+			fmt.Printf("%s: %s\n", cc.Config, p)
+		}
+	})
+	if len(cc.Problems) > 0 {
+		return ExitConfig
+	}
+	return ExitOK
+}
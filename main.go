@@ -4,24 +4,23 @@ package main
 // News aggregate
 // Author: Philip Schlump
 // github.com:   https://github.com/pschlump/news-aggregator.git
-//
-// TODO:
-//	1. 	A 2nd program that cleans up the old data in RedisKeySetOfFilesDownloaded.   This would be simple
-//	  	since the file names are time stamps.   A cron job could do this.
+// Usage:
+//	news-aggregator [flags] [command [flags] [args]]
+// With no command, "run".  See Commands in commands.go, or news-aggregator help, for the list of commands.
 //
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/pschlump/news-aggregator/index"
 	"github.com/pschlump/news-aggregator/naLib"
-	"github.com/pschlump/news-aggregator/unzip"
-	"github.com/pschlump/radix.v2/redis"
+	"github.com/pschlump/news-aggregator/pipeline"
 )
 
 var gCfg = naLib.GlobalConfigType{
@@ -36,11 +35,55 @@ var gCfg = naLib.GlobalConfigType{
 	TmpDir:                      "./tmp",
 	TmpPrefix:                   "na_",
 	RedisKeyNewsXML:             "NEWS_XML",
+	RedisKeyQuarantine:          "quarantined-files",
+	DownloadWorkers:             2,
+	ExtractWorkers:              2,
+	LoadWorkers:                 4,
+	ArchiveBuffer:               2,
+	DocumentBuffer:              100,
+	RedisBatchSize:              100,
+	RedisPoolSize:               10,
+	RedisTimeout:                30,
+	RedisRetries:                5,
+	RedisHealthCheck:            30,
+	ArchiveMaxEntries:           100000,
+	ArchiveMaxEntryBytes:        100 * 1024 * 1024,
+	ArchiveMaxTotalBytes:        2 * 1024 * 1024 * 1024,
+	ArchiveMaxRatio:             200,
+	ArchiveMaxDepth:             2,
+	ArchiveMaxAttempts:          5,
+	StateBackend:                "redis",
+	StateFile:                   "news-aggregator.db",
+	DedupeBackend:               "keys",
+	BloomCapacity:               1000000,
+	BloomErrorRate:              0.001,
+	BloomExactCheck:             true,
+	BloomExactBuckets:           65536,
+	ShutdownGrace:               30,
+	RunLeaseTTL:                 600,
+	HealthMaxRunTime:            6 * 60 * 60,
+	ReadyIndexCycles:            3,
+	RunHistory:                  1000,
 }
 
-var Rerun = flag.String("rerun", "", "Rerun of a specific .zip file")                  //
-var URL = flag.String("URL", "", "Load from URL - overrides default in cfg.json file") //
-var Cfg = flag.String("cfg", "cfg.json", "Configuraiton and Redis connection info")    //
+var Rerun = flag.String("rerun", "", "Rerun of a specific .zip file")                         //
+var URL = flag.String("URL", "", "Load from URL - overrides default in cfg.json file")        //
+var Cfg = flag.String("cfg", "cfg.json", "Configuraiton and Redis connection info")           //
+var DryRun = flag.Bool("dry-run", false, "Report what would be done without changing Redis")  //
+var Days = flag.Int("days", 0, "Age in days for prune - overrides RetentionDays in cfg.json") //
+var JSON = flag.Bool("json", false, "Print the results of commands as JSON")                  //
+var Download = flag.Bool("download", false, "With -dry-run, also count the new documents")    //
+var Count = flag.Int("n", 20, "Number of runs to list for history")                           //
+
+// backpressure is shared by all of the runs so that the time spent throttled is a running total.
+var backpressure *naLib.Backpressure
+
+// metrics are the Prometheus metrics, served by StartServer.
+var metrics *naLib.Metrics
+
+// health tracks the run loop for /healthz and /readyz.
+var health *naLib.Health
+
 func init() {
 	flag.StringVar(Rerun, "r", "", "Rerun of a specific .zip file")                    //
 	flag.StringVar(URL, "u", "", "Load from URL - overrides default in cfg.json file") //
@@ -49,138 +92,239 @@ func init() {
 
 func main() {
 
+	flag.Usage = Usage
 	flag.Parse()
 
 	// read in config file
 	naLib.ReadConfigFile(*Cfg, &gCfg)
-
-	if naLib.IsDbOn("dbVerbose", &gCfg) { // this is for testing - leave temporary directory in place
-		fmt.Printf("Servcie: [%s] Started\n", gCfg.ServiceName)
+	if err := naLib.InitLogging(&gCfg); err != nil {
+		naLib.Log(naLib.LogRun).Warn("logging configuration", "error", err)
 	}
+	naLib.Log(naLib.LogRun).Debug("service started", "service", gCfg.ServiceName)
 
 	// override configuration items from command line ( -u flag )
 	if URL != nil && len(*URL) > 0 {
 		gCfg.LoadUrl = *URL
 	}
 
-	// connect to Redis
-	client, err := naLib.RedisClient(gCfg.RedisHost, gCfg.RedisPort, gCfg.RedisAuth)
-	if err != nil {
-		log.Printf("Unable to connect to Redis, error=%s", err)
-		return
-	}
-
-	os.Mkdir(gCfg.TmpDir, 0700)
-
-	// iterate in a loop if RunFreq > 0, else just run once
-	if gCfg.RunFreq > 0 {
-		for n := 1; ; n++ {
-			if naLib.IsDbOn("dbVerbose", &gCfg) { // this is for testing - leave temporary directory in place
-				fmt.Printf("Running every %d seconds, iteration %d\n", gCfg.RunFreq, n)
-			}
-			RunMainProcess(client)
-			time.Sleep(time.Duration(gCfg.RunFreq) * time.Second)
-		}
-	} else {
-		if naLib.IsDbOn("dbVerbose", &gCfg) { // this is for testing - leave temporary directory in place
-			fmt.Printf("Running just once\n")
+	// with no command, run - the -rerun flag is the same as the rerun command
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"run"}
+		if Rerun != nil && len(*Rerun) > 0 {
+			args = []string{"rerun", *Rerun}
 		}
-		RunMainProcess(client)
 	}
+	os.Exit(RunCommand(args))
+}
 
+// RunOptions changes which archives RunMainProcess processes, for the rerun command.
+type RunOptions struct {
+	Archives []string // If set, only these archives are processed
+	Force    bool     // Process the archives even if they have already been downloaded
+	Trigger  string   // What started the run, for the run history: "schedule", "admin", "once", "rerun"
 }
 
-// RunMainProcess splits the main() into  2 parts to make it easy to process gCfg.RunFreq flag.
-func RunMainProcess(client *redis.Client) {
+// RunResult is what one pass of RunMainProcess did.  It is saved in the run history.
+type RunResult struct {
+	RunID       string    // In the run_id field of everything logged for the run
+	Trigger     string    // From RunOptions
+	Source      string    // The "source" label on the metrics, the host in LoadUrl
+	Started     time.Time //
+	Finished    time.Time //
+	Found       int       // Archives in the directory listing
+	New         int       // Archives in the listing that had not been downloaded
+	Archives    []string  // The archives that were processed
+	Resumed     []string  // Archives interrupted by the last shutdown that were processed again
+	Interrupted []string  // Archives that were not finished because of a shutdown, they are resumed at the next run
+	Failed      []string  // Archives where a download, extract or load failed, they are tried again at the next run
+	Pushed      int64     // Documents pushed onto the list
+	Skipped     int64     // Documents that had already been loaded
+	Errors      []string  `json:",omitempty"` // Why the run stopped, and each archive that failed
+	Stats       pipeline.Stats
+}
+
+// RunMainProcess is one pass: find the new archives in the directory listing at LoadUrl, then download, extract
+// and load them.  An error is returned if the listing can not be read or the state store fails, errors with
+// single archives are counted in the Stats.
+//
+// Each archive is in the Interrupted set in the state store while it is being processed.  Archives left there by a
+// shutdown (or a crash) are processed again at the start of the next pass - documents that were already loaded
+// are skipped.
+func RunMainProcess(ctx context.Context, store naLib.StateStore, opts RunOptions) (rr RunResult, err error) {
+	ks := naLib.NewKeyspace(&gCfg)
+	rr.RunID, rr.Trigger, rr.Source, rr.Started = naLib.NewRunID(), opts.Trigger, naLib.MetricsSource(&gCfg), time.Now()
+	ctx = naLib.WithLogAttrs(ctx, "run_id", rr.RunID, "source", rr.Source)
+	lg := naLib.Log(naLib.LogRun)
+	tally := &runTally{}
+	defer func() {
+		rr.Finished = time.Now()
+		rr.Pushed, rr.Skipped, rr.Errors = tally.result(err)
+		saveRun(store, rr)
+	}()
 
 	// get list of files -- directory listing via http.Get()
-	data, err := index.GetDirectory(gCfg.LoadUrl)
+	start := time.Now()
+	data, err := index.GetDirectory(ctx, gCfg.LoadUrl)
 	if err != nil {
-		log.Printf("Unable to get directory from %s, error=%s", gCfg.LoadUrl, err)
+		metrics.IndexFetch(time.Since(start), err)
+		health.IndexFetched(err)
+		naLib.Log(naLib.LogDownload).ErrorContext(ctx, "unable to get the directory listing", "url", gCfg.LoadUrl, "error", err)
 		return
 	}
 
 	// parse to list of file names
 	fList, err := index.ParseDirectory(data)
+	rr.Found = len(fList)
+	metrics.IndexFetch(time.Since(start), err)
+	health.IndexFetched(err)
 	if err != nil {
-		log.Printf("Unable to parse directory from %s, error=%s", gCfg.LoadUrl, err)
+		naLib.Log(naLib.LogDownload).ErrorContext(ctx, "unable to parse the directory listing", "url", gCfg.LoadUrl, "error", err)
 		return
 	}
 
-	// remove duplicates for download (if dbOnly1File, then only run 1 file) -- if Rerun - then search for that file
-	if Rerun != nil && len(*Rerun) > 0 {
-		if naLib.InArray(*Rerun, fList) {
-			fList = []string{*Rerun}
-		} else {
-			log.Printf("Unable to rerun %s - file is not available.", *Rerun)
+	// remove duplicates for download (if dbOnly1File, then only run 1 file) -- if rerun - then search for those files
+	if len(opts.Archives) > 0 {
+		for _, fn := range opts.Archives {
+			if !naLib.InArray(fn, fList) {
+				lg.ErrorContext(ctx, "unable to rerun, the archive is not in the directory listing", "archive", fn)
+				return rr, fmt.Errorf("%s is not in the directory listing at %s", fn, gCfg.LoadUrl)
+			}
+		}
+		fList = opts.Archives
+	}
+	newList, err := naLib.RemoveDuplicateDownloadFiles(store, fList, &gCfg)
+	if err != nil {
+		lg.ErrorContext(ctx, "unable to check for archives already downloaded", "error", err)
+		return
+	}
+	rr.New = len(newList)
+	metrics.Discovered(len(newList))
+	if !opts.Force {
+		fList = newList
+	}
+	if len(opts.Archives) == 0 {
+		err = store.Members(ks.Interrupted(), func(fn string) error {
+			if !naLib.InArray(fn, fList) {
+				rr.Resumed = append(rr.Resumed, fn)
+			}
+			return nil
+		})
+		if err != nil {
+			lg.ErrorContext(ctx, "unable to read the interrupted archives", "error", err)
 			return
 		}
+		if len(rr.Resumed) > 0 {
+			lg.InfoContext(ctx, "resuming archives interrupted by the last shutdown", "archives", rr.Resumed)
+			fList = append(rr.Resumed, fList...)
+		}
 	}
-	fList = naLib.RemoveDuplicateDownloadFiles(client, fList, &gCfg)
 	if naLib.IsDbOn("dbOnly1File", &gCfg) { // this is for testing - to only run 1 file
 		if len(fList) > 1 {
-			fmt.Printf("Debug flag %s is on, only run 1 file, list reduced from %s to %s\n", "dbOnly1File", fList, fList[0:1])
+			lg.DebugContext(ctx, "debug flag dbOnly1File is on, only running 1 archive", "archives", fList, "archive", fList[0])
 			fList = fList[0:1]
 		}
 	}
+	rr.Archives = fList
 	if len(fList) == 0 {
-		fmt.Printf("No new files to process\n")
+		lg.DebugContext(ctx, "no new archives", "duration", time.Since(start))
+		metrics.RunSucceeded()
 		return
 	}
-	if naLib.IsDbOn("dbVerbose", &gCfg) { // this is for testing - leave temporary directory in place
-		fmt.Printf("Processing %s\n", fList)
-	}
+	lg.InfoContext(ctx, "run started", "archives", fList)
 
 	// probably need to download into a tmp directory -- Create the tmp-dir
-	name, err := ioutil.TempDir(gCfg.TmpDir, gCfg.TmpPrefix)
+	name, err := TempDir(ctx)
 	if err != nil {
-		log.Printf("Unable to create temporary directory, error=%s", err)
 		return
 	}
-	if naLib.IsDbOn("dbVerbose", &gCfg) { // this is for testing - leave temporary directory in place
-		fmt.Printf("Name=%s\n", name)
-	}
 
-	// download files form list -- may want to do this in parallel --
-	fpfnList := naLib.DownloadZipFiles(fList, name, &gCfg)
-
-	for ii, zip := range fpfnList {
-		// skip, just use "name" - create temporary directory for each file to extract into - one temporary for each file - (if db2 then leave directory after run)
-		zipname, err := ioutil.TempDir(name, fList[ii]) // don't much like this.
-		if err != nil {
-			log.Printf("Error: Unable to create temporary directory in %s", name)
-		} else {
-
-			// extract each .zip file - get list of file names. (if dbLeaveTmpDir then leave .zip file, else if no error then discard)
-			zipList, err := unzip.UnZip(zip, zipname)
-			if err != nil {
-				log.Printf("Error: Unable to unzip %s", zip)
-			} else {
-
-				if naLib.IsDbOn("dbPrintListOfZipFiles", &gCfg) { // this is for testing - leave temporary directory in place
-					fmt.Printf("for %s in %s list of .zip files = %s\n", zip, zipname, zipList)
-				}
-
-				// for each xml in .zip file -- use zipList
-				for _, xmlfn := range zipList {
-					//		if it is not already loaded
-					key := gCfg.RedisPrefix + ":" + xmlfn
-					if naLib.SetIfNotExists(client, xmlfn, key) {
-						naLib.RedisLoadFile(client, gCfg.RedisKeyNewsXML, zipname+"/"+xmlfn, &gCfg)
-					}
-				}
-
-				// cleanup temporary files
-				if !naLib.IsDbOn("dbLeaveTmpDir", &gCfg) { // this is for testing - leave temporary directory in place
-					os.RemoveAll(zipname)
-				}
-
-			}
+	// download, extract and load the files in a pipeline so that the stages overlap
+	if _, err = store.AddNew(ks.Interrupted(), fList); err != nil {
+		lg.ErrorContext(ctx, "unable to save the archives in progress", "error", err)
+		return
+	}
+	rr.Stats = pipeline.Run(ctx, PipelineConfig(), fList, DownloadStage(name, tally), ExtractStage(store, name, tally), LoadStage(store, backpressure, tally))
+	rr.Interrupted = rr.Stats.Unfinished
+	for _, fn := range rr.Stats.Failed {
+		if _, quarantined, e := store.GetField(ks.Quarantine(), fn); e == nil && quarantined {
+			continue // a quarantined archive is not tried again
+		}
+		if !failedAttempt(ctx, store, fn, tally.lastError(fn)) {
+			rr.Failed = append(rr.Failed, fn)
 		}
 	}
+	var finished []string
+	for _, fn := range fList {
+		if !naLib.InArray(fn, rr.Interrupted) && !naLib.InArray(fn, rr.Failed) {
+			finished = append(finished, fn)
+		}
+	}
+	if e := store.Remove(ks.Interrupted(), finished); e != nil {
+		lg.ErrorContext(ctx, "unable to update the archives in progress", "error", e)
+	}
+	if e := store.RemoveFields(ks.Attempts(), finished); e != nil {
+		lg.ErrorContext(ctx, "unable to clear the failed attempts", "error", e)
+	}
+	if len(rr.Failed) > 0 {
+		lg.WarnContext(ctx, "archives failed and will be tried again at the next run", "archives", rr.Failed)
+	}
+	if len(rr.Interrupted) > 0 {
+		lg.WarnContext(ctx, "archives were interrupted and will be resumed at the next run", "archives", rr.Interrupted)
+	} else {
+		metrics.RunSucceeded()
+	}
+	throttled, dropped := backpressure.Stats()
+	lg.InfoContext(ctx, "run finished", "duration", time.Since(start), "downloaded", rr.Stats.Downloaded, "extracted", rr.Stats.Extracted,
+		"documents", rr.Stats.Documents, "loaded", rr.Stats.Loaded, "failed", rr.Stats.DownloadFailed+rr.Stats.ExtractFailed+rr.Stats.LoadFailed,
+		"throttled_total", throttled, "dropped_total", dropped)
 
 	// cleanup - remove temporary directories
 	if !naLib.IsDbOn("dbLeaveTmpDir", &gCfg) { // this is for testing - leave temporary directory in place
 		os.RemoveAll(name)
 	}
+	return
+}
+
+// failedAttempt counts a run that the archive 'fn' failed in.  After ArchiveMaxAttempts runs in a row the archive
+// is quarantined, so that one that can never be loaded is not tried again forever, and true is returned.
+func failedAttempt(ctx context.Context, store naLib.StateStore, fn, lastErr string) (quarantined bool) {
+	ks := naLib.NewKeyspace(&gCfg)
+	lg := naLib.Log(naLib.LogRun)
+	n := 0
+	if v, ok, err := store.GetField(ks.Attempts(), fn); err != nil {
+		lg.ErrorContext(ctx, "unable to read the failed attempts", "archive", fn, "error", err)
+		return
+	} else if ok {
+		n, _ = strconv.Atoi(v)
+	}
+	n++
+	if gCfg.ArchiveMaxAttempts <= 0 || n < gCfg.ArchiveMaxAttempts {
+		if err := store.SetField(ks.Attempts(), fn, strconv.Itoa(n)); err != nil {
+			lg.ErrorContext(ctx, "unable to save the failed attempts", "archive", fn, "error", err)
+		}
+		return
+	}
+	reason := fmt.Sprintf("failed in %d runs, last error: %s", n, lastErr)
+	if err := store.SetField(ks.Quarantine(), fn, reason); err != nil {
+		lg.ErrorContext(ctx, "unable to record the quarantine", "archive", fn, "error", err)
+		return
+	}
+	if err := store.RemoveFields(ks.Attempts(), []string{fn}); err != nil {
+		lg.ErrorContext(ctx, "unable to clear the failed attempts", "archive", fn, "error", err)
+	}
+	lg.WarnContext(ctx, "quarantined", "archive", fn, "reason", reason)
+	return true
+}
+
+// TempDir creates a new temporary directory in TmpDir for downloading archives into.
+func TempDir(ctx context.Context) (name string, err error) {
+	os.Mkdir(gCfg.TmpDir, 0700)
+	name, err = ioutil.TempDir(gCfg.TmpDir, gCfg.TmpPrefix)
+	if err != nil {
+		naLib.Log(naLib.LogDownload).ErrorContext(ctx, "unable to create the temporary directory", "dir", gCfg.TmpDir, "error", err)
+		return
+	}
+	naLib.Log(naLib.LogDownload).DebugContext(ctx, "temporary directory", "dir", name)
+	return
 }
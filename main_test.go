@@ -0,0 +1,170 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pschlump/news-aggregator/naLib"
+)
+
+// testConfig sets gCfg for a test, with the memory state store, and puts it back when the test is done.
+func testConfig(t *testing.T, cfg naLib.GlobalConfigType) naLib.StateStore {
+	saved := gCfg
+	t.Cleanup(func() { gCfg = saved })
+	gCfg = cfg
+	gCfg.StateBackend = naLib.StateMemory
+	if gCfg.TmpDir == "" {
+		gCfg.TmpDir, gCfg.TmpPrefix = t.TempDir(), "na_"
+	}
+	if gCfg.RedisBatchSize == 0 {
+		gCfg.RedisBatchSize = 10
+	}
+	metrics = naLib.NewMetrics(&gCfg)
+	health = naLib.NewHealth(&gCfg)
+	backpressure = naLib.NewBackpressure(naLib.NewKeyspace(&gCfg).NewsXML(), &gCfg)
+	store := naLib.NewMemoryStore(nil, &gCfg)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// testArchive returns a zip with the documents in it.
+func testArchive(t *testing.T, docs ...string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, d := range docs {
+		w, err := zw.Create(d)
+		if err != nil {
+			t.Fatalf("testArchive: %s", err)
+		}
+		fmt.Fprintf(w, "<doc>%s</doc>", d)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+// testSource is a directory listing and archives for LoadUrl.  An archive that is in the listing but not in files
+// gets a 404.
+type testSource struct {
+	lock  sync.Mutex
+	files map[string][]byte
+	names []string
+}
+
+func (ts *testSource) set(name string, data []byte) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.files[name] = data
+}
+
+func (ts *testSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if r.URL.Path == "/" {
+		for _, fn := range ts.names {
+			fmt.Fprintf(w, "<tr><td><a href=\"%s\">%s</a></td></tr>\n", fn, fn)
+		}
+		return
+	}
+	data, ok := ts.files[r.URL.Path[1:]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(data)
+}
+
+// newTestSource serves the archives in 'names', sets LoadUrl to it and returns it.
+func newTestSource(t *testing.T, names ...string) *testSource {
+	ts := &testSource{files: make(map[string][]byte), names: names}
+	srv := httptest.NewServer(ts)
+	t.Cleanup(srv.Close)
+	gCfg.LoadUrl = srv.URL
+	return ts
+}
+
+// func RunMainProcess(ctx context.Context, store naLib.StateStore, opts RunOptions) (rr RunResult, err error) {
+func Test_RunMainProcessRetry(t *testing.T) {
+	store := testConfig(t, naLib.GlobalConfigType{RunHistory: 10})
+	ts := newTestSource(t, "1600000001.zip", "1600000002.zip")
+	ts.set("1600000001.zip", testArchive(t, "a.xml", "b.xml"))
+	ks := naLib.NewKeyspace(&gCfg)
+
+	rr, err := RunMainProcess(context.Background(), store, RunOptions{Trigger: "once"})
+	if err != nil {
+		t.Fatalf("Test_RunMainProcessRetry: %s", err)
+	}
+	if len(rr.Failed) != 1 || rr.Failed[0] != "1600000002.zip" || rr.Pushed != 2 {
+		t.Errorf("Test_RunMainProcessRetry: expected 1600000002.zip to fail got %+v", rr)
+	}
+	if in, _ := store.IsMember(ks.Interrupted(), "1600000002.zip"); !in {
+		t.Errorf("Test_RunMainProcessRetry: expected 1600000002.zip to be kept to be tried again")
+	}
+
+	// the next run tries it again
+	ts.set("1600000002.zip", testArchive(t, "c.xml"))
+	rr, err = RunMainProcess(context.Background(), store, RunOptions{Trigger: "once"})
+	if err != nil || len(rr.Failed) != 0 || len(rr.Resumed) != 1 || rr.Pushed != 1 {
+		t.Errorf("Test_RunMainProcessRetry: expected 1600000002.zip to be loaded got %+v, %v", rr, err)
+	}
+	if n, _ := store.Count(ks.Interrupted()); n != 0 {
+		t.Errorf("Test_RunMainProcessRetry: expected nothing left to retry got %d", n)
+	}
+	if n, _ := store.Count(ks.Attempts()); n != 0 {
+		t.Errorf("Test_RunMainProcessRetry: expected the failed attempt cleared got %d", n)
+	}
+	var docs []string
+	for {
+		data, ok, _ := store.Pop(ks.NewsXML())
+		if !ok {
+			break
+		}
+		docs = append(docs, string(data))
+	}
+	sort.Strings(docs)
+	if len(docs) != 3 || docs[2] != "<doc>c.xml</doc>" {
+		t.Errorf("Test_RunMainProcessRetry: expected 3 documents got %q", docs)
+	}
+}
+
+func Test_RunMainProcessMaxAttempts(t *testing.T) {
+	store := testConfig(t, naLib.GlobalConfigType{ArchiveMaxAttempts: 3})
+	newTestSource(t, "1600000001.zip") // always a 404
+	ks := naLib.NewKeyspace(&gCfg)
+
+	for i := 1; i <= 3; i++ {
+		rr, err := RunMainProcess(context.Background(), store, RunOptions{Trigger: "once"})
+		if err != nil {
+			t.Fatalf("Test_RunMainProcessMaxAttempts: %s", err)
+		}
+		if i < 3 && len(rr.Failed) != 1 {
+			t.Errorf("Test_RunMainProcessMaxAttempts: run %d expected 1600000001.zip to be tried again got %+v", i, rr)
+		}
+		if i == 3 && len(rr.Failed) != 0 {
+			t.Errorf("Test_RunMainProcessMaxAttempts: run %d expected 1600000001.zip to be quarantined got %+v", i, rr)
+		}
+	}
+	reason, quarantined, _ := store.GetField(ks.Quarantine(), "1600000001.zip")
+	if !quarantined || !strings.Contains(reason, "failed in 3 runs, last error: ") {
+		t.Errorf("Test_RunMainProcessMaxAttempts: expected 1600000001.zip quarantined got %v %q", quarantined, reason)
+	}
+	if n, _ := store.Count(ks.Interrupted()); n != 0 {
+		t.Errorf("Test_RunMainProcessMaxAttempts: expected nothing left to retry got %d", n)
+	}
+	if n, _ := store.Count(ks.Attempts()); n != 0 {
+		t.Errorf("Test_RunMainProcessMaxAttempts: expected the attempts cleared got %d", n)
+	}
+
+	// the next run does not try it again
+	rr, err := RunMainProcess(context.Background(), store, RunOptions{Trigger: "once"})
+	if err != nil || len(rr.Archives) != 0 {
+		t.Errorf("Test_RunMainProcessMaxAttempts: expected no archives got %+v, %v", rr, err)
+	}
+}
@@ -0,0 +1,113 @@
+package naLib
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Overflow policies for when the output list reaches OutputHighWater.
+const (
+	OverflowPause      = "pause"       // Stop loading until consumers drain the list to OutputLowWater
+	OverflowDropOldest = "drop-oldest" // Keep loading, and trim the oldest documents off the list
+)
+
+// Backpressure keeps the output list from growing without limit when the consumers stop.  With the "pause" policy
+// loading waits while the list is at or over the high-water mark, until it drains down to the low-water mark.  With
+// the "drop-oldest" policy the list is trimmed back to the high-water mark after each push.
+type Backpressure struct {
+	listKey   string
+	high      int
+	low       int
+	policy    string
+	poll      time.Duration
+	lock      sync.Mutex   // Held by Wait while it is paused, so all of the load workers pause together
+	throttled atomic.Int64 // Total time spent paused, in nanoseconds, not counting the pause in progress
+	paused    atomic.Int64 // When the pause in progress started, in Unix nanoseconds, 0 if not paused
+	dropped   atomic.Int64 // Total documents trimmed off the list
+}
+
+// NewBackpressure returns the Backpressure for listKey from the configuration.  If OutputHighWater is 0 there is no limit.
+func NewBackpressure(listKey string, gCfg *GlobalConfigType) *Backpressure {
+	bp := &Backpressure{
+		listKey: listKey,
+		high:    gCfg.OutputHighWater,
+		low:     gCfg.OutputLowWater,
+		policy:  gCfg.OutputOverflowPolicy,
+		poll:    time.Second,
+	}
+	if bp.low <= 0 || bp.low > bp.high {
+		bp.low = bp.high * 8 / 10
+	}
+	if bp.policy == "" {
+		bp.policy = OverflowPause
+	}
+	return bp
+}
+
+// Wait blocks while the output list is over the high-water mark.  It returns when the list has drained to the
+// low-water mark, or with an error if ctx is canceled or the store fails.  Only one caller polls the store at a
+// time - the others wait on the lock, so all of the load workers pause together.
+func (bp *Backpressure) Wait(ctx context.Context, store StateStore) (err error) {
+	if bp.high <= 0 || bp.policy != OverflowPause {
+		return
+	}
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+
+	n, err := store.Len(bp.listKey)
+	if err != nil || n < bp.high {
+		return
+	}
+
+	start := time.Now()
+	bp.paused.Store(start.UnixNano())
+	lg := Log(LogLoad)
+	lg.WarnContext(ctx, "output list at the high-water mark, pausing", "key", bp.listKey, "documents", n, "high", bp.high, "low", bp.low)
+	defer func() {
+		d := time.Since(start)
+		total := time.Duration(bp.throttled.Add(int64(d)))
+		bp.paused.Store(0)
+		lg.InfoContext(ctx, "output list drained, resuming", "key", bp.listKey, "duration", d, "throttled_total", total)
+	}()
+	for n > bp.low {
+		select {
+		case <-time.After(bp.poll):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		n, err = store.Len(bp.listKey)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Trim is called after a push.  With the "drop-oldest" policy, the oldest documents, on the right end of the list,
+// are removed to bring the list back to the high-water mark.  The number of documents removed is returned.
+func (bp *Backpressure) Trim(store StateStore) (n int, err error) {
+	if bp.high <= 0 || bp.policy != OverflowDropOldest {
+		return
+	}
+	n, err = store.Trim(bp.listKey, bp.high)
+	if err != nil {
+		return
+	}
+	if n > 0 {
+		bp.dropped.Add(int64(n))
+		Log(LogLoad).Warn("output list over the high-water mark, dropped the oldest documents", "key", bp.listKey, "high", bp.high, "dropped", n)
+	}
+	return
+}
+
+// Stats returns the total time spent paused, including a pause that is still going on, and the total number of
+// documents dropped.  It does not wait for a pause to end.
+func (bp *Backpressure) Stats() (throttled time.Duration, dropped int64) {
+	throttled = time.Duration(bp.throttled.Load())
+	if start := bp.paused.Load(); start != 0 {
+		throttled += time.Since(time.Unix(0, start))
+	}
+	return throttled, bp.dropped.Load()
+}
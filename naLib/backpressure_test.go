@@ -0,0 +1,131 @@
+package naLib
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// func NewBackpressure(listKey string, gCfg *GlobalConfigType) *Backpressure {
+func Test_NewBackpressure(t *testing.T) {
+	tests := []struct {
+		high, low int
+		policy    string
+		exLow     int
+		exPolicy  string
+	}{
+		{high: 1000, low: 0, policy: "", exLow: 800, exPolicy: OverflowPause},
+		{high: 1000, low: 500, policy: "pause", exLow: 500, exPolicy: OverflowPause},
+		{high: 1000, low: 2000, policy: "drop-oldest", exLow: 800, exPolicy: OverflowDropOldest},
+		{high: 0, low: 0, policy: "", exLow: 0, exPolicy: OverflowPause},
+	}
+	for ii, test := range tests {
+		bp := NewBackpressure("list", &GlobalConfigType{OutputHighWater: test.high, OutputLowWater: test.low, OutputOverflowPolicy: test.policy})
+		if bp.low != test.exLow || bp.policy != test.exPolicy {
+			t.Errorf("Test_NewBackpressure %d: expected %d %s got %d %s", ii, test.exLow, test.exPolicy, bp.low, bp.policy)
+		}
+	}
+}
+
+// func (bp *Backpressure) Wait(ctx context.Context, store StateStore) (err error) {
+// func (bp *Backpressure) Trim(store StateStore) (n int, err error) {
+//
+// test depends on connecting to Redis and the ../cfg.json file
+func Test_Backpressure(t *testing.T) {
+	gCfg := GlobalConfigType{
+		RedisHost: "127.0.0.1",
+		RedisPort: "6379",
+	}
+	ReadConfigFile("../cfg.json", &gCfg)
+
+	client, err := RedisClient(gCfg.RedisHost, gCfg.RedisPort, gCfg.RedisAuth)
+	if err != nil {
+		t.Errorf("RedisClient error- failed to connect- %s\n", err)
+		return
+	}
+
+	store := NewRedisStore(client, &gCfg)
+	listKey := "Test_Backpressure:list"
+	client.Cmd("DEL", listKey)
+	for i := 0; i < 10; i++ {
+		client.Cmd("LPUSH", listKey, i)
+	}
+
+	// drop-oldest trims the right end of the list back to the high-water mark
+	gCfg.OutputHighWater = 6
+	gCfg.OutputOverflowPolicy = OverflowDropOldest
+	bp := NewBackpressure(listKey, &gCfg)
+	n, err := bp.Trim(store)
+	if err != nil || n != 4 {
+		t.Errorf("Trim error- expected 4 dropped, got %d, %v\n", n, err)
+	}
+	if s, _ := client.Cmd("LINDEX", listKey, -1).Str(); s != "4" {
+		t.Errorf("Trim error- expected oldest remaining to be 4, got %s\n", s)
+	}
+	if _, dropped := bp.Stats(); dropped != 4 {
+		t.Errorf("Trim error- expected 4 dropped in Stats, got %d\n", dropped)
+	}
+
+	// pause waits until the list drains to the low-water mark
+	gCfg.OutputHighWater = 5
+	gCfg.OutputLowWater = 2
+	gCfg.OutputOverflowPolicy = OverflowPause
+	bp = NewBackpressure(listKey, &gCfg)
+	bp.poll = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	err = bp.Wait(ctx, store)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("Wait error- expected to time out over the high-water mark, got %v\n", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client2, _ := RedisClient(gCfg.RedisHost, gCfg.RedisPort, gCfg.RedisAuth)
+		client2.Cmd("LTRIM", listKey, 0, 1)
+		client2.Close()
+	}()
+	err = bp.Wait(context.Background(), store)
+	if err != nil {
+		t.Errorf("Wait error- %s\n", err)
+	}
+	if throttled, _ := bp.Stats(); throttled < 50*time.Millisecond {
+		t.Errorf("Wait error- expected at least 50ms throttled, got %s\n", throttled)
+	}
+
+	client.Cmd("DEL", listKey)
+}
+
+// func (bp *Backpressure) Stats() (throttled time.Duration, dropped int64) {
+func Test_BackpressureStats(t *testing.T) {
+	gCfg := GlobalConfigType{OutputHighWater: 2, OutputLowWater: 1}
+	store := NewMemoryStore(nil, &gCfg)
+	store.Enqueue("list", [][]byte{[]byte("a"), []byte("b")})
+	bp := NewBackpressure("list", &gCfg)
+	bp.poll = 10 * time.Millisecond
+
+	waited := make(chan error)
+	go func() { waited <- bp.Wait(context.Background(), store) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// Stats does not wait for the pause to end, and counts the pause so far
+	got := make(chan time.Duration)
+	go func() { throttled, _ := bp.Stats(); got <- throttled }()
+	select {
+	case throttled := <-got:
+		if throttled < 40*time.Millisecond {
+			t.Errorf("Test_BackpressureStats: expected the pause so far to be counted, got %s", throttled)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Test_BackpressureStats: Stats blocked while Wait was paused")
+	}
+
+	store.Pop("list")
+	if err := <-waited; err != nil {
+		t.Errorf("Test_BackpressureStats: Wait error %s", err)
+	}
+	if throttled, _ := bp.Stats(); throttled < 50*time.Millisecond {
+		t.Errorf("Test_BackpressureStats: expected at least 50ms throttled, got %s", throttled)
+	}
+}
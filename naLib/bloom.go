@@ -0,0 +1,320 @@
+package naLib
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/pschlump/radix.v2/util"
+)
+
+// Dedupe backends, DedupeBackend in the configuration.
+const (
+	DedupeKeys  = "keys"  // One key per document, with a TTL of RetentionDays (the default)
+	DedupeBloom = "bloom" // A scalable Bloom filter on Redis bitmaps, with an exact check of positives
+)
+
+// The Bloom filter is a series of layers, each a Redis bitmap.  Layer i holds BloomCapacity * 2^i names with a false
+// positive rate of BloomErrorRate / 2^(i+1), so the rate for all of the layers together stays under BloomErrorRate.
+// When the newest layer is full a new one is started.  The size and number of hashes for each layer are saved in the
+// BloomMeta hash when the layer is created:
+//
+//	layers      number of layers
+//	m:<i>       bits in layer i
+//	k:<i>       hashes (bits set) per name in layer i
+//	n:<i>       names added to layer i
+//	fp          positives from the filter that the exact check found were new
+//
+// With BloomExactCheck a 64 bit fingerprint of each name is also saved in one of BloomExactBuckets small hashes.
+// A name is only a duplicate if the filter and the fingerprint both say so.  Small hashes are stored very compactly
+// by Redis (keep hash-max-listpack-entries above the number of names per bucket), so this still uses far less
+// memory than one key per document.  Without the exact check a false positive drops a new document.
+
+// bloomHash returns the two hashes used to pick the bits for 'name' and its fingerprint.  The hashes are kept to 32
+// bits so that Lua can do the arithmetic exactly.
+func bloomHash(name string) (h1, h2 uint32, fp string) {
+	sum := sha256.Sum256([]byte(name))
+	h1 = binary.BigEndian.Uint32(sum[0:4])
+	h2 = binary.BigEndian.Uint32(sum[4:8]) | 1 // odd, so it is never 0
+	fp = hex.EncodeToString(sum[8:16])
+	return
+}
+
+// bloomBucket returns the bucket that the fingerprint 'fp' is saved in.
+func bloomBucket(fp string, gCfg *GlobalConfigType) int {
+	buckets := gCfg.BloomExactBuckets
+	if buckets <= 0 {
+		buckets = 1
+	}
+	b, _ := hex.DecodeString(fp[:8])
+	return int(binary.BigEndian.Uint32(b) % uint32(buckets))
+}
+
+// bloomLoadBatch is RedisLoadBatch for the "bloom" DedupeBackend.  If 'push' is false the names are only added to
+// the filter, this is used by BuildBloom.
+func bloomLoadBatch(client util.Cmder, listKey string, docs []LoadDoc, push bool, gCfg *GlobalConfigType) (isNew []bool, err error) {
+	ks := NewKeyspace(gCfg)
+	exact := "0"
+	if gCfg.BloomExactCheck {
+		exact = "1"
+	}
+	pushArg := "0"
+	if push {
+		pushArg = "1"
+	}
+	keys := make([]interface{}, 0, len(docs)+2)
+	argv := make([]interface{}, 0, 4*len(docs)+5)
+	keys = append(keys, ks.BloomMeta(), listKey)
+	argv = append(argv, pushArg, ks.BloomBits(""), gCfg.BloomCapacity, gCfg.BloomErrorRate, exact)
+	for _, d := range docs {
+		h1, h2, fp := bloomHash(d.Name)
+		keys = append(keys, ks.BloomExact(bloomBucket(fp, gCfg)))
+		argv = append(argv, h1, h2, fp, d.Data)
+	}
+	pushed, err := util.LuaEval(client, bloomLoadScript, len(keys), append(keys, argv...)...).Array()
+	if err != nil {
+		Log(LogRedis).Error("bloom load batch failed", "key", listKey, "documents", len(docs), "error", err)
+		return nil, err
+	}
+	isNew = make([]bool, len(docs))
+	for ii, p := range pushed {
+		if n, _ := p.Int(); n == 1 && ii < len(docs) {
+			isNew[ii] = true
+		}
+	}
+	return
+}
+
+// bloomLoadScript - KEYS[1] is the BloomMeta hash, KEYS[2] the list to push onto and KEYS[2+i] the exact check
+// bucket for document i.  ARGV[1] is "1" to push, ARGV[2] the prefix for the layer bitmaps, ARGV[3] and ARGV[4]
+// the capacity and error rate for layer 0, ARGV[5] is "1" for the exact check, followed by h1, h2, fingerprint and
+// data for each document.  The layer bitmaps all have the same hash tag as KEYS[1], so they are in the same slot.
+const bloomLoadScript = `
+local meta = KEYS[1]
+local list = KEYS[2]
+local bits = ARGV[2]
+local cap0 = tonumber(ARGV[3])
+local p0 = tonumber(ARGV[4])
+local exact = ARGV[5] == '1'
+
+local layers = tonumber(redis.call('HGET', meta, 'layers') or '0')
+local m, k, n = {}, {}, {}
+for i = 0, layers - 1 do
+	local v = redis.call('HMGET', meta, 'm:' .. i, 'k:' .. i, 'n:' .. i)
+	m[i], k[i], n[i] = tonumber(v[1]), tonumber(v[2]), tonumber(v[3] or '0')
+end
+
+local function addLayer()
+	local i = layers
+	local p = p0 / math.pow(2, i + 1)
+	local c = cap0 * math.pow(2, i)
+	m[i] = math.ceil(-c * math.log(p) / (math.log(2) * math.log(2)))
+	k[i] = math.ceil(-math.log(p) / math.log(2))
+	n[i] = 0
+	if m[i] > 4294967296 then
+		return redis.error_reply('bloom filter layer ' .. i .. ' is larger than a Redis bitmap, increase BloomCapacity')
+	end
+	redis.call('HSET', meta, 'm:' .. i, m[i], 'k:' .. i, k[i], 'n:' .. i, 0, 'layers', i + 1)
+	layers = i + 1
+end
+
+local rv = {}
+for d = 1, #KEYS - 2 do
+	local h1, h2, fp, data = tonumber(ARGV[4*d+2]), tonumber(ARGV[4*d+3]), ARGV[4*d+4], ARGV[4*d+5]
+	local maybe = false
+	for i = 0, layers - 1 do
+		local all = true
+		for j = 0, k[i] - 1 do
+			if redis.call('GETBIT', bits .. i, (h1 + j * h2) % m[i]) == 0 then
+				all = false
+				break
+			end
+		end
+		if all then
+			maybe = true
+			break
+		end
+	end
+	local seen = maybe
+	if maybe and exact then
+		seen = redis.call('HEXISTS', KEYS[2+d], fp) == 1
+		if not seen then
+			redis.call('HINCRBY', meta, 'fp', 1)
+		end
+	end
+	rv[d] = 0
+	if not seen then
+		local i = layers - 1
+		if layers == 0 or n[i] >= cap0 * math.pow(2, i) then
+			local e = addLayer()
+			if e then
+				return e
+			end
+			i = layers - 1
+		end
+		for j = 0, k[i] - 1 do
+			redis.call('SETBIT', bits .. i, (h1 + j * h2) % m[i], 1)
+		end
+		n[i] = n[i] + 1
+		redis.call('HINCRBY', meta, 'n:' .. i, 1)
+		if exact then
+			redis.call('HSET', KEYS[2+d], fp, 1)
+		end
+		rv[d] = 1
+		if ARGV[1] == '1' then
+			redis.call('LPUSH', list, data)
+		end
+	end
+end
+return rv
+`
+
+// bloomCheckBatch is RedisCheckBatch for the "bloom" DedupeBackend.  Nothing is added to the filter.
+func bloomCheckBatch(client util.Cmder, docs []LoadDoc, gCfg *GlobalConfigType) (loaded []bool, err error) {
+	ks := NewKeyspace(gCfg)
+	exact := "0"
+	if gCfg.BloomExactCheck {
+		exact = "1"
+	}
+	keys := make([]interface{}, 0, len(docs)+1)
+	argv := make([]interface{}, 0, 3*len(docs)+2)
+	keys = append(keys, ks.BloomMeta())
+	argv = append(argv, ks.BloomBits(""), exact)
+	for _, d := range docs {
+		h1, h2, fp := bloomHash(d.Name)
+		keys = append(keys, ks.BloomExact(bloomBucket(fp, gCfg)))
+		argv = append(argv, h1, h2, fp)
+	}
+	found, err := util.LuaEval(client, bloomCheckScript, len(keys), append(keys, argv...)...).Array()
+	if err != nil {
+		Log(LogRedis).Error("bloom check batch failed", "documents", len(docs), "error", err)
+		return nil, err
+	}
+	loaded = make([]bool, len(docs))
+	for ii, f := range found {
+		if n, _ := f.Int(); n == 1 && ii < len(docs) {
+			loaded[ii] = true
+		}
+	}
+	return
+}
+
+// bloomCheckScript is the read only part of bloomLoadScript.  KEYS[1] is the BloomMeta hash and KEYS[1+i] the
+// exact check bucket for document i.  ARGV[1] is the prefix for the layer bitmaps, ARGV[2] is "1" for the exact
+// check, followed by h1, h2 and fingerprint for each document.  It returns a 1 for each document in the filter.
+const bloomCheckScript = `
+local meta = KEYS[1]
+local bits = ARGV[1]
+local exact = ARGV[2] == '1'
+
+local layers = tonumber(redis.call('HGET', meta, 'layers') or '0')
+local m, k = {}, {}
+for i = 0, layers - 1 do
+	local v = redis.call('HMGET', meta, 'm:' .. i, 'k:' .. i)
+	m[i], k[i] = tonumber(v[1]), tonumber(v[2])
+end
+
+local rv = {}
+for d = 1, #KEYS - 1 do
+	local h1, h2, fp = tonumber(ARGV[3*d]), tonumber(ARGV[3*d+1]), ARGV[3*d+2]
+	local seen = false
+	for i = 0, layers - 1 do
+		local all = true
+		for j = 0, k[i] - 1 do
+			if redis.call('GETBIT', bits .. i, (h1 + j * h2) % m[i]) == 0 then
+				all = false
+				break
+			end
+		end
+		if all then
+			seen = true
+			break
+		end
+	end
+	if seen and exact then
+		seen = redis.call('HEXISTS', KEYS[1+d], fp) == 1
+	end
+	rv[d] = 0
+	if seen then
+		rv[d] = 1
+	end
+end
+return rv
+`
+
+// BloomInfo describes the Bloom filter.
+type BloomInfo struct {
+	Layers         int   // Number of bitmaps
+	Names          int64 // Names added to the filter
+	Bits           int64 // Total size of the bitmaps in bits
+	FalsePositives int64 // Positives from the filter that the exact check found were new
+}
+
+func (bi BloomInfo) String() string {
+	return fmt.Sprintf("%d names in %d layers, %d KiB of bitmaps, %d false positives caught by the exact check",
+		bi.Names, bi.Layers, bi.Bits/8/1024, bi.FalsePositives)
+}
+
+// GetBloomInfo reads the BloomMeta hash.
+func GetBloomInfo(client util.Cmder, gCfg *GlobalConfigType) (bi BloomInfo, err error) {
+	m, err := client.Cmd("HGETALL", NewKeyspace(gCfg).BloomMeta()).Map()
+	if err != nil {
+		return
+	}
+	for f, v := range m {
+		var x int64
+		fmt.Sscan(v, &x)
+		switch {
+		case f == "layers":
+			bi.Layers = int(x)
+		case f == "fp":
+			bi.FalsePositives = x
+		case strings.HasPrefix(f, "n:"):
+			bi.Names += x
+		case strings.HasPrefix(f, "m:"):
+			bi.Bits += x
+		}
+	}
+	return
+}
+
+// BuildBloom adds the name of every per-document key (the "keys" DedupeBackend) to the Bloom filter, so that
+// switching DedupeBackend to "bloom" does not load the documents again.  Names already in the filter are skipped,
+// so it can be run more than once.  The document keys are left in place and expire after RetentionDays.  The
+// number of names added is returned.
+func BuildBloom(client util.Cmder, gCfg *GlobalConfigType) (added int, err error) {
+	ks := NewKeyspace(gCfg)
+	docPrefix := ks.Document("")
+	batchSize := gCfg.RedisBatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	flush := func(docs []LoadDoc) error {
+		if len(docs) == 0 {
+			return nil
+		}
+		isNew, e := bloomLoadBatch(client, ks.NewsXML(), docs, false, gCfg)
+		for _, n := range isNew {
+			if n {
+				added++
+			}
+		}
+		return e
+	}
+	err = scan(client, "SCAN", "", ks.DocumentPattern(), func(keys []string) error {
+		docs := make([]LoadDoc, 0, batchSize)
+		for _, k := range keys {
+			docs = append(docs, LoadDoc{Key: k, Name: strings.TrimPrefix(k, docPrefix)})
+			if len(docs) == batchSize {
+				if e := flush(docs); e != nil {
+					return e
+				}
+				docs = docs[:0]
+			}
+		}
+		return flush(docs)
+	})
+	return
+}
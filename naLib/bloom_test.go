@@ -0,0 +1,120 @@
+package naLib
+
+import (
+	"fmt"
+	"testing"
+)
+
+// func bloomHash(name string) (h1, h2 uint32, fp string) {
+// func bloomBucket(fp string, gCfg *GlobalConfigType) int {
+func Test_bloomHash(t *testing.T) {
+	gCfg := GlobalConfigType{BloomExactBuckets: 16}
+	h1, h2, fp := bloomHash("a.xml")
+	g1, g2, gp := bloomHash("a.xml")
+	if h1 != g1 || h2 != g2 || fp != gp {
+		t.Errorf("Test_bloomHash: not stable, %d %d %s and %d %d %s", h1, h2, fp, g1, g2, gp)
+	}
+	if h2%2 != 1 || len(fp) != 16 {
+		t.Errorf("Test_bloomHash: expected odd h2 and 16 character fingerprint, got %d %s", h2, fp)
+	}
+	if _, _, fp2 := bloomHash("b.xml"); fp2 == fp {
+		t.Errorf("Test_bloomHash: a.xml and b.xml have the same fingerprint %s", fp)
+	}
+	used := make(map[int]bool)
+	for i := 0; i < 200; i++ {
+		_, _, fp := bloomHash(fmt.Sprintf("%d.xml", i))
+		b := bloomBucket(fp, &gCfg)
+		if b < 0 || b >= 16 {
+			t.Errorf("Test_bloomHash: bucket %d out of range", b)
+		}
+		used[b] = true
+	}
+	if len(used) != 16 {
+		t.Errorf("Test_bloomHash: expected all 16 buckets to be used, got %d", len(used))
+	}
+}
+
+// func RedisLoadBatch(client util.Cmder, listKey string, docs []LoadDoc, gCfg *GlobalConfigType) (isNew []bool, err error) {
+// func RedisCheckBatch(client util.Cmder, docs []LoadDoc, gCfg *GlobalConfigType) (loaded []bool, err error) {
+// func BuildBloom(client util.Cmder, gCfg *GlobalConfigType) (added int, err error) {
+//
+// test depends on connecting to Redis and the ../cfg.json file
+func Test_BloomLoadBatch(t *testing.T) {
+	gCfg := GlobalConfigType{
+		RedisHost: "127.0.0.1",
+		RedisPort: "6379",
+	}
+	ReadConfigFile("../cfg.json", &gCfg)
+	gCfg.RedisPrefix = "Test_BloomLoadBatch"
+	gCfg.RedisHashTag = ""
+	gCfg.RedisKeyNewsXML = "list"
+	gCfg.DedupeBackend = DedupeBloom
+	gCfg.BloomCapacity = 10 // small, so that more layers are added
+	gCfg.BloomErrorRate = 0.01
+	gCfg.BloomExactCheck = true
+	gCfg.BloomExactBuckets = 4
+
+	client, err := RedisClient(gCfg.RedisHost, gCfg.RedisPort, gCfg.RedisAuth)
+	if err != nil {
+		t.Errorf("RedisClient error- failed to connect- %s\n", err)
+		return
+	}
+
+	ks := NewKeyspace(&gCfg)
+	cleanup := func() {
+		keys := []interface{}{ks.NewsXML(), ks.BloomMeta(), ks.Document("old.xml")}
+		for i := 0; i < 8; i++ {
+			keys = append(keys, ks.BloomBits(fmt.Sprintf("%d", i)))
+		}
+		for i := 0; i < gCfg.BloomExactBuckets; i++ {
+			keys = append(keys, ks.BloomExact(i))
+		}
+		client.Cmd("DEL", keys...)
+	}
+	cleanup()
+
+	var docs []LoadDoc
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("%d.xml", i)
+		docs = append(docs, LoadDoc{Key: ks.Document(name), Name: name, Data: []byte(name)})
+	}
+	isNew, err := RedisLoadBatch(client, ks.NewsXML(), docs, &gCfg)
+	if err != nil {
+		t.Errorf("RedisLoadBatch error- %s\n", err)
+	}
+	for ii, n := range isNew {
+		if !n {
+			t.Errorf("RedisLoadBatch error- %s should be new\n", docs[ii].Name)
+		}
+	}
+	loaded, err := RedisCheckBatch(client, append(docs[:2:2], LoadDoc{Name: "new.xml"}), &gCfg)
+	if err != nil || len(loaded) != 3 || !loaded[0] || !loaded[1] || loaded[2] {
+		t.Errorf("RedisCheckBatch error- expected [true true false] got %v, %v\n", loaded, err)
+	}
+	isNew, err = RedisLoadBatch(client, ks.NewsXML(), docs, &gCfg)
+	for ii, n := range isNew {
+		if n {
+			t.Errorf("RedisLoadBatch error- %s should be a duplicate\n", docs[ii].Name)
+		}
+	}
+	if n, _ := client.Cmd("LLEN", ks.NewsXML()).Int(); n != 50 {
+		t.Errorf("RedisLoadBatch error- expected 50 documents on the list, got %d\n", n)
+	}
+	bi, err := GetBloomInfo(client, &gCfg)
+	if err != nil || bi.Names != 50 || bi.Layers != 3 { // 10 + 20 + 40
+		t.Errorf("GetBloomInfo error- got %s, %v\n", bi, err)
+	}
+
+	// a document key from the "keys" backend is added by BuildBloom
+	client.Cmd("SET", ks.Document("old.xml"), "old.xml")
+	added, err := BuildBloom(client, &gCfg)
+	if err != nil || added != 1 {
+		t.Errorf("BuildBloom error- expected 1 added, got %d, %v\n", added, err)
+	}
+	isNew, _ = RedisLoadBatch(client, ks.NewsXML(), []LoadDoc{{Name: "old.xml", Data: []byte("old")}}, &gCfg)
+	if len(isNew) != 1 || isNew[0] {
+		t.Errorf("RedisLoadBatch error- old.xml should be a duplicate after BuildBloom\n")
+	}
+
+	cleanup()
+}
@@ -0,0 +1,463 @@
+package naLib
+
+import (
+	"encoding/binary"
+	"strconv"
+	"time"
+
+	"github.com/pschlump/radix.v2/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore is a StateStore in an embedded bbolt database file, for a single aggregator that keeps its own state
+// out of Redis.  Only one process can have the file open at a time.  The output list is still in Redis, see
+// outputList.  The database has a top level bucket for each kind of state, with a nested bucket for each set, hash
+// and list:
+//
+//	sets/<set>/<member>
+//	hashes/<hash>/<field> = value
+//	keys/<key> = 8 byte expire time (unix nanoseconds, 0 for never) + value, for SetIfNotExists, leases and documents
+//	counters/<counter> = decimal value
+//	lists/<list>/<8 byte sequence number> = data, oldest first
+type BoltStore struct {
+	db     *bolt.DB
+	gCfg   *GlobalConfigType
+	output outputList
+}
+
+var (
+	boltSets     = []byte("sets")
+	boltHashes   = []byte("hashes")
+	boltKeys     = []byte("keys")
+	boltCounters = []byte("counters")
+	boltLists    = []byte("lists")
+)
+
+// NewBoltStore opens (or creates) the database file 'fn'.  The output list is pushed to Redis with 'out', nil
+// keeps it in the database, for tests.
+func NewBoltStore(fn string, out util.Cmder, gCfg *GlobalConfigType) (bs *BoltStore, err error) {
+	db, err := bolt.Open(fn, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{boltSets, boltHashes, boltKeys, boltCounters, boltLists} {
+			if _, e := tx.CreateBucketIfNotExists(b); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db, gCfg: gCfg, output: newOutputList(out, gCfg)}, nil
+}
+
+// nested returns the bucket 'name' inside of the top level bucket 'top', creating it if 'create' is true.  With
+// create false and no bucket, nil is returned.
+func nested(tx *bolt.Tx, top []byte, name string, create bool) (*bolt.Bucket, error) {
+	t := tx.Bucket(top)
+	if !create {
+		return t.Bucket([]byte(name)), nil
+	}
+	return t.CreateBucketIfNotExists([]byte(name))
+}
+
+func (bs *BoltStore) AddNew(set string, members []string) (added []bool, err error) {
+	added = make([]bool, len(members))
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		b, e := nested(tx, boltSets, set, true)
+		if e != nil {
+			return e
+		}
+		for ii, m := range members {
+			if b.Get([]byte(m)) == nil {
+				if e := b.Put([]byte(m), []byte{}); e != nil {
+					return e
+				}
+				added[ii] = true
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (bs *BoltStore) Remove(set string, members []string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, _ := nested(tx, boltSets, set, false)
+		if b == nil {
+			return nil
+		}
+		for _, m := range members {
+			if e := b.Delete([]byte(m)); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *BoltStore) IsMember(set, member string) (found bool, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		b, _ := nested(tx, boltSets, set, false)
+		found = b != nil && b.Get([]byte(member)) != nil
+		return nil
+	})
+	return
+}
+
+// forEach calls fn with each key and value in the nested bucket top/name.  The keys and values are copied, since
+// bbolt only keeps them valid during the transaction.
+func (bs *BoltStore) forEach(top []byte, name string, fn func(k, v string) error) error {
+	type kv struct{ k, v string }
+	var all []kv
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b, _ := nested(tx, top, name, false)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			all = append(all, kv{string(k), string(v)})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, x := range all {
+		if err = fn(x.k, x.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bs *BoltStore) Members(set string, fn func(member string) error) error {
+	return bs.forEach(boltSets, set, func(k, v string) error { return fn(k) })
+}
+
+func (bs *BoltStore) SetField(hash, field, value string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, e := nested(tx, boltHashes, hash, true)
+		if e != nil {
+			return e
+		}
+		return b.Put([]byte(field), []byte(value))
+	})
+}
+
+func (bs *BoltStore) GetField(hash, field string) (value string, ok bool, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		if b, _ := nested(tx, boltHashes, hash, false); b != nil {
+			if v := b.Get([]byte(field)); v != nil {
+				value, ok = string(v), true
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (bs *BoltStore) RemoveFields(hash string, fields []string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, _ := nested(tx, boltHashes, hash, false)
+		if b == nil {
+			return nil
+		}
+		for _, f := range fields {
+			if e := b.Delete([]byte(f)); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *BoltStore) Fields(hash string, fn func(field, value string) error) error {
+	return bs.forEach(boltHashes, hash, fn)
+}
+
+func (bs *BoltStore) Count(name string) (n int, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		for _, top := range [][]byte{boltSets, boltHashes} {
+			if b, _ := nested(tx, top, name, false); b != nil {
+				n += b.Stats().KeyN
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// getKey returns the value of a key in the keys bucket, ok is false if it is not there or has expired.
+func getKey(b *bolt.Bucket, key string, now time.Time) (value string, ok bool) {
+	return decodeKey(b.Get([]byte(key)), now)
+}
+
+// decodeKey splits a value from the keys bucket into the expire time and value, ok is false if it has expired.
+func decodeKey(v []byte, now time.Time) (value string, ok bool) {
+	if len(v) < 8 {
+		return "", false
+	}
+	exp := int64(binary.BigEndian.Uint64(v[:8]))
+	if exp != 0 && now.UnixNano() >= exp {
+		return "", false
+	}
+	return string(v[8:]), true
+}
+
+// putKey saves a value in the keys bucket with the expire time in front of it.
+func putKey(b *bolt.Bucket, key, value string, ttl time.Duration, now time.Time) error {
+	v := make([]byte, 8, 8+len(value))
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(v, uint64(now.Add(ttl).UnixNano()))
+	}
+	return b.Put([]byte(key), append(v, value...))
+}
+
+func (bs *BoltStore) Expire() (removed int, err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltKeys)
+		now := time.Now()
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			if _, ok := decodeKey(v, now); !ok {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err = b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	return
+}
+
+func (bs *BoltStore) SetIfNotExists(key, value string, ttl time.Duration) (set bool, err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltKeys)
+		now := time.Now()
+		if _, ok := getKey(b, key, now); ok {
+			return nil
+		}
+		set = true
+		return putKey(b, key, value, ttl, now)
+	})
+	return
+}
+
+func (bs *BoltStore) AcquireLease(name, owner string, ttl time.Duration) (got bool, err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltKeys)
+		now := time.Now()
+		if v, ok := getKey(b, name, now); ok && v != owner {
+			return nil
+		}
+		got = true
+		return putKey(b, name, owner, ttl, now)
+	})
+	return
+}
+
+func (bs *BoltStore) ReleaseLease(name, owner string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltKeys)
+		if v, ok := getKey(b, name, time.Now()); ok && v == owner {
+			return b.Delete([]byte(name))
+		}
+		return nil
+	})
+}
+
+func (bs *BoltStore) Incr(counter string, n int64) (v int64, err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltCounters)
+		v, _ = strconv.ParseInt(string(b.Get([]byte(counter))), 10, 64)
+		v += n
+		return b.Put([]byte(counter), []byte(strconv.FormatInt(v, 10)))
+	})
+	return
+}
+
+// Push marks the new documents as loaded and pushes them in one transaction.  When the list is in Redis the push
+// is done before the transaction commits, so if it fails the documents are not marked as loaded.
+func (bs *BoltStore) Push(list string, docs []LoadDoc) (isNew []bool, err error) {
+	isNew = make([]bool, len(docs))
+	ttl := time.Duration(DedupeTTL(bs.gCfg)) * time.Second
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(boltKeys)
+		var data [][]byte
+		now := time.Now()
+		for ii, d := range docs {
+			if _, ok := getKey(keys, d.Key, now); ok {
+				continue
+			}
+			if e := putKey(keys, d.Key, d.Name, ttl, now); e != nil {
+				return e
+			}
+			data = append(data, d.Data)
+			isNew[ii] = true
+		}
+		if len(data) == 0 || skipPush(list, len(data), bs.gCfg) {
+			return nil
+		}
+		if rs := bs.output.redis(list); rs != nil {
+			return rs.Enqueue(list, data)
+		}
+		return enqueue(tx, list, data)
+	})
+	if err != nil {
+		isNew = nil
+	}
+	return
+}
+
+func (bs *BoltStore) Loaded(docs []LoadDoc) (loaded []bool, err error) {
+	loaded = make([]bool, len(docs))
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(boltKeys)
+		now := time.Now()
+		for ii, d := range docs {
+			_, loaded[ii] = getKey(keys, d.Key, now)
+		}
+		return nil
+	})
+	return
+}
+
+// appendList adds data to the end (newest) of the list bucket l.
+func appendList(l *bolt.Bucket, data []byte) error {
+	seq, err := l.NextSequence()
+	if err != nil {
+		return err
+	}
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], seq)
+	return l.Put(k[:], data)
+}
+
+// listLen returns the length of the list bucket l.  Entries are only added at the end and removed from the front,
+// so the sequence numbers have no gaps and the length comes from the first and last without reading the rest.
+func listLen(l *bolt.Bucket) int {
+	c := l.Cursor()
+	first, _ := c.First()
+	if first == nil {
+		return 0
+	}
+	last, _ := c.Last()
+	return int(binary.BigEndian.Uint64(last) - binary.BigEndian.Uint64(first) + 1)
+}
+
+// enqueue adds data to the end of the list in the transaction.
+func enqueue(tx *bolt.Tx, list string, data [][]byte) error {
+	l, e := nested(tx, boltLists, list, true)
+	if e != nil {
+		return e
+	}
+	for _, d := range data {
+		if e := appendList(l, d); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (bs *BoltStore) Enqueue(list string, data [][]byte) error {
+	if rs := bs.output.redis(list); rs != nil {
+		return rs.Enqueue(list, data)
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error { return enqueue(tx, list, data) })
+}
+
+func (bs *BoltStore) Pop(list string) (data []byte, ok bool, err error) {
+	if rs := bs.output.redis(list); rs != nil {
+		return rs.Pop(list)
+	}
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		l, _ := nested(tx, boltLists, list, false)
+		if l == nil {
+			return nil
+		}
+		c := l.Cursor()
+		k, v := c.First()
+		if k == nil {
+			return nil
+		}
+		data, ok = append([]byte(nil), v...), true
+		return c.Delete()
+	})
+	return
+}
+
+func (bs *BoltStore) Len(list string) (n int, err error) {
+	if rs := bs.output.redis(list); rs != nil {
+		return rs.Len(list)
+	}
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		l, _ := nested(tx, boltLists, list, false)
+		if l != nil {
+			n = listLen(l)
+		}
+		return nil
+	})
+	return
+}
+
+func (bs *BoltStore) Recent(list string, n int) (data [][]byte, err error) {
+	if rs := bs.output.redis(list); rs != nil {
+		return rs.Recent(list, n)
+	}
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		l, _ := nested(tx, boltLists, list, false)
+		if l == nil {
+			return nil
+		}
+		c := l.Cursor()
+		for k, v := c.Last(); k != nil && len(data) < n; k, v = c.Prev() {
+			data = append(data, append([]byte(nil), v...))
+		}
+		return nil
+	})
+	return
+}
+
+func (bs *BoltStore) Trim(list string, max int) (dropped int, err error) {
+	if rs := bs.output.redis(list); rs != nil {
+		return rs.Trim(list, max)
+	}
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		l, _ := nested(tx, boltLists, list, false)
+		if l == nil {
+			return nil
+		}
+		n := listLen(l) - max
+		var old [][]byte // deleting while moving a cursor forward skips keys, so collect them first
+		c := l.Cursor()
+		for k, _ := c.First(); k != nil && len(old) < n; k, _ = c.Next() {
+			old = append(old, append([]byte(nil), k...))
+		}
+		for _, k := range old {
+			if e := l.Delete(k); e != nil {
+				return e
+			}
+			dropped++
+		}
+		return nil
+	})
+	return
+}
+
+func (bs *BoltStore) Close() error {
+	bs.output.Close()
+	return bs.db.Close()
+}
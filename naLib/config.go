@@ -0,0 +1,135 @@
+package naLib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pschlump/news-aggregator/schedule"
+)
+
+// CheckConfig looks for mistakes in the configuration that would otherwise only show up part way through a run.
+// It returns a description of each problem, nil if there are none.  Nothing is connected to.
+func CheckConfig(gCfg *GlobalConfigType) (problems []string) {
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	fileExists := func(name, fn string) {
+		if fn == "" {
+			return
+		}
+		if _, err := os.Stat(fn); err != nil {
+			add("%s %s: %s", name, fn, err)
+		}
+	}
+
+	if gCfg.LoadUrl == "" {
+		add("LoadUrl is not set")
+	}
+	for name, v := range map[string]string{
+		"RedisKeySetOfFilesDownoaded": gCfg.RedisKeySetOfFilesDownoaded,
+		"RedisKeyNewsXML":             gCfg.RedisKeyNewsXML,
+		"RedisKeyQuarantine":          gCfg.RedisKeyQuarantine,
+		"TmpDir":                      gCfg.TmpDir,
+	} {
+		if v == "" {
+			add("%s is not set", name)
+		}
+	}
+
+	switch gCfg.StateBackend {
+	case "", StateRedis, StateMemory:
+	case StateBolt:
+		if gCfg.StateFile == "" {
+			add("StateFile must be set for StateBackend %q", StateBolt)
+		} else {
+			fileExists("Directory for StateFile", filepath.Dir(gCfg.StateFile))
+		}
+	default:
+		add("StateBackend %q should be %s, %s or %s", gCfg.StateBackend, StateRedis, StateBolt, StateMemory)
+	}
+
+	switch gCfg.DedupeBackend {
+	case "", DedupeKeys:
+	case DedupeBloom:
+		if gCfg.StateBackend != "" && gCfg.StateBackend != StateRedis {
+			add("DedupeBackend %q needs StateBackend %q", DedupeBloom, StateRedis)
+		}
+		if gCfg.BloomCapacity <= 0 {
+			add("BloomCapacity must be more than 0")
+		}
+		if gCfg.BloomErrorRate <= 0 || gCfg.BloomErrorRate >= 1 {
+			add("BloomErrorRate %g must be between 0 and 1", gCfg.BloomErrorRate)
+		}
+	default:
+		add("DedupeBackend %q should be %s or %s", gCfg.DedupeBackend, DedupeKeys, DedupeBloom)
+	}
+
+	switch gCfg.OutputOverflowPolicy {
+	case "", OverflowPause, OverflowDropOldest:
+	default:
+		add("OutputOverflowPolicy %q should be %s or %s", gCfg.OutputOverflowPolicy, OverflowPause, OverflowDropOldest)
+	}
+	if gCfg.OutputHighWater > 0 && gCfg.OutputLowWater > gCfg.OutputHighWater {
+		add("OutputLowWater %d is more than OutputHighWater %d", gCfg.OutputLowWater, gCfg.OutputHighWater)
+	}
+
+	if gCfg.RunSchedule != "" {
+		if _, err := schedule.ParseCron(gCfg.RunSchedule); err != nil {
+			add("RunSchedule: %s", err)
+		}
+	}
+	if _, err := schedule.ParseWindows(gCfg.RunWindows); err != nil {
+		add("RunWindows: %s", err)
+	}
+
+	if len(gCfg.RedisClusterNodes) > 0 && gCfg.RedisHashTag == "" {
+		add("%s", ErrClusterNeedsHashTag)
+	}
+	if gCfg.RedisSentinelMaster != "" && len(gCfg.RedisSentinelAddrs) == 0 {
+		add("RedisSentinelAddrs must be set with RedisSentinelMaster")
+	}
+	fileExists("RedisAuthFile", gCfg.RedisAuthFile)
+	if gCfg.RedisAuthEnv != "" && os.Getenv(gCfg.RedisAuthEnv) == "" {
+		add("RedisAuthEnv %s is not set in the environment", gCfg.RedisAuthEnv)
+	}
+	fileExists("RedisTLSCAFile", gCfg.RedisTLSCAFile)
+	fileExists("AdminTokenFile", gCfg.AdminTokenFile)
+	if (gCfg.AdminToken != "" || gCfg.AdminTokenFile != "" || gCfg.AdminTokenEnv != "") && gCfg.HTTPAddr == "" {
+		add("an admin token is set but HTTPAddr is not, the admin API is not served")
+	}
+	fileExists("RedisTLSCertFile", gCfg.RedisTLSCertFile)
+	fileExists("RedisTLSKeyFile", gCfg.RedisTLSKeyFile)
+	if (gCfg.RedisTLSCertFile == "") != (gCfg.RedisTLSKeyFile == "") {
+		add("RedisTLSCertFile and RedisTLSKeyFile must be set together")
+	}
+
+	if gCfg.RedisBatchSize == 0 {
+		add("RedisBatchSize must be at least 1")
+	}
+
+	_, _, logProblems := LogLevels(gCfg)
+	problems = append(problems, logProblems...)
+
+	for name, v := range map[string]int{
+		"RunFreq":            gCfg.RunFreq,
+		"DownloadWorkers":    gCfg.DownloadWorkers,
+		"ExtractWorkers":     gCfg.ExtractWorkers,
+		"LoadWorkers":        gCfg.LoadWorkers,
+		"RedisBatchSize":     gCfg.RedisBatchSize,
+		"RetentionDays":      gCfg.RetentionDays,
+		"ArchiveMaxDepth":    gCfg.ArchiveMaxDepth,
+		"ArchiveMaxAttempts": gCfg.ArchiveMaxAttempts,
+		"ShutdownGrace":      gCfg.ShutdownGrace,
+		"RunJitter":          gCfg.RunJitter,
+		"RunLeaseTTL":        gCfg.RunLeaseTTL,
+		"HealthMaxRunTime":   gCfg.HealthMaxRunTime,
+		"ReadyIndexCycles":   gCfg.ReadyIndexCycles,
+		"RunHistory":         gCfg.RunHistory,
+	} {
+		if v < 0 {
+			add("%s %d can not be negative", name, v)
+		}
+	}
+	return
+}
@@ -0,0 +1,58 @@
+package naLib
+
+import (
+	"strings"
+	"testing"
+)
+
+// func CheckConfig(gCfg *GlobalConfigType) (problems []string) {
+func Test_CheckConfig(t *testing.T) {
+	good := GlobalConfigType{
+		LoadUrl:                     "http://example.com/",
+		RedisKeySetOfFilesDownoaded: "downloaded-files",
+		RedisKeyNewsXML:             "NEWS_XML",
+		RedisKeyQuarantine:          "quarantined-files",
+		TmpDir:                      "./tmp",
+		StateBackend:                StateRedis,
+		DedupeBackend:               DedupeKeys,
+		RedisBatchSize:              100,
+	}
+	tests := []struct {
+		change func(c *GlobalConfigType)
+		expect string // Part of the problem, "" for none
+	}{
+		{change: func(c *GlobalConfigType) {}},
+		{change: func(c *GlobalConfigType) { c.LoadUrl = "" }, expect: "LoadUrl"},
+		{change: func(c *GlobalConfigType) { c.StateBackend = "mysql" }, expect: "StateBackend"},
+		{change: func(c *GlobalConfigType) {
+			c.DedupeBackend = "bloom"
+			c.BloomCapacity, c.BloomErrorRate = 10, 0.01
+			c.StateBackend = StateMemory
+		}, expect: "needs StateBackend"},
+		{change: func(c *GlobalConfigType) { c.DedupeBackend = "bloom"; c.BloomCapacity = 10; c.BloomErrorRate = 2 }, expect: "BloomErrorRate"},
+		{change: func(c *GlobalConfigType) { c.OutputOverflowPolicy = "drop" }, expect: "OutputOverflowPolicy"},
+		{change: func(c *GlobalConfigType) { c.OutputHighWater, c.OutputLowWater = 10, 20 }, expect: "OutputLowWater"},
+		{change: func(c *GlobalConfigType) { c.RedisClusterNodes = []string{"a:1"} }, expect: "RedisHashTag"},
+		{change: func(c *GlobalConfigType) { c.RedisAuthFile = "./no-such-file" }, expect: "RedisAuthFile"},
+		{change: func(c *GlobalConfigType) { c.RedisTLSCertFile = "../cfg.json" }, expect: "RedisTLSKeyFile"},
+		{change: func(c *GlobalConfigType) { c.LoadWorkers = -1 }, expect: "LoadWorkers"},
+		{change: func(c *GlobalConfigType) { c.RedisBatchSize = 0 }, expect: "RedisBatchSize"},
+		{change: func(c *GlobalConfigType) { c.RedisBatchSize = -1 }, expect: "RedisBatchSize"},
+		{change: func(c *GlobalConfigType) { c.RunSchedule = "*/15 * * *" }, expect: "RunSchedule"},
+		{change: func(c *GlobalConfigType) { c.RunWindows = []string{"Mon-Fri 18:00-7"} }, expect: "RunWindows"},
+	}
+	for ii, test := range tests {
+		gCfg := good
+		test.change(&gCfg)
+		problems := CheckConfig(&gCfg)
+		if test.expect == "" {
+			if len(problems) != 0 {
+				t.Errorf("Test_CheckConfig %d: expected no problems got %s", ii, problems)
+			}
+			continue
+		}
+		if len(problems) != 1 || !strings.Contains(problems[0], test.expect) {
+			t.Errorf("Test_CheckConfig %d: expected a problem with %s got %s", ii, test.expect, problems)
+		}
+	}
+}
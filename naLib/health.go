@@ -0,0 +1,119 @@
+package naLib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Health tracks the run loop for the /healthz and /readyz endpoints.  The loop is alive if it is waiting for a
+// run that is not overdue, or is in a run that has not gone on for more than HealthMaxRunTime seconds.  It is ready
+// if Redis can be reached and the directory listing was fetched in one of the last ReadyIndexCycles runs.
+type Health struct {
+	gCfg          *GlobalConfigType
+	lock          sync.Mutex
+	loop          string    // "starting", "running" or "waiting"
+	since         time.Time // When the loop went into that state
+	until         time.Time // When the wait is over
+	fetchFailures int       // Index fetches that failed since the last one that worked
+	lastFetch     time.Time // Time of the last index fetch that worked
+	lastFetchErr  string
+}
+
+// HealthReport is the JSON returned by /healthz and /readyz.
+type HealthReport struct {
+	Status             string   // "ok" or "fail"
+	Problems           []string `json:",omitempty"`
+	Loop               string
+	Since              time.Time
+	NextRun            *time.Time `json:",omitempty"`
+	LastIndexFetch     *time.Time `json:",omitempty"`
+	IndexFetchFailures int
+	LastIndexError     string `json:",omitempty"`
+}
+
+// loopSlack is how late the loop can be in waking up before it is considered stuck.
+const loopSlack = time.Minute
+
+// NewHealth returns the Health for a process that has just started.
+func NewHealth(gCfg *GlobalConfigType) *Health {
+	return &Health{gCfg: gCfg, loop: "starting", since: time.Now()}
+}
+
+// RunStarted records the start of a run.
+func (h *Health) RunStarted() {
+	h.lock.Lock()
+	h.loop, h.since, h.until = "running", time.Now(), time.Time{}
+	h.lock.Unlock()
+}
+
+// Waiting records that the loop is waiting until the next run.
+func (h *Health) Waiting(until time.Time) {
+	h.lock.Lock()
+	h.loop, h.since, h.until = "waiting", time.Now(), until
+	h.lock.Unlock()
+}
+
+// IndexFetched records the result of fetching the directory listing.
+func (h *Health) IndexFetched(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err != nil {
+		h.fetchFailures++
+		h.lastFetchErr = err.Error()
+		return
+	}
+	h.fetchFailures, h.lastFetch, h.lastFetchErr = 0, time.Now(), ""
+}
+
+// report fills in the state of the loop, the caller holds the lock.
+func (h *Health) report() (rep HealthReport) {
+	rep = HealthReport{Status: "ok", Loop: h.loop, Since: h.since, IndexFetchFailures: h.fetchFailures, LastIndexError: h.lastFetchErr}
+	if !h.until.IsZero() {
+		until := h.until
+		rep.NextRun = &until
+	}
+	if !h.lastFetch.IsZero() {
+		last := h.lastFetch
+		rep.LastIndexFetch = &last
+	}
+	return
+}
+
+// Fail adds a problem to the report.
+func (rep *HealthReport) Fail(format string, args ...interface{}) {
+	rep.Status = "fail"
+	rep.Problems = append(rep.Problems, fmt.Sprintf(format, args...))
+}
+
+// Alive checks that the loop is still going at 'now'.
+func (h *Health) Alive(now time.Time) (rep HealthReport) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	rep = h.report()
+	switch h.loop {
+	case "running":
+		if max := time.Duration(h.gCfg.HealthMaxRunTime) * time.Second; max > 0 && now.Sub(h.since) > max {
+			rep.Fail("the run started at %s has gone on for %s, more than HealthMaxRunTime", h.since.Format(time.RFC3339), now.Sub(h.since).Round(time.Second))
+		}
+	case "waiting":
+		if now.After(h.until.Add(loopSlack)) {
+			rep.Fail("the run due at %s has not started", h.until.Format(time.RFC3339))
+		}
+	}
+	return
+}
+
+// Ready checks that runs can work at 'now': redisErr is the result of a PING, nil if the state is not in Redis.
+func (h *Health) Ready(now time.Time, redisErr error) (rep HealthReport) {
+	rep = h.Alive(now)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if redisErr != nil {
+		rep.Fail("Redis is not reachable: %s", redisErr)
+	}
+	if n := h.gCfg.ReadyIndexCycles; n > 0 && h.fetchFailures >= n {
+		rep.Fail("the last %d fetches of the directory listing failed: %s", h.fetchFailures, h.lastFetchErr)
+	}
+	return
+}
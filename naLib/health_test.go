@@ -0,0 +1,56 @@
+package naLib
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// func (h *Health) Alive(now time.Time) (rep HealthReport) {
+func Test_HealthAlive(t *testing.T) {
+	h := NewHealth(&GlobalConfigType{HealthMaxRunTime: 3600})
+	now := time.Now()
+	if rep := h.Alive(now); rep.Status != "ok" || rep.Loop != "starting" {
+		t.Errorf("Test_HealthAlive: expected ok while starting got %+v", rep)
+	}
+
+	h.Waiting(now.Add(10 * time.Minute))
+	if rep := h.Alive(now.Add(10 * time.Minute)); rep.Status != "ok" {
+		t.Errorf("Test_HealthAlive: expected ok while waiting got %+v", rep)
+	}
+	if rep := h.Alive(now.Add(20 * time.Minute)); rep.Status != "fail" || len(rep.Problems) != 1 {
+		t.Errorf("Test_HealthAlive: expected an overdue run to fail got %+v", rep)
+	}
+
+	h.RunStarted()
+	if rep := h.Alive(time.Now().Add(30 * time.Minute)); rep.Status != "ok" || rep.Loop != "running" {
+		t.Errorf("Test_HealthAlive: expected ok while running got %+v", rep)
+	}
+	if rep := h.Alive(time.Now().Add(2 * time.Hour)); rep.Status != "fail" {
+		t.Errorf("Test_HealthAlive: expected a long run to fail got %+v", rep)
+	}
+}
+
+// func (h *Health) Ready(now time.Time, redisErr error) (rep HealthReport) {
+func Test_HealthReady(t *testing.T) {
+	h := NewHealth(&GlobalConfigType{ReadyIndexCycles: 2})
+	if rep := h.Ready(time.Now(), nil); rep.Status != "ok" {
+		t.Errorf("Test_HealthReady: expected ok got %+v", rep)
+	}
+	if rep := h.Ready(time.Now(), errors.New("connection refused")); rep.Status != "fail" {
+		t.Errorf("Test_HealthReady: expected fail when Redis is down got %+v", rep)
+	}
+
+	h.IndexFetched(errors.New("timeout"))
+	if rep := h.Ready(time.Now(), nil); rep.Status != "ok" || rep.IndexFetchFailures != 1 {
+		t.Errorf("Test_HealthReady: expected ok after 1 failed fetch got %+v", rep)
+	}
+	h.IndexFetched(errors.New("timeout"))
+	if rep := h.Ready(time.Now(), nil); rep.Status != "fail" || rep.LastIndexError != "timeout" {
+		t.Errorf("Test_HealthReady: expected fail after 2 failed fetches got %+v", rep)
+	}
+	h.IndexFetched(nil)
+	if rep := h.Ready(time.Now(), nil); rep.Status != "ok" || rep.LastIndexFetch == nil {
+		t.Errorf("Test_HealthReady: expected ok after a fetch worked got %+v", rep)
+	}
+}
@@ -0,0 +1,241 @@
+package naLib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pschlump/radix.v2/util"
+)
+
+// Keyspace builds every Redis key used by the aggregator, so that all of them follow the same layout.  With
+// RedisPrefix "na", RedisHashTag "news" and the default key names the keys are:
+//
+//	{news}na:downloaded-files     set of archive names that have been downloaded
+//	{news}na:quarantined-files    hash of rejected archive name -> reason
+//	{news}na:interrupted-files    set of archives that were not finished, to resume at the next run
+//	{news}na:archive-attempts     hash of archive name -> runs in a row it failed in, see ArchiveMaxAttempts
+//	{news}na:run-lease            held by the process that is running, so runs do not overlap
+//	{news}na:schedule             hash with the time of the next scheduled run
+//	{news}na:rerun-queue          set of archives queued with the admin API to be processed again
+//	{news}na:run-history          list of what each run did, newest first, capped at RunHistory
+//	{news}na:NEWS_XML             list of documents for the consumers, LPUSH in / RPOP out
+//	{news}na:doc:<name>           one string per loaded document, used to skip duplicates
+//	{news}na:bloom                hash describing the Bloom filter, with DedupeBackend "bloom"
+//	{news}na:bloom:bits:<n>       bitmap for layer n of the Bloom filter
+//	{news}na:bloom:exact:<n>      hash of document fingerprints, bucket n, for the exact check
+//
+// A trailing ":" on RedisPrefix is ignored, "na" and "na:" are the same prefix.  With no prefix the keys start
+// with the name, downloaded-files, NEWS_XML, doc:<name>.  Without a hash tag the {news} is left off.
+type Keyspace struct {
+	gCfg   *GlobalConfigType
+	prefix string // Prefix and ":", or "" for no prefix
+}
+
+// DocumentKeyPart is the part of a per-document key between the prefix and the name of the document.
+const DocumentKeyPart = "doc:"
+
+// NewKeyspace returns the Keyspace for the configuration.
+func NewKeyspace(gCfg *GlobalConfigType) Keyspace {
+	prefix := strings.TrimSuffix(gCfg.RedisPrefix, ":")
+	if prefix != "" {
+		prefix += ":"
+	}
+	return Keyspace{gCfg: gCfg, prefix: prefix}
+}
+
+// Key returns the full key for 'name', with the hash tag and prefix in front of it.
+func (ks Keyspace) Key(name string) string {
+	return HashTagKey(ks.prefix+name, ks.gCfg)
+}
+
+// Downloaded is the set of archive names that have been downloaded.
+func (ks Keyspace) Downloaded() string { return ks.Key(ks.gCfg.RedisKeySetOfFilesDownoaded) }
+
+// Quarantine is the hash of archives that were rejected.
+func (ks Keyspace) Quarantine() string { return ks.Key(ks.gCfg.RedisKeyQuarantine) }
+
+// Interrupted is the set of archives that were started but not finished, because of a shutdown or a crash.
+func (ks Keyspace) Interrupted() string { return ks.Key("interrupted-files") }
+
+// Attempts is the hash of the number of runs in a row that each archive in Interrupted has failed in.
+func (ks Keyspace) Attempts() string { return ks.Key("archive-attempts") }
+
+// RunLease is the lease held while a run is in progress, so that two processes do not run at the same time.
+func (ks Keyspace) RunLease() string { return ks.Key("run-lease") }
+
+// Schedule is the hash where a running process saves when its next run is, for the status command.
+func (ks Keyspace) Schedule() string { return ks.Key("schedule") }
+
+// Reruns is the set of archives queued to be processed again at the start of the next run, see the admin API.
+func (ks Keyspace) Reruns() string { return ks.Key("rerun-queue") }
+
+// RunHistory is the list of run records, JSON, newest first, see the history command.
+func (ks Keyspace) RunHistory() string { return ks.Key("run-history") }
+
+// NewsXML is the list that the documents are pushed on to for the consumers.
+func (ks Keyspace) NewsXML() string { return ks.Key(ks.gCfg.RedisKeyNewsXML) }
+
+// Document is the key used to check if the document 'name' has already been loaded.
+func (ks Keyspace) Document(name string) string { return ks.Key(DocumentKeyPart + name) }
+
+// DocumentPattern is a SCAN pattern that matches all of the per-document keys.
+func (ks Keyspace) DocumentPattern() string { return ks.Document("*") }
+
+// BloomMeta is the hash that describes the layers of the Bloom filter, see bloom.go.
+func (ks Keyspace) BloomMeta() string { return ks.Key("bloom") }
+
+// BloomBits is the bitmap for one layer of the Bloom filter, BloomBits("") is the prefix for all of them.
+func (ks Keyspace) BloomBits(layer string) string { return ks.Key("bloom:bits:" + layer) }
+
+// BloomExact is one of the hashes of fingerprints used for the exact check of Bloom filter positives.
+func (ks Keyspace) BloomExact(bucket int) string {
+	return ks.Key(fmt.Sprintf("bloom:exact:%d", bucket))
+}
+
+// Owns returns true if 'key' is one of the keys built by the Keyspace.  A key added to the Keyspace has to be added
+// here too, or migrate-keys can take it for an old per-document key.
+func (ks Keyspace) Owns(key string) bool {
+	for _, k := range []string{ks.Downloaded(), ks.Quarantine(), ks.Interrupted(), ks.Attempts(), ks.RunLease(),
+		ks.Schedule(), ks.Reruns(), ks.RunHistory(), ks.NewsXML(), ks.BloomMeta()} {
+		if key == k {
+			return true
+		}
+	}
+	for _, prefix := range []string{ks.Document(""), ks.BloomBits(""), ks.Key("bloom:exact:")} {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyKeyspace builds keys the way they were built before Keyspace: the prefix was put directly in front of
+// the set and hash names, per-document keys were prefix+":"+name and the list did not use the prefix at all.
+type legacyKeyspace struct {
+	gCfg *GlobalConfigType
+}
+
+func (lk legacyKeyspace) Downloaded() string {
+	return HashTagKey(lk.gCfg.RedisPrefix+lk.gCfg.RedisKeySetOfFilesDownoaded, lk.gCfg)
+}
+func (lk legacyKeyspace) Quarantine() string {
+	return HashTagKey(lk.gCfg.RedisPrefix+lk.gCfg.RedisKeyQuarantine, lk.gCfg)
+}
+func (lk legacyKeyspace) NewsXML() string        { return HashTagKey(lk.gCfg.RedisKeyNewsXML, lk.gCfg) }
+func (lk legacyKeyspace) DocumentPrefix() string { return HashTagKey(lk.gCfg.RedisPrefix+":", lk.gCfg) }
+
+// MigrateResult is what MigrateKeys did, or with DryRun would have done.
+type MigrateResult struct {
+	Renamed int // Keys that were renamed to the new name
+	Merged  int // Keys that were merged into a key that already had the new name
+	DryRun  bool
+}
+
+func (mr MigrateResult) String() string {
+	s := fmt.Sprintf("%d keys renamed, %d keys merged", mr.Renamed, mr.Merged)
+	if mr.DryRun {
+		s += " (dry run, nothing changed)"
+	}
+	return s
+}
+
+// MigrateKeys renames the keys written with the old key layout to the names from Keyspace.  Each key is moved with
+// a Lua script, so it is safe to run while the aggregator and the consumers are running.  If the new key already
+// exists, because a new version has already written to it, the old key is merged into it: sets are unioned, hash
+// fields that are not in the new hash are added, and list entries are added to the consumer (right) end since they
+// are older.  For per-document keys the new key is kept.  Running it again does nothing.
+func MigrateKeys(client util.Cmder, dryRun bool, gCfg *GlobalConfigType) (mr MigrateResult, err error) {
+	mr.DryRun = dryRun
+	ks := NewKeyspace(gCfg)
+	lk := legacyKeyspace{gCfg: gCfg}
+
+	move := func(oldKey, newKey string) error {
+		if oldKey == newKey {
+			return nil
+		}
+		if dryRun {
+			n, e := client.Cmd("EXISTS", oldKey).Int()
+			if e != nil {
+				return e
+			}
+			if n == 1 {
+				if m, _ := client.Cmd("EXISTS", newKey).Int(); m == 1 {
+					mr.Merged++
+				} else {
+					mr.Renamed++
+				}
+			}
+			return nil
+		}
+		n, e := util.LuaEval(client, moveKeyScript, 2, oldKey, newKey).Int()
+		if e != nil {
+			Log(LogState).Error("migrate failed", "key", oldKey, "new_key", newKey, "error", e)
+			return e
+		}
+		switch n {
+		case 1:
+			mr.Renamed++
+		case 2:
+			mr.Merged++
+		}
+		return nil
+	}
+
+	for _, kk := range [][2]string{
+		{lk.Downloaded(), ks.Downloaded()},
+		{lk.Quarantine(), ks.Quarantine()},
+		{lk.NewsXML(), ks.NewsXML()},
+	} {
+		err = move(kk[0], kk[1])
+		if err != nil {
+			return
+		}
+	}
+
+	// The old document pattern can also match keys that are already in the new layout, for example RedisPrefix "na"
+	// gives old keys "na:<name>" and new keys "na:doc:<name>", "na:run-lease" and so on, so those are skipped.
+	docPrefix := lk.DocumentPrefix()
+	err = scan(client, "SCAN", "", docPrefix+"*", func(keys []string) error {
+		for _, k := range keys {
+			if ks.Owns(k) {
+				continue
+			}
+			if e := move(k, ks.Document(strings.TrimPrefix(k, docPrefix))); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// moveKeyScript moves KEYS[1] to KEYS[2].  It returns 0 if there was nothing to move, 1 if the key was renamed and 2
+// if it was merged into an existing KEYS[2].
+const moveKeyScript = `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	redis.call('RENAME', KEYS[1], KEYS[2])
+	return 1
+end
+local t = redis.call('TYPE', KEYS[1]).ok
+if t ~= redis.call('TYPE', KEYS[2]).ok then
+	return redis.error_reply('can not merge ' .. KEYS[1] .. ' into ' .. KEYS[2] .. ', different types')
+end
+if t == 'set' then
+	redis.call('SUNIONSTORE', KEYS[2], KEYS[2], KEYS[1])
+elseif t == 'hash' then
+	local h = redis.call('HGETALL', KEYS[1])
+	for i = 1, #h, 2 do
+		redis.call('HSETNX', KEYS[2], h[i], h[i+1])
+	end
+elseif t == 'list' then
+	local l = redis.call('LRANGE', KEYS[1], 0, -1)
+	for i = 1, #l do
+		redis.call('RPUSH', KEYS[2], l[i])
+	end
+end
+redis.call('DEL', KEYS[1])
+return 2
+`
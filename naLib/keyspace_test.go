@@ -0,0 +1,157 @@
+package naLib
+
+import (
+	"testing"
+)
+
+// func NewKeyspace(gCfg *GlobalConfigType) Keyspace {
+func Test_Keyspace(t *testing.T) {
+	tests := []struct {
+		prefix, tag                           string
+		exDownloaded, exNews, exDoc, exLegacy string
+	}{
+		{prefix: "na:", exDownloaded: "na:downloaded-files", exNews: "na:NEWS_XML", exDoc: "na:doc:a.xml", exLegacy: "na::"},
+		{prefix: "na", exDownloaded: "na:downloaded-files", exNews: "na:NEWS_XML", exDoc: "na:doc:a.xml", exLegacy: "na:"},
+		{prefix: "", exDownloaded: "downloaded-files", exNews: "NEWS_XML", exDoc: "doc:a.xml", exLegacy: ":"},
+		{prefix: "na:", tag: "news", exDownloaded: "{news}na:downloaded-files", exNews: "{news}na:NEWS_XML", exDoc: "{news}na:doc:a.xml", exLegacy: "{news}na::"},
+	}
+	for ii, test := range tests {
+		gCfg := GlobalConfigType{RedisPrefix: test.prefix, RedisHashTag: test.tag, RedisKeySetOfFilesDownoaded: "downloaded-files", RedisKeyNewsXML: "NEWS_XML"}
+		ks := NewKeyspace(&gCfg)
+		if s := ks.Downloaded(); s != test.exDownloaded {
+			t.Errorf("Test_Keyspace %d: Downloaded expected %s got %s", ii, test.exDownloaded, s)
+		}
+		if s := ks.NewsXML(); s != test.exNews {
+			t.Errorf("Test_Keyspace %d: NewsXML expected %s got %s", ii, test.exNews, s)
+		}
+		if s := ks.Document("a.xml"); s != test.exDoc {
+			t.Errorf("Test_Keyspace %d: Document expected %s got %s", ii, test.exDoc, s)
+		}
+		if s := (legacyKeyspace{gCfg: &gCfg}).DocumentPrefix(); s != test.exLegacy {
+			t.Errorf("Test_Keyspace %d: legacy DocumentPrefix expected %s got %s", ii, test.exLegacy, s)
+		}
+		for _, k := range []string{ks.Interrupted(), ks.RunLease(), ks.BloomBits("3"), ks.BloomExact(7), ks.Document("a.xml")} {
+			if !ks.Owns(k) {
+				t.Errorf("Test_Keyspace %d: expected Owns(%s)", ii, k)
+			}
+		}
+		if k := ks.Key("1471622300928.xml"); ks.Owns(k) {
+			t.Errorf("Test_Keyspace %d: expected not Owns(%s)", ii, k)
+		}
+	}
+}
+
+// func MigrateKeys(client util.Cmder, dryRun bool, gCfg *GlobalConfigType) (mr MigrateResult, err error) {
+//
+// test depends on connecting to Redis and the ../cfg.json file
+func Test_MigrateKeys(t *testing.T) {
+	gCfg := GlobalConfigType{
+		RedisHost: "127.0.0.1",
+		RedisPort: "6379",
+	}
+	ReadConfigFile("../cfg.json", &gCfg)
+	gCfg.RedisPrefix = "Test_MigrateKeys:"
+	gCfg.RedisHashTag = ""
+	gCfg.RedisKeySetOfFilesDownoaded = "downloaded-files"
+	gCfg.RedisKeyQuarantine = "quarantined-files"
+	gCfg.RedisKeyNewsXML = "Test_MigrateKeys_NEWS_XML"
+
+	client, err := RedisClient(gCfg.RedisHost, gCfg.RedisPort, gCfg.RedisAuth)
+	if err != nil {
+		t.Errorf("RedisClient error- failed to connect- %s\n", err)
+		return
+	}
+
+	ks := NewKeyspace(&gCfg)
+	oldList, oldDoc := "Test_MigrateKeys_NEWS_XML", "Test_MigrateKeys::a.xml"
+	all := []interface{}{oldList, oldDoc, ks.NewsXML(), ks.Document("a.xml"), ks.Document("b.xml"), ks.Downloaded()}
+	client.Cmd("DEL", all...)
+
+	// old layout, plus a new list that already has a newer document on it
+	client.Cmd("LPUSH", oldList, "old-1", "old-2")
+	client.Cmd("LPUSH", ks.NewsXML(), "new-1")
+	client.Cmd("SET", oldDoc, "a.xml")
+	client.Cmd("SET", "Test_MigrateKeys::b.xml", "b.xml")
+	client.Cmd("SADD", ks.Downloaded(), "1471622300928.zip") // same name in old and new layout with this prefix
+
+	mr, err := MigrateKeys(client, true, &gCfg)
+	if err != nil || mr.Renamed != 2 || mr.Merged != 1 {
+		t.Errorf("MigrateKeys error- dry run got %s, %v\n", mr, err)
+	}
+	if n, _ := client.Cmd("EXISTS", oldDoc).Int(); n != 1 {
+		t.Errorf("MigrateKeys error- dry run moved %s\n", oldDoc)
+	}
+
+	mr, err = MigrateKeys(client, false, &gCfg)
+	if err != nil || mr.Renamed != 2 || mr.Merged != 1 {
+		t.Errorf("MigrateKeys error- got %s, %v\n", mr, err)
+	}
+	if s, _ := client.Cmd("GET", ks.Document("a.xml")).Str(); s != "a.xml" {
+		t.Errorf("MigrateKeys error- document not renamed, got [%s]\n", s)
+	}
+	if l, _ := client.Cmd("LRANGE", ks.NewsXML(), 0, -1).List(); len(l) != 3 || l[0] != "new-1" || l[2] != "old-1" {
+		t.Errorf("MigrateKeys error- list not merged with oldest on the right, got %s\n", l)
+	}
+	if n, _ := client.Cmd("EXISTS", oldList).Int(); n != 0 {
+		t.Errorf("MigrateKeys error- old list %s still exists\n", oldList)
+	}
+
+	mr, err = MigrateKeys(client, false, &gCfg)
+	if err != nil || mr.Renamed != 0 || mr.Merged != 0 {
+		t.Errorf("MigrateKeys error- second run should do nothing, got %s, %v\n", mr, err)
+	}
+
+	client.Cmd("DEL", all...)
+}
+
+// With RedisPrefix "na" the old per-document keys are "na:<name>", the same pattern as the keys that are already in
+// the new layout.  None of those may be moved.
+//
+// test depends on connecting to Redis and the ../cfg.json file
+func Test_MigrateKeysOverlap(t *testing.T) {
+	gCfg := GlobalConfigType{
+		RedisHost: "127.0.0.1",
+		RedisPort: "6379",
+	}
+	ReadConfigFile("../cfg.json", &gCfg)
+	gCfg.RedisPrefix = "Test_MigrateKeysOverlap"
+	gCfg.RedisHashTag = ""
+	gCfg.RedisKeySetOfFilesDownoaded = "downloaded-files"
+	gCfg.RedisKeyQuarantine = "quarantined-files"
+	gCfg.RedisKeyNewsXML = "NEWS_XML"
+
+	client, err := RedisClient(gCfg.RedisHost, gCfg.RedisPort, gCfg.RedisAuth)
+	if err != nil {
+		t.Errorf("RedisClient error- failed to connect- %s\n", err)
+		return
+	}
+
+	ks := NewKeyspace(&gCfg)
+	owned := []string{ks.Downloaded(), ks.Quarantine(), ks.Interrupted(), ks.Attempts(), ks.RunLease(), ks.Schedule(), ks.Reruns(),
+		ks.RunHistory(), ks.NewsXML(), ks.BloomMeta(), ks.BloomBits("0"), ks.BloomExact(3), ks.Document("b.xml")}
+	oldDoc := "Test_MigrateKeysOverlap:a.xml"
+	all := []interface{}{oldDoc, ks.Document("a.xml"), "NEWS_XML"}
+	for _, k := range owned {
+		all = append(all, k)
+	}
+	client.Cmd("DEL", all...)
+	for _, k := range owned {
+		client.Cmd("SET", k, "keep")
+	}
+	client.Cmd("SET", oldDoc, "a.xml")
+
+	mr, err := MigrateKeys(client, false, &gCfg)
+	if err != nil || mr.Renamed != 1 || mr.Merged != 0 {
+		t.Errorf("MigrateKeys error- expected only %s to be renamed, got %s, %v\n", oldDoc, mr, err)
+	}
+	for _, k := range owned {
+		if s, _ := client.Cmd("GET", k).Str(); s != "keep" {
+			t.Errorf("MigrateKeys error- %s was moved\n", k)
+		}
+	}
+	if s, _ := client.Cmd("GET", ks.Document("a.xml")).Str(); s != "a.xml" {
+		t.Errorf("MigrateKeys error- document not renamed, got [%s]\n", s)
+	}
+
+	client.Cmd("DEL", all...)
+}
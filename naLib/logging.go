@@ -0,0 +1,162 @@
+package naLib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The components that can be given their own log level in LogLevels.
+const (
+	LogRun      = "run"      // The run loop, scheduling, leases and shutdown
+	LogDownload = "download" // Fetching the directory listing and the archives
+	LogExtract  = "extract"  // Reading the documents out of the archives, quarantine
+	LogLoad     = "load"     // Pushing the documents onto the list, backpressure
+	LogRedis    = "redis"    // Connections to Redis and failed commands
+	LogState    = "state"    // The state store, pruning and key migration
+	LogHTTP     = "http"     // The /metrics, /healthz and /readyz listener
+)
+
+// LogComponents is the list of components, for checking LogLevels.
+var LogComponents = []string{LogRun, LogDownload, LogExtract, LogLoad, LogRedis, LogState, LogHTTP}
+
+// logging is the handler and levels set up by InitLogging, and the loggers made from them.
+var logging = struct {
+	lock    sync.RWMutex
+	handler slog.Handler
+	level   slog.Level            // Level for components that are not in levels
+	levels  map[string]slog.Level // From LogLevels
+	loggers map[string]*slog.Logger
+}{
+	handler: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	level:   slog.LevelInfo,
+	loggers: make(map[string]*slog.Logger),
+}
+
+// InitLogging sets up logging from LogFormat, LogLevel and LogLevels.  The old debug flags are the same as
+// setting a level: dbVerbose is LogLevel "debug" and dbPrintListOfZipFiles is "debug" for the extract component.
+// Anything logged with the log package goes to the same place at the info level.  If a level or the format is not
+// valid the default is used for it and an error is returned.
+func InitLogging(gCfg *GlobalConfigType) error {
+	return initLogging(gCfg, os.Stderr)
+}
+
+func initLogging(gCfg *GlobalConfigType, w io.Writer) (err error) {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug} // each component's level is checked in componentHandler
+	var handler slog.Handler = slog.NewTextHandler(w, opts)
+	if strings.EqualFold(gCfg.LogFormat, "json") {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	level, levels, problems := LogLevels(gCfg)
+	if len(problems) > 0 {
+		err = fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	logging.lock.Lock()
+	logging.handler, logging.level, logging.levels = handler, level, levels
+	logging.loggers = make(map[string]*slog.Logger)
+	logging.lock.Unlock()
+
+	slog.SetDefault(slog.New(componentHandler{Handler: handler, level: level}))
+	return
+}
+
+// LogLevels returns the default level and the level for each component from the configuration.  Anything that
+// is not valid is left at the default and reported in problems.
+func LogLevels(gCfg *GlobalConfigType) (level slog.Level, levels map[string]slog.Level, problems []string) {
+	level = slog.LevelInfo
+	if gCfg.LogLevel != "" {
+		if e := level.UnmarshalText([]byte(gCfg.LogLevel)); e != nil {
+			problems = append(problems, fmt.Sprintf("LogLevel %q is not debug, info, warn or error", gCfg.LogLevel))
+			level = slog.LevelInfo
+		}
+	}
+	if IsDbOn("dbVerbose", gCfg) && level > slog.LevelDebug {
+		level = slog.LevelDebug
+	}
+	levels = make(map[string]slog.Level)
+	if IsDbOn("dbPrintListOfZipFiles", gCfg) {
+		levels[LogExtract] = slog.LevelDebug
+	}
+	for component, name := range gCfg.LogLevels {
+		if !InArray(component, LogComponents) {
+			problems = append(problems, fmt.Sprintf("LogLevels has %q, the components are %s", component, strings.Join(LogComponents, ", ")))
+			continue
+		}
+		var l slog.Level
+		if e := l.UnmarshalText([]byte(name)); e != nil {
+			problems = append(problems, fmt.Sprintf("LogLevels %s %q is not debug, info, warn or error", component, name))
+			continue
+		}
+		levels[component] = l
+	}
+	if gCfg.LogFormat != "" && !strings.EqualFold(gCfg.LogFormat, "text") && !strings.EqualFold(gCfg.LogFormat, "json") {
+		problems = append(problems, fmt.Sprintf("LogFormat %q should be text or json", gCfg.LogFormat))
+	}
+	return
+}
+
+// Log returns the logger for a component.  Everything it logs has a "component" field, and any fields added to
+// the context with WithLogAttrs when logged with the ...Context methods.
+func Log(component string) *slog.Logger {
+	logging.lock.RLock()
+	lg, ok := logging.loggers[component]
+	logging.lock.RUnlock()
+	if ok {
+		return lg
+	}
+	logging.lock.Lock()
+	defer logging.lock.Unlock()
+	level, ok := logging.levels[component]
+	if !ok {
+		level = logging.level
+	}
+	lg = slog.New(componentHandler{Handler: logging.handler, level: level}).With("component", component)
+	logging.loggers[component] = lg
+	return lg
+}
+
+// logAttrsKey is the context key for the fields added by WithLogAttrs.
+type logAttrsKey struct{}
+
+// WithLogAttrs returns a context that adds the key, value pairs to everything logged with it, such as the run_id
+// for a run or the archive being processed.
+func WithLogAttrs(ctx context.Context, args ...interface{}) context.Context {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]interface{})
+	return context.WithValue(ctx, logAttrsKey{}, append(attrs[:len(attrs):len(attrs)], args...))
+}
+
+// componentHandler filters on the level for one component and adds the fields from WithLogAttrs.
+type componentHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+func (h componentHandler) Enabled(_ context.Context, level slog.Level) bool { return level >= h.level }
+
+func (h componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]interface{}); ok {
+		r = r.Clone()
+		r.Add(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return componentHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h componentHandler) WithGroup(name string) slog.Handler {
+	return componentHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+// NewRunID returns an id for a run, the start time and a random suffix, "20260302T101500-3f2a".
+func NewRunID() string {
+	return fmt.Sprintf("%s-%04x", time.Now().UTC().Format("20060102T150405"), rand.Intn(0x10000))
+}
@@ -0,0 +1,55 @@
+package naLib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+// func Log(component string) *slog.Logger {
+func Test_Log(t *testing.T) {
+	defer initLogging(&GlobalConfigType{}, os.Stderr)
+
+	var buf bytes.Buffer
+	err := initLogging(&GlobalConfigType{LogFormat: "json", LogLevel: "warn", LogLevels: map[string]string{LogRedis: "debug"}}, &buf)
+	if err != nil {
+		t.Fatalf("Test_Log: initLogging error %s", err)
+	}
+	ctx := WithLogAttrs(context.Background(), "run_id", "r1", "source", "feed")
+	Log(LogDownload).InfoContext(ctx, "not logged, below warn")
+	Log(LogDownload).WarnContext(ctx, "download warning", "archive", "a.zip")
+	Log(LogRedis).Debug("redis debug")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Test_Log: expected 2 lines got %d: %s", len(lines), buf.String())
+	}
+	var rec map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatalf("Test_Log: bad JSON %s, error %s", lines[0], err)
+	}
+	for k, v := range map[string]string{"msg": "download warning", "component": LogDownload, "run_id": "r1", "source": "feed", "archive": "a.zip"} {
+		if rec[k] != v {
+			t.Errorf("Test_Log: expected %s=%s got %v", k, v, rec[k])
+		}
+	}
+	if !strings.Contains(lines[1], `"component":"redis"`) {
+		t.Errorf("Test_Log: expected the redis debug line got %s", lines[1])
+	}
+}
+
+// func LogLevels(gCfg *GlobalConfigType) (level slog.Level, levels map[string]slog.Level, problems []string) {
+func Test_LogLevels(t *testing.T) {
+	level, levels, problems := LogLevels(&GlobalConfigType{DebugFlags: map[string]bool{"dbVerbose": true, "dbPrintListOfZipFiles": true}})
+	if level.String() != "DEBUG" || levels[LogExtract].String() != "DEBUG" || len(problems) != 0 {
+		t.Errorf("Test_LogLevels: expected the debug flags to set debug got %s %v %v", level, levels, problems)
+	}
+
+	_, _, problems = LogLevels(&GlobalConfigType{LogFormat: "xml", LogLevel: "loud", LogLevels: map[string]string{"nope": "info", LogLoad: "quiet"}})
+	if len(problems) != 4 {
+		t.Errorf("Test_LogLevels: expected 4 problems got %q", problems)
+	}
+}
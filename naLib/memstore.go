@@ -0,0 +1,310 @@
+package naLib
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pschlump/radix.v2/util"
+)
+
+// MemoryStore is a StateStore kept in memory.  Everything is lost when the program exits, so it is for tests and
+// for one off runs.  The output list is still in Redis, see outputList.
+type MemoryStore struct {
+	gCfg     *GlobalConfigType
+	output   outputList
+	lock     sync.Mutex
+	sets     map[string]map[string]bool
+	hashes   map[string]map[string]string
+	keys     map[string]memEntry
+	counters map[string]int64
+	lists    map[string][][]byte // oldest first
+}
+
+type memEntry struct {
+	value   string
+	expires time.Time // zero for never
+}
+
+func (e memEntry) live(now time.Time) bool { return e.expires.IsZero() || now.Before(e.expires) }
+
+// NewMemoryStore returns an empty MemoryStore.  The output list is pushed to Redis with 'out', nil keeps it in
+// memory, for tests.
+func NewMemoryStore(out util.Cmder, gCfg *GlobalConfigType) *MemoryStore {
+	return &MemoryStore{
+		gCfg:     gCfg,
+		output:   newOutputList(out, gCfg),
+		sets:     make(map[string]map[string]bool),
+		hashes:   make(map[string]map[string]string),
+		keys:     make(map[string]memEntry),
+		counters: make(map[string]int64),
+		lists:    make(map[string][][]byte),
+	}
+}
+
+func (ms *MemoryStore) AddNew(set string, members []string) (added []bool, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	s := ms.sets[set]
+	if s == nil {
+		s = make(map[string]bool)
+		ms.sets[set] = s
+	}
+	added = make([]bool, len(members))
+	for ii, m := range members {
+		if !s[m] {
+			s[m] = true
+			added[ii] = true
+		}
+	}
+	return
+}
+
+func (ms *MemoryStore) Remove(set string, members []string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for _, m := range members {
+		delete(ms.sets[set], m)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) IsMember(set, member string) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.sets[set][member], nil
+}
+
+func (ms *MemoryStore) Members(set string, fn func(member string) error) error {
+	ms.lock.Lock()
+	members := make([]string, 0, len(ms.sets[set]))
+	for m := range ms.sets[set] {
+		members = append(members, m)
+	}
+	ms.lock.Unlock()
+	for _, m := range members {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) SetField(hash, field, value string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	h := ms.hashes[hash]
+	if h == nil {
+		h = make(map[string]string)
+		ms.hashes[hash] = h
+	}
+	h[field] = value
+	return nil
+}
+
+func (ms *MemoryStore) GetField(hash, field string) (string, bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	value, ok := ms.hashes[hash][field]
+	return value, ok, nil
+}
+
+func (ms *MemoryStore) RemoveFields(hash string, fields []string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for _, f := range fields {
+		delete(ms.hashes[hash], f)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Fields(hash string, fn func(field, value string) error) error {
+	ms.lock.Lock()
+	h := make(map[string]string, len(ms.hashes[hash]))
+	for f, v := range ms.hashes[hash] {
+		h[f] = v
+	}
+	ms.lock.Unlock()
+	for f, v := range h {
+		if err := fn(f, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Count(name string) (int, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return len(ms.sets[name]) + len(ms.hashes[name]), nil
+}
+
+func (ms *MemoryStore) Expire() (removed int, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	now := time.Now()
+	for k, e := range ms.keys {
+		if !e.live(now) {
+			delete(ms.keys, k)
+			removed++
+		}
+	}
+	return
+}
+
+func (ms *MemoryStore) SetIfNotExists(key, value string, ttl time.Duration) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.setNX(key, value, ttl, time.Now()), nil
+}
+
+// setNX is SetIfNotExists with the lock held.
+func (ms *MemoryStore) setNX(key, value string, ttl time.Duration, now time.Time) bool {
+	if e, ok := ms.keys[key]; ok && e.live(now) {
+		return false
+	}
+	ms.keys[key] = newMemEntry(value, ttl, now)
+	return true
+}
+
+func newMemEntry(value string, ttl time.Duration, now time.Time) memEntry {
+	e := memEntry{value: value}
+	if ttl > 0 {
+		e.expires = now.Add(ttl)
+	}
+	return e
+}
+
+func (ms *MemoryStore) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	now := time.Now()
+	if e, ok := ms.keys[name]; ok && e.live(now) && e.value != owner {
+		return false, nil
+	}
+	ms.keys[name] = newMemEntry(owner, ttl, now)
+	return true, nil
+}
+
+func (ms *MemoryStore) ReleaseLease(name, owner string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if e, ok := ms.keys[name]; ok && e.value == owner {
+		delete(ms.keys, name)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Incr(counter string, n int64) (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.counters[counter] += n
+	return ms.counters[counter], nil
+}
+
+// Push marks the new documents as loaded and pushes them with the lock held.  If the push to Redis fails they are
+// not marked as loaded.
+func (ms *MemoryStore) Push(list string, docs []LoadDoc) (isNew []bool, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	now := time.Now()
+	ttl := time.Duration(DedupeTTL(ms.gCfg)) * time.Second
+	isNew = make([]bool, len(docs))
+	var data [][]byte
+	for ii, d := range docs {
+		if ms.setNX(d.Key, d.Name, ttl, now) {
+			isNew[ii] = true
+			data = append(data, d.Data)
+		}
+	}
+	if len(data) == 0 || skipPush(list, len(data), ms.gCfg) {
+		return
+	}
+	rs := ms.output.redis(list)
+	if rs == nil {
+		ms.lists[list] = append(ms.lists[list], data...)
+		return
+	}
+	if err = rs.Enqueue(list, data); err != nil {
+		for ii, d := range docs {
+			if isNew[ii] {
+				delete(ms.keys, d.Key)
+			}
+		}
+		return nil, err
+	}
+	return
+}
+
+func (ms *MemoryStore) Loaded(docs []LoadDoc) (loaded []bool, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	now := time.Now()
+	loaded = make([]bool, len(docs))
+	for ii, d := range docs {
+		e, ok := ms.keys[d.Key]
+		loaded[ii] = ok && e.live(now)
+	}
+	return
+}
+
+func (ms *MemoryStore) Enqueue(list string, data [][]byte) error {
+	if rs := ms.output.redis(list); rs != nil {
+		return rs.Enqueue(list, data)
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.lists[list] = append(ms.lists[list], data...)
+	return nil
+}
+
+func (ms *MemoryStore) Pop(list string) (data []byte, ok bool, err error) {
+	if rs := ms.output.redis(list); rs != nil {
+		return rs.Pop(list)
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	l := ms.lists[list]
+	if len(l) == 0 {
+		return nil, false, nil
+	}
+	ms.lists[list] = l[1:]
+	return l[0], true, nil
+}
+
+func (ms *MemoryStore) Len(list string) (int, error) {
+	if rs := ms.output.redis(list); rs != nil {
+		return rs.Len(list)
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return len(ms.lists[list]), nil
+}
+
+func (ms *MemoryStore) Recent(list string, n int) (data [][]byte, err error) {
+	if rs := ms.output.redis(list); rs != nil {
+		return rs.Recent(list, n)
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	l := ms.lists[list]
+	for ii := len(l) - 1; ii >= 0 && len(data) < n; ii-- {
+		data = append(data, l[ii])
+	}
+	return
+}
+
+func (ms *MemoryStore) Trim(list string, max int) (dropped int, err error) {
+	if rs := ms.output.redis(list); rs != nil {
+		return rs.Trim(list, max)
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	l := ms.lists[list]
+	if len(l) > max {
+		dropped = len(l) - max
+		ms.lists[list] = l[dropped:]
+	}
+	return
+}
+
+func (ms *MemoryStore) Close() error { return ms.output.Close() }
@@ -0,0 +1,204 @@
+package naLib
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The Prometheus metrics.  They are always collected and are served on /metrics when HTTPAddr is set.  Every
+// metric has a "source" label, MetricsSource or the host name in LoadUrl, so that several aggregators reading
+// different feeds can be told apart.
+var (
+	metricIndexFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "news_aggregator_index_fetches_total",
+		Help: "Directory listings fetched from LoadUrl, by result (ok or error).",
+	}, []string{"source", "result"})
+	metricIndexDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "news_aggregator_index_fetch_duration_seconds",
+		Help:    "Time to fetch and parse the directory listing.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"source"})
+	metricArchivesDiscovered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "news_aggregator_archives_discovered_total",
+		Help: "New archives found in the directory listing.",
+	}, []string{"source"})
+	metricArchivesDownloaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "news_aggregator_archives_downloaded_total",
+		Help: "Archives downloaded.",
+	}, []string{"source"})
+	metricArchivesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "news_aggregator_archives_failed_total",
+		Help: "Archives that failed, by stage (download or extract).",
+	}, []string{"source", "stage"})
+	metricDownloadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "news_aggregator_download_bytes_total",
+		Help: "Bytes of archives downloaded.",
+	}, []string{"source"})
+	metricDownloadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "news_aggregator_download_duration_seconds",
+		Help:    "Time to download an archive.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"source"})
+	metricExtractDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "news_aggregator_extract_duration_seconds",
+		Help:    "Time to read all of the documents out of an archive, including waiting for them to be loaded.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"source"})
+	metricDocumentsPushed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "news_aggregator_documents_pushed_total",
+		Help: "Documents pushed onto the output list.",
+	}, []string{"source"})
+	metricDocumentsDeduplicated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "news_aggregator_documents_deduplicated_total",
+		Help: "Documents skipped because they had already been loaded.",
+	}, []string{"source"})
+	metricRedisErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "news_aggregator_redis_errors_total",
+		Help: "Failed Redis commands and health checks, each retry is counted.",
+	}, []string{"source"})
+	metricLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "news_aggregator_last_success_timestamp_seconds",
+		Help: "Unix time of the end of the last successful run.",
+	}, []string{"source"})
+)
+
+func init() {
+	prometheus.MustRegister(metricIndexFetches, metricIndexDuration, metricArchivesDiscovered, metricArchivesDownloaded,
+		metricArchivesFailed, metricDownloadBytes, metricDownloadDuration, metricExtractDuration, metricDocumentsPushed,
+		metricDocumentsDeduplicated, metricRedisErrors, metricLastSuccess)
+}
+
+// MetricsSource returns the value of the "source" label: MetricsSource from the configuration, or the host name in
+// LoadUrl.
+func MetricsSource(gCfg *GlobalConfigType) string {
+	if gCfg.MetricsSource != "" {
+		return gCfg.MetricsSource
+	}
+	if u, err := url.Parse(gCfg.LoadUrl); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return gCfg.LoadUrl
+}
+
+// Metrics records the metrics for one source.
+type Metrics struct {
+	source      string
+	lock        sync.Mutex
+	started     time.Time
+	lastSuccess time.Time
+}
+
+// NewMetrics returns the Metrics for the source in the configuration.
+func NewMetrics(gCfg *GlobalConfigType) *Metrics {
+	return &Metrics{source: MetricsSource(gCfg), started: time.Now()}
+}
+
+// IndexFetch records fetching the directory listing.
+func (m *Metrics) IndexFetch(d time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metricIndexFetches.WithLabelValues(m.source, result).Inc()
+	metricIndexDuration.WithLabelValues(m.source).Observe(d.Seconds())
+}
+
+// Discovered records n new archives in the directory listing.
+func (m *Metrics) Discovered(n int) {
+	metricArchivesDiscovered.WithLabelValues(m.source).Add(float64(n))
+}
+
+// Downloaded records an archive of 'bytes' downloaded in d.
+func (m *Metrics) Downloaded(bytes int64, d time.Duration) {
+	metricArchivesDownloaded.WithLabelValues(m.source).Inc()
+	metricDownloadBytes.WithLabelValues(m.source).Add(float64(bytes))
+	metricDownloadDuration.WithLabelValues(m.source).Observe(d.Seconds())
+}
+
+// Extracted records reading the documents out of an archive in d.
+func (m *Metrics) Extracted(d time.Duration) {
+	metricExtractDuration.WithLabelValues(m.source).Observe(d.Seconds())
+}
+
+// Failed records an archive that failed in 'stage', "download" or "extract".
+func (m *Metrics) Failed(stage string) {
+	metricArchivesFailed.WithLabelValues(m.source, stage).Inc()
+}
+
+// Pushed records the result of StateStore.Push, isNew is true for each document that was pushed.
+func (m *Metrics) Pushed(isNew []bool) {
+	n := 0
+	for _, b := range isNew {
+		if b {
+			n++
+		}
+	}
+	metricDocumentsPushed.WithLabelValues(m.source).Add(float64(n))
+	metricDocumentsDeduplicated.WithLabelValues(m.source).Add(float64(len(isNew) - n))
+}
+
+// RedisError records a failed Redis command.
+func (m *Metrics) RedisError() {
+	metricRedisErrors.WithLabelValues(m.source).Inc()
+}
+
+// RunSucceeded records the end of a successful run.
+func (m *Metrics) RunSucceeded() {
+	now := time.Now()
+	m.lock.Lock()
+	m.lastSuccess = now
+	m.lock.Unlock()
+	metricLastSuccess.WithLabelValues(m.source).Set(float64(now.Unix()))
+}
+
+// SinceLastSuccess returns the time since the last successful run, or since the process started if there has not
+// been one.
+func (m *Metrics) SinceLastSuccess() time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.lastSuccess.IsZero() {
+		return time.Since(m.started)
+	}
+	return time.Since(m.lastSuccess)
+}
+
+// RegisterGauges adds the gauges that are read when /metrics is scraped: the length of the output list, the time
+// since the last successful run, and the time loading was paused and documents dropped by the backpressure.
+func (m *Metrics) RegisterGauges(store StateStore, listKey string, bp *Backpressure) {
+	labels := prometheus.Labels{"source": m.source}
+	prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "news_aggregator_output_list_length",
+		Help:        "Documents waiting on the output list for the consumers.",
+		ConstLabels: labels,
+	}, func() float64 {
+		n, err := store.Len(listKey)
+		if err != nil {
+			return -1
+		}
+		return float64(n)
+	}))
+	prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "news_aggregator_seconds_since_last_success",
+		Help:        "Seconds since the last successful run, or since the process started if there has not been one.",
+		ConstLabels: labels,
+	}, func() float64 { return m.SinceLastSuccess().Seconds() }))
+	prometheus.Register(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name:        "news_aggregator_backpressure_throttled_seconds_total",
+		Help:        "Time loading was paused because the output list was at OutputHighWater.",
+		ConstLabels: labels,
+	}, func() float64 {
+		throttled, _ := bp.Stats()
+		return throttled.Seconds()
+	}))
+	prometheus.Register(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name:        "news_aggregator_backpressure_dropped_total",
+		Help:        "Documents trimmed off the output list by the drop-oldest OutputOverflowPolicy.",
+		ConstLabels: labels,
+	}, func() float64 {
+		_, dropped := bp.Stats()
+		return float64(dropped)
+	}))
+}
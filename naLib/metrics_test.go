@@ -0,0 +1,63 @@
+package naLib
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// func MetricsSource(gCfg *GlobalConfigType) string {
+func Test_MetricsSource(t *testing.T) {
+	cfg := GlobalConfigType{LoadUrl: "http://feed.example.com:8080/posts/"}
+	if s := MetricsSource(&cfg); s != "feed.example.com:8080" {
+		t.Errorf("Test_MetricsSource: expected the LoadUrl host got %q", s)
+	}
+	cfg.MetricsSource = "mainstream"
+	if s := MetricsSource(&cfg); s != "mainstream" {
+		t.Errorf("Test_MetricsSource: expected mainstream got %q", s)
+	}
+}
+
+// func (m *Metrics) Pushed(isNew []bool) {
+func Test_Metrics(t *testing.T) {
+	m := NewMetrics(&GlobalConfigType{MetricsSource: "Test_Metrics"})
+
+	m.IndexFetch(time.Second, nil)
+	m.IndexFetch(time.Second, errors.New("timeout"))
+	m.IndexFetch(time.Second, nil)
+	if n := testutil.ToFloat64(metricIndexFetches.WithLabelValues("Test_Metrics", "ok")); n != 2 {
+		t.Errorf("Test_Metrics: expected 2 ok index fetches got %v", n)
+	}
+	if n := testutil.ToFloat64(metricIndexFetches.WithLabelValues("Test_Metrics", "error")); n != 1 {
+		t.Errorf("Test_Metrics: expected 1 failed index fetch got %v", n)
+	}
+
+	m.Downloaded(1000, time.Second)
+	m.Downloaded(500, time.Second)
+	if n := testutil.ToFloat64(metricDownloadBytes.WithLabelValues("Test_Metrics")); n != 1500 {
+		t.Errorf("Test_Metrics: expected 1500 bytes got %v", n)
+	}
+
+	m.Pushed([]bool{true, false, true, true})
+	if n := testutil.ToFloat64(metricDocumentsPushed.WithLabelValues("Test_Metrics")); n != 3 {
+		t.Errorf("Test_Metrics: expected 3 pushed got %v", n)
+	}
+	if n := testutil.ToFloat64(metricDocumentsDeduplicated.WithLabelValues("Test_Metrics")); n != 1 {
+		t.Errorf("Test_Metrics: expected 1 deduplicated got %v", n)
+	}
+
+	m.Failed("extract")
+	if n := testutil.ToFloat64(metricArchivesFailed.WithLabelValues("Test_Metrics", "extract")); n != 1 {
+		t.Errorf("Test_Metrics: expected 1 failed extract got %v", n)
+	}
+
+	m.RunSucceeded()
+	if d := m.SinceLastSuccess(); d > time.Second {
+		t.Errorf("Test_Metrics: expected a recent success got %s", d)
+	}
+	if n := testutil.ToFloat64(metricLastSuccess.WithLabelValues("Test_Metrics")); n < float64(time.Now().Unix()-1) {
+		t.Errorf("Test_Metrics: expected the last success time to be now got %v", n)
+	}
+}
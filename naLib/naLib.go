@@ -4,9 +4,9 @@ package naLib
 // 1. xyzzy1 - move this into HTTPGetToFile
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -14,6 +14,7 @@ import (
 	"os"
 
 	"github.com/pschlump/radix.v2/redis"
+	"github.com/pschlump/radix.v2/util"
 )
 
 // GlobalConfigType is for reading in the configuration for this program.
@@ -45,6 +46,67 @@ type GlobalConfigType struct {
 	TmpDir                      string          `json:"TmpDir"`                      //	Where to create temporary directories
 	TmpPrefix                   string          `json:"TmpPrefix"`                   // Prefix to create the temporary directories with
 	RedisKeyNewsXML             string          `json:"RedisKeyNewsXML"`             //
+	RedisKeyQuarantine          string          `json:"RedisKeyQuarantine"`          // Hash of archives that were rejected, archive name -> reason
+	QuarantineDir               string          `json:"QuarantineDir"`               // If set, rejected archives are moved to this directory
+	ArchiveMaxEntries           int             `json:"ArchiveMaxEntries"`           // Limits on archive extraction, 0 is no limit
+	ArchiveMaxEntryBytes        int64           `json:"ArchiveMaxEntryBytes"`        //
+	ArchiveMaxTotalBytes        int64           `json:"ArchiveMaxTotalBytes"`        //
+	ArchiveMaxRatio             float64         `json:"ArchiveMaxRatio"`             //
+	ArchiveMaxDepth             int             `json:"ArchiveMaxDepth"`             // How many levels of archives inside of archives to expand
+	ArchiveMaxAttempts          int             `json:"ArchiveMaxAttempts"`          // Runs in a row an archive can fail in before it is quarantined, 0 for no limit
+	DownloadWorkers             int             `json:"DownloadWorkers"`             // Number of archives to download at the same time
+	ExtractWorkers              int             `json:"ExtractWorkers"`              // Number of archives to read documents from at the same time
+	LoadWorkers                 int             `json:"LoadWorkers"`                 // Number of documents to load into Redis at the same time
+	ArchiveBuffer               int             `json:"ArchiveBuffer"`               // Downloaded archives waiting to be extracted
+	DocumentBuffer              int             `json:"DocumentBuffer"`              // Documents waiting to be loaded
+	RedisBatchSize              int             `json:"RedisBatchSize"`              // Number of documents to dedupe and push in one round trip
+	RedisPoolSize               int             `json:"RedisPoolSize"`               // Number of connections to Redis
+	RedisTimeout                int             `json:"RedisTimeout"`                // Seconds to wait for a read or write to Redis, 0 waits forever
+	RedisRetries                int             `json:"RedisRetries"`                // Number of times to retry after losing the connection to Redis
+	RedisHealthCheck            int             `json:"RedisHealthCheck"`            // Seconds between PINGs to check Redis is reachable, 0 turns off
+	RedisSentinelMaster         string          `json:"RedisSentinelMaster"`         // Name of the master to get from Sentinel
+	RedisSentinelAddrs          []string        `json:"RedisSentinelAddrs"`          // host:port of the sentinels
+	RedisClusterNodes           []string        `json:"RedisClusterNodes"`           // host:port of Redis Cluster seed nodes
+	RedisHashTag                string          `json:"RedisHashTag"`                // If set, all keys start with {RedisHashTag} so they are in one cluster slot
+	RedisUser                   string          `json:"RedisUser"`                   // Redis 6 ACL user name, used with the password
+	RedisAuthFile               string          `json:"RedisAuthFile"`               // File with the Redis password in it, instead of RedisAuth
+	RedisAuthEnv                string          `json:"RedisAuthEnv"`                // Environment variable with the Redis password in it, instead of RedisAuth
+	RedisTLS                    bool            `json:"RedisTLS"`                    // Connect to Redis with TLS
+	RedisTLSCAFile              string          `json:"RedisTLSCAFile"`              // PEM file with the CA certificates to trust
+	RedisTLSCertFile            string          `json:"RedisTLSCertFile"`            // PEM client certificate
+	RedisTLSKeyFile             string          `json:"RedisTLSKeyFile"`             // PEM client key
+	RedisTLSServerName          string          `json:"RedisTLSServerName"`          // Name to check in the server certificate, if not the host name
+	RedisTLSInsecureSkipVerify  bool            `json:"RedisTLSInsecureSkipVerify"`  // Do not check the server certificate - for testing only
+	RetentionDays               int             `json:"RetentionDays"`               // Days to keep state in Redis, 0 keeps it forever
+	PruneFreq                   int             `json:"PruneFreq"`                   // Seconds between prunes of old state when running with RunFreq, 0 turns off
+	OutputHighWater             int             `json:"OutputHighWater"`             // Length of RedisKeyNewsXML at which loading pauses or drops, 0 for no limit
+	OutputLowWater              int             `json:"OutputLowWater"`              // Length at which loading resumes after a pause, default 80% of OutputHighWater
+	OutputOverflowPolicy        string          `json:"OutputOverflowPolicy"`        // "pause" (default) or "drop-oldest"
+	StateBackend                string          `json:"StateBackend"`                // "redis" (default), "bolt" or "memory"
+	StateFile                   string          `json:"StateFile"`                   // Database file for the "bolt" StateBackend
+	DedupeBackend               string          `json:"DedupeBackend"`               // "keys" (default) or "bloom"
+	BloomCapacity               int             `json:"BloomCapacity"`               // Names in the first layer of the Bloom filter, each new layer is twice as large
+	BloomErrorRate              float64         `json:"BloomErrorRate"`              // False positive rate for the Bloom filter
+	BloomExactCheck             bool            `json:"BloomExactCheck"`             // Check positives from the Bloom filter against saved fingerprints
+	BloomExactBuckets           int             `json:"BloomExactBuckets"`           // Number of hashes the fingerprints are spread over
+	ShutdownGrace               int             `json:"ShutdownGrace"`               // Seconds to finish the archives in progress after SIGINT or SIGTERM
+	RunSchedule                 string          `json:"RunSchedule"`                 // Cron expression for when to run, instead of RunFreq
+	RunJitter                   int             `json:"RunJitter"`                   // Up to this many seconds are added to each scheduled run
+	RunWindows                  []string        `json:"RunWindows"`                  // Runs only start in these windows, "Mon-Fri 18:00-07:00"
+	RunLeaseTTL                 int             `json:"RunLeaseTTL"`                 // Seconds the run lease is held for, renewed while a run is in progress
+	HTTPAddr                    string          `json:"HTTPAddr"`                    // Address to serve /metrics, /healthz and /readyz on, ":9180", "" for none
+	HealthMaxRunTime            int             `json:"HealthMaxRunTime"`            // Seconds a run can take before /healthz fails, 0 for no limit
+	ReadyIndexCycles            int             `json:"ReadyIndexCycles"`            // /readyz fails after this many runs in a row that could not fetch the directory listing
+	MetricsSource               string          `json:"MetricsSource"`               // Value of the "source" label on the metrics, default the host in LoadUrl
+	RunHistory                  int             `json:"RunHistory"`                  // Number of run records to keep for the history command, 0 for none
+	AdminToken                  string          `json:"AdminToken"`                  // Bearer token for the admin API on HTTPAddr, "" turns the API off
+	AdminTokenFile              string          `json:"AdminTokenFile"`              // File with the admin token in it, instead of AdminToken
+	AdminTokenEnv               string          `json:"AdminTokenEnv"`               // Environment variable with the admin token in it, instead of AdminToken
+
+	// Logging, see InitLogging
+	LogFormat string            `json:"LogFormat"` // "text" (default) or "json"
+	LogLevel  string            `json:"LogLevel"`  // "debug", "info" (default), "warn" or "error"
+	LogLevels map[string]string `json:"LogLevels"` // Level for each component, {"redis": "debug"}, see LogComponents
 }
 
 // IsDbOn returns true if a specified debug flag is enabled.
@@ -67,60 +129,98 @@ func ReadConfigFile(fn string, gCfg *GlobalConfigType) {
 	}
 }
 
-// RemoveDuplicateDownloadFiles takes a list of .zip files to be downloaded and looks in the list in Redis
+// RemoveDuplicateDownloadFiles takes a list of .zip files to be downloaded and looks in the list in the store
 // to see if the file has already been marked as downloaded.  The returned list is just the files that do not
-// appear in the Redis list of files that have already been processed.
-func RemoveDuplicateDownloadFiles(client *redis.Client, fList []string, gCfg *GlobalConfigType) (rv []string) {
-	// Use Redis set to see if file is already down.
-	for _, fn := range fList {
-		key := gCfg.RedisPrefix + gCfg.RedisKeySetOfFilesDownoaded
-		// TODO: this has a race condition in it - if multiple processes are to be run then this test should be changed to set a key, and check the key in Redis.
-		if !IsInRedisSet(client, fn, key) {
-			rv = append(rv, fn)
-			AddToRedisSet(client, fn, key)
+// appear in the list of files that have already been processed.  If the store can not be reached an error
+// is returned, and none of the files should be processed.
+//
+// The check and the add to the set are done for the entire list in one atomic step, so if multiple processes
+// are run only one of them will get each file.
+func RemoveDuplicateDownloadFiles(store StateStore, fList []string, gCfg *GlobalConfigType) (rv []string, err error) {
+	if len(fList) == 0 {
+		return
+	}
+	added, err := store.AddNew(NewKeyspace(gCfg).Downloaded(), fList)
+	if err != nil {
+		return nil, err
+	}
+	for ii, a := range added {
+		if a {
+			rv = append(rv, fList[ii])
 		}
 	}
 	return
 }
 
+// addNewMembersScript adds each of ARGV to the set KEYS[1] and returns an array with a 1 for each
+// member that was not already in the set.
+const addNewMembersScript = `
+local rv = {}
+for i = 1, #ARGV do
+	rv[i] = redis.call('SADD', KEYS[1], ARGV[i])
+end
+return rv
+`
+
 // DownloadZipFiles downloads each of the files in the fList into tmpDir
-func DownloadZipFiles(fList []string, tmpDir string, gCfg *GlobalConfigType) (fullPathFn []string) {
+func DownloadZipFiles(ctx context.Context, fList []string, tmpDir string, gCfg *GlobalConfigType) (fullPathFn []string) {
 	for _, fn := range fList {
-
-		fpfn := tmpDir + "/" + fn
+		fpfn, _ := DownloadFile(ctx, fn, tmpDir, gCfg)
 		fullPathFn = append(fullPathFn, fpfn)
+	}
+	return
+}
 
-		// xyzzy1 - move this into HTTPGetToFile
+var ErrDownloadFailed = errors.New("Download failed")
 
-		fp, err := Fopen(fpfn, "w")
-		if err != nil {
-			log.Printf("Error: Unable to open file %s", fpfn)
-		} else {
-			defer fp.Close()
+// DownloadFile downloads the file 'fn' from gCfg.LoadUrl into tmpDir.  The path to the downloaded file is returned.
+// If the download fails or ctx is canceled part way through, the partly written file is removed.
+func DownloadFile(ctx context.Context, fn string, tmpDir string, gCfg *GlobalConfigType) (fpfn string, err error) {
+	fpfn = tmpDir + "/" + fn
 
-			URL := gCfg.LoadUrl + "/" + fn
-			HTTPGetToFile(URL, fp, fpfn)
+	// xyzzy1 - move this into HTTPGetToFile
+
+	fp, err := Fopen(fpfn, "w")
+	if err != nil {
+		Log(LogDownload).ErrorContext(ctx, "unable to open the file to download into", "path", fpfn, "error", err)
+		return
+	}
+	defer fp.Close()
+
+	URL := gCfg.LoadUrl + "/" + fn
+	if HTTPGetToFile(ctx, URL, fp, fpfn) != http.StatusOK {
+		err = ErrDownloadFailed
+		if ctx.Err() != nil {
+			err = ctx.Err()
 		}
+		os.Remove(fpfn)
 	}
 	return
 }
 
-// HTTPGetToFile will perform a http.Get on the specified url, then copying the data to the file fp/fn.
-func HTTPGetToFile(URL string, fp *os.File, fn string) (status int) {
-	res, err := http.Get(URL)
+// HTTPGetToFile will perform a http.Get on the specified url, then copying the data to the file fp/fn.  The request
+// is canceled if ctx is canceled; if the copy does not finish the returned status is 0.
+func HTTPGetToFile(ctx context.Context, URL string, fp *os.File, fn string) (status int) {
+	lg := Log(LogDownload)
+	req, err := http.NewRequestWithContext(ctx, "GET", URL, nil)
 	if err != nil {
-		log.Printf("Error: Unable to http.Get url %s", URL)
+		lg.ErrorContext(ctx, "unable to get", "url", URL, "error", err)
+		return
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		lg.ErrorContext(ctx, "unable to get", "url", URL, "error", err)
 		return
 	}
 	defer res.Body.Close()
 	if res.StatusCode == 200 {
 		_, err := io.Copy(fp, res.Body)
 		if err != nil {
-			log.Printf("Error: Unable to copy data to %s", fn)
+			lg.ErrorContext(ctx, "unable to copy the download to the file", "url", URL, "path", fn, "error", err)
 			return
 		}
 	} else {
-		log.Printf("Error: Failed to get %s, got status of %d", URL, res.StatusCode)
+		lg.ErrorContext(ctx, "unable to get", "url", URL, "status", res.StatusCode)
 	}
 	status = res.StatusCode
 	return
@@ -142,60 +242,209 @@ func RedisClient(RedisHost, RedisPort, RedisAuth string) (client *redis.Client,
 }
 
 // IsInRedisSet returns true if 'item' is in the Redis set 'key'.
-func IsInRedisSet(client *redis.Client, item, key string) bool {
+func IsInRedisSet(client util.Cmder, item, key string) (bool, error) {
 	// - use sets, SISMEMBER - to find if in set
 	n, err := client.Cmd("SISMEMBER", key, item).Int()
 	if err != nil {
-		log.Printf("Error: Redis SISMEMBER, %s, %s returned error %s\n", key, item, err)
-		return false
+		Log(LogRedis).Error("SISMEMBER failed", "key", key, "member", item, "error", err)
+		return false, err
 	}
 	if n == 1 {
-		return true
+		return true, nil
 	}
-	return false
+	return false, nil
 }
 
 // SetIfNotExists is a test and set operation with redis, true is returned if the key did NOT exists.
-func SetIfNotExists(client *redis.Client, item, key string) bool {
+func SetIfNotExists(client util.Cmder, item, key string) (bool, error) {
 	n, err := client.Cmd("SETNX", key, item).Int()
 	if err != nil {
-		log.Printf("Error: Redis SETNX, %s, %s returned error %s\n", key, item, err)
-		return false
+		Log(LogRedis).Error("SETNX failed", "key", key, "value", item, "error", err)
+		return false, err
 	}
-	// TODO: may want to use a TTL (time to live) for key so will automatically delete and clean up after X days
 	if n == 1 {
-		return true
+		return true, nil
 	}
-	return false
+	return false, nil
 }
 
 // AddToRedisSet will add the specified 'item' to the redis set 'key'.
-func AddToRedisSet(client *redis.Client, item, key string) {
-	err := client.Cmd("SADD", key, item).Err
+func AddToRedisSet(client util.Cmder, item, key string) (err error) {
+	err = client.Cmd("SADD", key, item).Err
 	if err != nil {
-		log.Printf("Error: Redis SADD, %s, %s returned error %s\n", key, item, err)
+		Log(LogRedis).Error("SADD failed", "key", key, "member", item, "error", err)
 	}
+	return
 }
 
-// RedisLoadFile will take the contents of the file 'fn' and LPUSH it onto the Redis list specified by listKey
-func RedisLoadFile(client *redis.Client, listKey string, fn string, gCfg *GlobalConfigType) {
+// RedisLoadFile will take the contents of the file 'fn' and LPUSH it onto the Redis list specified by listKey.  An
+// error opening or reading the file or pushing to Redis is returned.
+func RedisLoadFile(client util.Cmder, listKey string, fn string, gCfg *GlobalConfigType) (err error) {
 
-	data, err := ioutil.ReadFile(fn)
+	fp, err := Fopen(fn, "r")
 	if err != nil {
-		log.Printf("Error: Failed to read %s, error=%s", fn, err)
+		Log(LogLoad).Error("unable to read the document", "path", fn, "error", err)
 		return
 	}
+	defer fp.Close()
+
+	return RedisLoadReader(client, listKey, fn, fp, gCfg)
+}
+
+// RedisLoadReader will read all of 'rd' and LPUSH it onto the Redis list specified by listKey.  The 'name' is
+// only used for reporting errors.  This allows documents to be streamed directly out of an archive.  An error
+// reading 'rd' or pushing to Redis is returned.
+func RedisLoadReader(client util.Cmder, listKey string, name string, rd io.Reader, gCfg *GlobalConfigType) (err error) {
+
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		Log(LogLoad).Error("unable to read the document", "entry", name, "error", err)
+		return
+	}
+
+	return RedisLoadData(client, listKey, name, data, gCfg)
+}
+
+// RedisLoadData will LPUSH 'data' onto the Redis list specified by listKey.  The 'name' is only used for reporting errors.
+func RedisLoadData(client util.Cmder, listKey string, name string, data []byte, gCfg *GlobalConfigType) (err error) {
 
 	if IsDbOn("dbSkipPushOfContent", gCfg) { // this is for testing - leave temporary directory in place
-		fmt.Printf("Skipping Redis: LPUSH %s len(data=%d, fn=%s)\n", listKey, len(data), fn)
+		Log(LogLoad).Debug("debug flag dbSkipPushOfContent is on, not pushing", "key", listKey, "entry", name, "bytes", len(data))
 		return
 	}
 
 	// This is assuming that you want to LPUSH and RPOP for processing.  So this adds to the "left" side of the list.
 	err = client.Cmd("LPUSH", listKey, string(data)).Err
 	if err != nil {
-		log.Printf("Error: Redis LPUSH, %s, %s returned error %s\n", listKey, fn, err)
+		Log(LogRedis).Error("LPUSH failed", "key", listKey, "entry", name, "error", err)
+	}
+	return
+}
+
+// LoadDoc is one document for RedisLoadBatch.
+type LoadDoc struct {
+	Key  string // Key used to check if the document is already loaded
+	Name string // Name of the document
+	Data []byte
+}
+
+// RedisLoadBatch loads a batch of documents in a single round trip to Redis.  For each document the Key is
+// set, with a TTL of RetentionDays, and if it did not already exist the Data is LPUSHed onto listKey.  This is done atomically in a Lua
+// script so a document is never marked as loaded without being pushed.  The returned isNew has true for each
+// document that was pushed.  With DedupeBackend "bloom" the Name is checked against the Bloom filter instead and
+// the Key is not used, see bloom.go.
+func RedisLoadBatch(client util.Cmder, listKey string, docs []LoadDoc, gCfg *GlobalConfigType) (isNew []bool, err error) {
+	if len(docs) == 0 {
+		return
+	}
+	push := "1"
+	if skipPush(listKey, len(docs), gCfg) { // this is for testing - mark as loaded but do not push the data
+		push = "0"
+	}
+	if gCfg.DedupeBackend == DedupeBloom {
+		return bloomLoadBatch(client, listKey, docs, push == "1", gCfg)
+	}
+	args := make([]interface{}, 0, 3*len(docs)+2)
+	for _, d := range docs {
+		args = append(args, d.Key)
+	}
+	args = append(args, listKey, push, DedupeTTL(gCfg))
+	for _, d := range docs {
+		args = append(args, d.Name, d.Data)
+	}
+	pushed, err := util.LuaEval(client, loadBatchScript, len(docs)+1, args...).Array()
+	if err != nil {
+		Log(LogRedis).Error("load batch failed", "key", listKey, "documents", len(docs), "error", err)
+		return nil, err
+	}
+	isNew = make([]bool, len(docs))
+	for ii, p := range pushed {
+		if n, _ := p.Int(); n == 1 && ii < len(docs) {
+			isNew[ii] = true
+		}
+	}
+	return
+}
+
+// loadBatchScript - KEYS are the keys for N documents followed by the list to push onto.  ARGV[1] is "1" to
+// push, ARGV[2] is the TTL in seconds for the document keys (0 for none), followed by the name and data for each
+// document.
+const loadBatchScript = `
+local n = #KEYS - 1
+local list = KEYS[#KEYS]
+local ttl = tonumber(ARGV[2])
+local rv = {}
+for i = 1, n do
+	local ok
+	if ttl > 0 then
+		ok = redis.call('SET', KEYS[i], ARGV[2*i+1], 'NX', 'EX', ttl)
+	else
+		ok = redis.call('SET', KEYS[i], ARGV[2*i+1], 'NX')
+	end
+	rv[i] = 0
+	if ok then
+		rv[i] = 1
+		if ARGV[1] == '1' then
+			redis.call('LPUSH', list, ARGV[2*i+2])
+		end
+	end
+end
+return rv
+`
+
+// RedisCheckBatch returns true for each document that RedisLoadBatch would skip as already loaded, in a single
+// round trip and without changing anything.  This is for a dry run.
+func RedisCheckBatch(client util.Cmder, docs []LoadDoc, gCfg *GlobalConfigType) (loaded []bool, err error) {
+	if len(docs) == 0 {
+		return
+	}
+	if gCfg.DedupeBackend == DedupeBloom {
+		return bloomCheckBatch(client, docs, gCfg)
+	}
+	keys := make([]interface{}, 0, len(docs))
+	for _, d := range docs {
+		keys = append(keys, d.Key)
+	}
+	found, err := util.LuaEval(client, checkBatchScript, len(keys), keys...).Array()
+	if err != nil {
+		Log(LogRedis).Error("check batch failed", "documents", len(docs), "error", err)
+		return nil, err
+	}
+	loaded = make([]bool, len(docs))
+	for ii, f := range found {
+		if n, _ := f.Int(); n == 1 && ii < len(docs) {
+			loaded[ii] = true
+		}
+	}
+	return
+}
+
+// checkBatchScript returns an array with a 1 for each of KEYS that exists.
+const checkBatchScript = `
+local rv = {}
+for i = 1, #KEYS do
+	rv[i] = redis.call('EXISTS', KEYS[i])
+end
+return rv
+`
+
+// QuarantineArchive records that the archive 'fn' was rejected and why.  The archive name and reason are saved in the
+// hash RedisKeyQuarantine.  If QuarantineDir is set then the downloaded file 'fpfn' is moved into that directory
+// so it can be looked at, otherwise it is left to be cleaned up with the temporary directory.
+func QuarantineArchive(ctx context.Context, store StateStore, fn, fpfn, reason string, gCfg *GlobalConfigType) {
+	lg := Log(LogExtract)
+	err := store.SetField(NewKeyspace(gCfg).Quarantine(), fn, reason)
+	if err != nil {
+		lg.ErrorContext(ctx, "unable to record the quarantine", "archive", fn, "error", err)
+	}
+	if gCfg.QuarantineDir != "" {
+		os.MkdirAll(gCfg.QuarantineDir, 0700)
+		err = os.Rename(fpfn, gCfg.QuarantineDir+"/"+fn)
+		if err != nil {
+			lg.ErrorContext(ctx, "unable to move the archive to the quarantine directory", "archive", fn, "path", fpfn, "dir", gCfg.QuarantineDir, "error", err)
+		}
 	}
+	lg.WarnContext(ctx, "quarantined", "archive", fn, "reason", reason)
 }
 
 // InArray returns true when "lookFor" is found in "inArr".
@@ -1,11 +1,16 @@
 package naLib
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
+
+	"github.com/pschlump/radix.v2/util"
 )
 
 func Test_IsDbOn(t *testing.T) {
@@ -53,9 +58,9 @@ func Test_ReadConfigFile(t *testing.T) {
 }
 
 // Tests:
-// 	func RemoveDuplicateDownloadFiles(client *redis.Client, fList []string, gCfg *GlobalConfigType) (rv []string) {
-// 	func IsInRedisSet(client *redis.Client, item, key string) bool {
-// 	func AddToRedisSet(client *redis.Client, item, key string) {
+// 	func RemoveDuplicateDownloadFiles(store StateStore, fList []string, gCfg *GlobalConfigType) (rv []string, err error) {
+// 	func IsInRedisSet(client util.Cmder, item, key string) (bool, error) {
+// 	func AddToRedisSet(client util.Cmder, item, key string) (err error) {
 //	func RedisClient(RedisHost, RedisPort, RedisAuth string) (client *redis.Client, err error) {
 //
 // test depends on connecting to Redis and the ../cfg.json file
@@ -96,23 +101,32 @@ func Test_RemoveDuplicateDownloadFiles(t *testing.T) {
 	}
 
 	fList := []string{"a.zip", "b.zip", "c.zip"}
-	rv := RemoveDuplicateDownloadFiles(client, fList, &gCfg)
+	rv, err := RemoveDuplicateDownloadFiles(NewRedisStore(client, &gCfg), fList, &gCfg)
+	if err != nil {
+		t.Errorf("RemoveDuplicateDownloadFiles error - %s\n", err)
+	}
 	if len(rv) != 3 {
 		t.Errorf("RemoveDuplicateDownloadFiles error - expected 3, got %d\n", len(rv))
 	}
-	rv = RemoveDuplicateDownloadFiles(client, fList, &gCfg)
+	rv, err = RemoveDuplicateDownloadFiles(NewRedisStore(client, &gCfg), fList, &gCfg)
+	if err != nil {
+		t.Errorf("RemoveDuplicateDownloadFiles error - %s\n", err)
+	}
 	if len(rv) != 0 {
 		t.Errorf("RemoveDuplicateDownloadFiles error - expected 0, got %d\n", len(rv))
 	}
 	fList = []string{"a.zip", "b.zip", "c.zip", "d.zip"}
-	rv = RemoveDuplicateDownloadFiles(client, fList, &gCfg)
+	rv, err = RemoveDuplicateDownloadFiles(NewRedisStore(client, &gCfg), fList, &gCfg)
+	if err != nil {
+		t.Errorf("RemoveDuplicateDownloadFiles error - %s\n", err)
+	}
 	if len(rv) != 1 {
 		t.Errorf("RemoveDuplicateDownloadFiles error - expected 1, got %d\n", len(rv))
 	}
 
 }
 
-// func RedisLoadFile(client *redis.Client, listKey string, fn string, gCfg *GlobalConfigType) {
+// func RedisLoadFile(client util.Cmder, listKey string, fn string, gCfg *GlobalConfigType) (err error) {
 func Test_RedisLoadFile(t *testing.T) {
 	gCfg := GlobalConfigType{
 		RedisHost:                   "127.0.0.1",
@@ -147,7 +161,12 @@ func Test_RedisLoadFile(t *testing.T) {
 	key := "Test_RedisLoadFile:1"
 	client.Cmd("DEL", key)
 
-	RedisLoadFile(client, key, "./testdata/test01.txt", &gCfg)
+	if err = RedisLoadFile(client, key, "./testdata/test01.txt", &gCfg); err != nil {
+		t.Errorf("RedisLoadFile error- %s\n", err)
+	}
+	if err = RedisLoadFile(client, key, "./testdata/no-such-file.txt", &gCfg); err == nil {
+		t.Errorf("RedisLoadFile error- expected an error for a missing file\n")
+	}
 
 	s, err := client.Cmd("RPOP", key).Str()
 	if err != nil {
@@ -162,8 +181,8 @@ func Test_RedisLoadFile(t *testing.T) {
 }
 
 // Tests:
-// 		func DownloadZipFiles(fList []string, tmpDir string, gCfg *GlobalConfigType) (fullPathFn []string) {
-// 		func HTTPGetToFile(URL string, fp *os.File, fn string) (status int) {
+// 		func DownloadZipFiles(ctx context.Context, fList []string, tmpDir string, gCfg *GlobalConfigType) (fullPathFn []string) {
+// 		func HTTPGetToFile(ctx context.Context, URL string, fp *os.File, fn string) (status int) {
 func Test_DownloadZipFiles(t *testing.T) {
 	gCfg := GlobalConfigType{
 		RedisHost:                   "127.0.0.1",
@@ -194,7 +213,7 @@ func Test_DownloadZipFiles(t *testing.T) {
 
 	fList := []string{"test01.txt"}
 
-	fp := DownloadZipFiles(fList, "./tmp", &gCfg)
+	fp := DownloadZipFiles(context.Background(), fList, "./tmp", &gCfg)
 	if len(fp) != 1 {
 		t.Errorf("Test_DownloadZipFiles")
 	}
@@ -224,3 +243,106 @@ func Test_Fopen(t *testing.T) {
 	fp.Close()
 	os.RemoveAll("./testdata")
 }
+
+// func RedisLoadBatch(client util.Cmder, listKey string, docs []LoadDoc, gCfg *GlobalConfigType) (isNew []bool, err error) {
+//
+// test depends on connecting to Redis and the ../cfg.json file
+func Test_RedisLoadBatch(t *testing.T) {
+	gCfg := GlobalConfigType{
+		RedisHost: "127.0.0.1",
+		RedisPort: "6379",
+	}
+	ReadConfigFile("../cfg.json", &gCfg)
+	gCfg.DebugFlags = make(map[string]bool) // turn off all debug flags for this test
+
+	client, err := RedisClient(gCfg.RedisHost, gCfg.RedisPort, gCfg.RedisAuth)
+	if err != nil {
+		t.Errorf("RedisClient error- failed to connect- %s\n", err)
+		return
+	}
+
+	listKey := "Test_RedisLoadBatch:list"
+	docs := []LoadDoc{
+		{Key: "Test_RedisLoadBatch:a", Name: "a.xml", Data: []byte("A")},
+		{Key: "Test_RedisLoadBatch:b", Name: "b.xml", Data: []byte("B")},
+	}
+	client.Cmd("DEL", listKey, docs[0].Key, docs[1].Key)
+
+	isNew, err := RedisLoadBatch(client, listKey, docs[:1], &gCfg)
+	if err != nil || len(isNew) != 1 || !isNew[0] {
+		t.Errorf("RedisLoadBatch error- %v %s\n", isNew, err)
+	}
+	isNew, err = RedisLoadBatch(client, listKey, docs, &gCfg)
+	if err != nil || len(isNew) != 2 || isNew[0] || !isNew[1] {
+		t.Errorf("RedisLoadBatch error- expected [false true] got %v %s\n", isNew, err)
+	}
+	s, err := client.Cmd("LRANGE", listKey, 0, -1).List()
+	if err != nil || len(s) != 2 || s[0] != "B" || s[1] != "A" {
+		t.Errorf("RedisLoadBatch error- list is %s %s\n", s, err)
+	}
+
+	client.Cmd("DEL", listKey, docs[0].Key, docs[1].Key)
+}
+
+// benchmarkDocs returns n documents, the size of an archive with a few thousand entries in it.
+func benchmarkDocs(n int) (docs []LoadDoc) {
+	data := []byte(strings.Repeat("<post>some news</post>", 100))
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("%d.xml", i)
+		docs = append(docs, LoadDoc{Key: "Benchmark_Load:" + name, Name: name, Data: data})
+	}
+	return
+}
+
+// benchmarkLoad runs 'load' for an archive of 5000 documents and reports documents per second.
+func benchmarkLoad(b *testing.B, load func(client util.Cmder, docs []LoadDoc, gCfg *GlobalConfigType)) {
+	gCfg := GlobalConfigType{
+		RedisHost: "127.0.0.1",
+		RedisPort: "6379",
+	}
+	ReadConfigFile("../cfg.json", &gCfg)
+	gCfg.DebugFlags = make(map[string]bool) // turn off all debug flags for this test
+
+	client, err := RedisClient(gCfg.RedisHost, gCfg.RedisPort, gCfg.RedisAuth)
+	if err != nil {
+		b.Skipf("RedisClient error- failed to connect- %s\n", err)
+	}
+	docs := benchmarkDocs(5000)
+	cleanup := func() {
+		client.Cmd("DEL", "Benchmark_Load:list")
+		for _, d := range docs {
+			client.Cmd("DEL", d.Key)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		cleanup()
+		b.StartTimer()
+		load(client, docs, &gCfg)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N*len(docs))/b.Elapsed().Seconds(), "docs/s")
+	cleanup()
+}
+
+// Benchmark_LoadOneAtATime is the old way, a SETNX and an LPUSH round trip for each document.
+func Benchmark_LoadOneAtATime(b *testing.B) {
+	benchmarkLoad(b, func(client util.Cmder, docs []LoadDoc, gCfg *GlobalConfigType) {
+		for _, d := range docs {
+			if isNew, _ := SetIfNotExists(client, d.Name, d.Key); isNew {
+				RedisLoadData(client, "Benchmark_Load:list", d.Name, d.Data, gCfg)
+			}
+		}
+	})
+}
+
+// Benchmark_LoadBatch100 loads the documents with RedisLoadBatch in batches of 100.
+func Benchmark_LoadBatch100(b *testing.B) {
+	benchmarkLoad(b, func(client util.Cmder, docs []LoadDoc, gCfg *GlobalConfigType) {
+		for i := 0; i < len(docs); i += 100 {
+			RedisLoadBatch(client, "Benchmark_Load:list", docs[i:min(i+100, len(docs))], gCfg)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package naLib
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pschlump/radix.v2/util"
+)
+
+// PruneResult reports what Prune removed, or would have removed with a dry run.
+type PruneResult struct {
+	DownloadedRemoved int // Archive names removed from RedisKeySetOfFilesDownoaded
+	QuarantineRemoved int // Archive names removed from RedisKeyQuarantine
+	DocumentsExpired  int // Per-document keys that had no TTL and were given one
+	DryRun            bool
+}
+
+func (pr PruneResult) String() string {
+	dry := ""
+	if pr.DryRun {
+		dry = " (dry run)"
+	}
+	return fmt.Sprintf("removed %d downloaded files, removed %d quarantined files, set TTL on %d document keys%s",
+		pr.DownloadedRemoved, pr.QuarantineRemoved, pr.DocumentsExpired, dry)
+}
+
+// DedupeTTL returns the TTL in seconds for the per-document keys, 0 if they are kept forever.
+func DedupeTTL(gCfg *GlobalConfigType) int {
+	if gCfg.RetentionDays <= 0 {
+		return 0
+	}
+	return gCfg.RetentionDays * 24 * 60 * 60
+}
+
+// TimestampFromName returns the time from an archive name like 1471622300928.zip.  The provider names the archives
+// with a time stamp in milliseconds; a 10 digit name is taken as seconds.  false is returned if there is no time stamp.
+func TimestampFromName(fn string) (t time.Time, ok bool) {
+	n := 0
+	for n < len(fn) && fn[n] >= '0' && fn[n] <= '9' {
+		n++
+	}
+	ts, err := strconv.ParseInt(fn[:n], 10, 64)
+	if err != nil {
+		return
+	}
+	switch {
+	case n >= 13:
+		return time.Unix(0, ts*int64(time.Millisecond)), true
+	case n == 10:
+		return time.Unix(ts, 0), true
+	}
+	return
+}
+
+// Prune removes state older than maxAge from Redis.  Archive names are removed from the set of downloaded files
+// and the quarantine hash using the time stamp in the name.  Per-document keys written before there was a TTL are
+// given one.  With dryRun nothing is changed, the result is what would have been done.
+func Prune(client util.Cmder, maxAge time.Duration, dryRun bool, gCfg *GlobalConfigType) (pr PruneResult, err error) {
+	pr.DryRun = dryRun
+	cutoff := time.Now().Add(-maxAge)
+	isOld := func(fn string) bool {
+		t, ok := TimestampFromName(fn)
+		return ok && t.Before(cutoff)
+	}
+
+	ks := NewKeyspace(gCfg)
+	key := ks.Downloaded()
+	err = scan(client, "SSCAN", key, "*", func(members []string) error {
+		for _, fn := range members {
+			if isOld(fn) {
+				pr.DownloadedRemoved++
+				if !dryRun {
+					if e := client.Cmd("SREM", key, fn).Err; e != nil {
+						return e
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	key = ks.Quarantine()
+	err = scan(client, "HSCAN", key, "*", func(fields []string) error {
+		for ii := 0; ii+1 < len(fields); ii += 2 { // HSCAN returns field, value pairs
+			if isOld(fields[ii]) {
+				pr.QuarantineRemoved++
+				if !dryRun {
+					if e := client.Cmd("HDEL", key, fields[ii]).Err; e != nil {
+						return e
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	ttl := int(maxAge / time.Second)
+	err = scan(client, "SCAN", "", ks.DocumentPattern(), func(keys []string) error {
+		for _, k := range keys {
+			n, e := client.Cmd("TTL", k).Int()
+			if e != nil {
+				return e
+			}
+			if n == -1 { // key exists with no TTL
+				pr.DocumentsExpired++
+				if !dryRun {
+					if e := client.Cmd("EXPIRE", k, ttl).Err; e != nil {
+						return e
+					}
+				}
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// scan runs SCAN, SSCAN or HSCAN until the cursor comes back to 0, calling fn with each batch of results.
+// 'key' is not used for SCAN.
+func scan(client util.Cmder, cmd, key, pattern string, fn func([]string) error) error {
+	cursor := "0"
+	for {
+		var args []interface{}
+		if cmd != "SCAN" {
+			args = append(args, key)
+		}
+		args = append(args, cursor, "MATCH", pattern, "COUNT", 1000)
+		parts, err := client.Cmd(cmd, args...).Array()
+		if err != nil {
+			Log(LogRedis).Error(cmd+" failed", "key", key, "pattern", pattern, "error", err)
+			return err
+		}
+		if len(parts) != 2 {
+			return fmt.Errorf("Redis %s returned %d parts, expected 2", cmd, len(parts))
+		}
+		cursor, err = parts[0].Str()
+		if err != nil {
+			return err
+		}
+		items, err := parts[1].List()
+		if err != nil {
+			return err
+		}
+		if err = fn(items); err != nil {
+			return err
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
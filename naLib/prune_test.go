@@ -0,0 +1,86 @@
+package naLib
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// func TimestampFromName(fn string) (t time.Time, ok bool) {
+func Test_TimestampFromName(t *testing.T) {
+	tests := []struct {
+		fn string
+		ex int64 // unix seconds, 0 for not ok
+	}{
+		{fn: "1471622300928.zip", ex: 1471622300},
+		{fn: "1471622300928.tar.gz", ex: 1471622300},
+		{fn: "1471622300.zip", ex: 1471622300},
+		{fn: "news.zip", ex: 0},
+		{fn: "12345.zip", ex: 0},
+		{fn: "", ex: 0},
+	}
+	for ii, test := range tests {
+		ts, ok := TimestampFromName(test.fn)
+		if test.ex == 0 {
+			if ok {
+				t.Errorf("Test_TimestampFromName %d: %s expected no time stamp, got %s", ii, test.fn, ts)
+			}
+		} else if !ok || ts.Unix() != test.ex {
+			t.Errorf("Test_TimestampFromName %d: %s expected %d got %d", ii, test.fn, test.ex, ts.Unix())
+		}
+	}
+}
+
+// func Prune(client util.Cmder, maxAge time.Duration, dryRun bool, gCfg *GlobalConfigType) (pr PruneResult, err error) {
+//
+// test depends on connecting to Redis and the ../cfg.json file
+func Test_Prune(t *testing.T) {
+	gCfg := GlobalConfigType{
+		RedisHost: "127.0.0.1",
+		RedisPort: "6379",
+	}
+	ReadConfigFile("../cfg.json", &gCfg)
+	gCfg.RedisPrefix = "Test_Prune:"
+	gCfg.RedisKeySetOfFilesDownoaded = "downloaded-files"
+	gCfg.RedisKeyQuarantine = "quarantined-files"
+
+	client, err := RedisClient(gCfg.RedisHost, gCfg.RedisPort, gCfg.RedisAuth)
+	if err != nil {
+		t.Errorf("RedisClient error- failed to connect- %s\n", err)
+		return
+	}
+
+	old := fmt.Sprintf("%d.zip", time.Now().Add(-40*24*time.Hour).UnixNano()/int64(time.Millisecond))
+	recent := fmt.Sprintf("%d.zip", time.Now().UnixNano()/int64(time.Millisecond))
+	setKey := "Test_Prune:downloaded-files"
+	qKey := "Test_Prune:quarantined-files"
+	docKey := "Test_Prune:doc:a.xml"
+	client.Cmd("DEL", setKey, qKey, docKey)
+	client.Cmd("SADD", setKey, old, recent, "not-a-timestamp.zip")
+	client.Cmd("HSET", qKey, old, "MaxRatio")
+	client.Cmd("SET", docKey, "a.xml")
+
+	pr, err := Prune(client, 30*24*time.Hour, true, &gCfg)
+	if err != nil || pr.DownloadedRemoved != 1 || pr.QuarantineRemoved != 1 || pr.DocumentsExpired != 1 {
+		t.Errorf("Prune error- dry run got %s, %v\n", pr, err)
+	}
+	if n, _ := client.Cmd("SCARD", setKey).Int(); n != 3 {
+		t.Errorf("Prune error- dry run changed the set, %d members\n", n)
+	}
+
+	pr, err = Prune(client, 30*24*time.Hour, false, &gCfg)
+	if err != nil || pr.DownloadedRemoved != 1 || pr.QuarantineRemoved != 1 || pr.DocumentsExpired != 1 {
+		t.Errorf("Prune error- got %s, %v\n", pr, err)
+	}
+	if found, _ := IsInRedisSet(client, old, setKey); found {
+		t.Errorf("Prune error- old file not removed\n")
+	}
+	if found, _ := IsInRedisSet(client, recent, setKey); !found {
+		t.Errorf("Prune error- recent file removed\n")
+	}
+	if ttl, _ := client.Cmd("TTL", docKey).Int(); ttl <= 0 {
+		t.Errorf("Prune error- document key has no TTL, %d\n", ttl)
+	}
+
+	client.Cmd("DEL", setKey, qKey, docKey)
+}
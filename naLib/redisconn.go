@@ -0,0 +1,398 @@
+package naLib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pschlump/radix.v2/cluster"
+	"github.com/pschlump/radix.v2/pool"
+	"github.com/pschlump/radix.v2/redis"
+	"github.com/pschlump/radix.v2/sentinel"
+)
+
+var ErrClusterNeedsHashTag = errors.New("RedisHashTag must be set when using RedisClusterNodes")
+
+// RedisConn is a pool of connections to Redis that can be shared between goroutines.  Commands that fail because the
+// connection was lost are retried with a backoff, and a background health check PINGs Redis so that dead connections
+// are thrown away after Redis restarts.  Connection errors are returned from Cmd in the Resp like any other error.
+//
+// Redis can be a single server (RedisHost, RedisPort), a master found through Sentinel (RedisSentinelMaster and
+// RedisSentinelAddrs) or a Cluster (RedisClusterNodes).
+type RedisConn struct {
+	gCfg     *GlobalConfigType
+	be       redisBackend
+	password string      // From RedisPassword
+	tlsCfg   *tls.Config // nil if not using TLS
+	lock     sync.RWMutex
+	lastErr  error     // Error from the last health check, nil if Redis is reachable
+	lastOk   time.Time // Time of the last successful health check
+	done     chan bool
+	metrics  *Metrics
+}
+
+// redisBackend is the part of RedisConn that is different for a single server, Sentinel and Cluster.
+type redisBackend interface {
+	Cmd(cmd string, args ...interface{}) *redis.Resp
+	Reset() // Throw away idle connections so they are re-dialed
+	Close()
+}
+
+// NewRedisConn creates the pool of connections to Redis.  If Redis is not reachable, connecting is retried
+// RedisRetries times with a backoff before an error is returned.
+func NewRedisConn(gCfg *GlobalConfigType) (rc *RedisConn, err error) {
+	rc = &RedisConn{gCfg: gCfg, done: make(chan bool), metrics: NewMetrics(gCfg)}
+	rc.password, err = RedisPassword(gCfg)
+	if err != nil {
+		return nil, err
+	}
+	if gCfg.RedisTLS {
+		rc.tlsCfg, err = RedisTLSConfig(gCfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	size := max(gCfg.RedisPoolSize, 1)
+	switch {
+	case len(gCfg.RedisClusterNodes) > 0:
+		if gCfg.RedisHashTag == "" {
+			return nil, ErrClusterNeedsHashTag
+		}
+		err = rc.retry(func() (e error) {
+			rc.be, e = dialCluster(gCfg.RedisClusterNodes, size, time.Duration(gCfg.RedisTimeout)*time.Second, rc.dial)
+			return
+		})
+	case gCfg.RedisSentinelMaster != "":
+		err = rc.retry(func() (e error) {
+			rc.be, e = dialSentinel(gCfg.RedisSentinelMaster, gCfg.RedisSentinelAddrs, size, rc.dial)
+			return
+		})
+	default:
+		addr := gCfg.RedisHost + ":" + gCfg.RedisPort
+		err = rc.retry(func() (e error) {
+			p, e := pool.NewCustom("tcp", addr, size, rc.dial)
+			rc.be = poolBackend{p}
+			return
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc.lastOk = time.Now()
+	if gCfg.RedisHealthCheck > 0 {
+		go rc.healthCheck(time.Duration(gCfg.RedisHealthCheck) * time.Second)
+	}
+	return
+}
+
+// dial connects a single connection for the pool.  The RedisTimeout applies to every read and write on the connection.
+// If RedisTLS is set the connection uses TLS.  If there is a password then the connection is authenticated with AUTH,
+// using the Redis 6 ACL form "AUTH username password" if RedisUser is set.
+func (rc *RedisConn) dial(network, addr string) (client *redis.Client, err error) {
+	timeout := time.Duration(rc.gCfg.RedisTimeout) * time.Second
+	if rc.tlsCfg == nil {
+		client, err = redis.DialTimeout(network, addr, timeout)
+	} else {
+		var conn net.Conn
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, network, addr, rc.tlsCfg)
+		if err == nil {
+			client, err = redis.NewClient(&deadlineConn{Conn: conn, timeout: timeout})
+		}
+	}
+	if err != nil {
+		return
+	}
+	if rc.password != "" {
+		if rc.gCfg.RedisUser != "" {
+			err = client.Cmd("AUTH", rc.gCfg.RedisUser, rc.password).Err
+		} else {
+			err = client.Cmd("AUTH", rc.password).Err
+		}
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return
+}
+
+// deadlineConn sets a deadline before each read and write, the same as redis.DialTimeout does for plain TCP.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (dc *deadlineConn) Read(p []byte) (int, error) {
+	if dc.timeout > 0 {
+		dc.Conn.SetReadDeadline(time.Now().Add(dc.timeout))
+	}
+	return dc.Conn.Read(p)
+}
+
+func (dc *deadlineConn) Write(p []byte) (int, error) {
+	if dc.timeout > 0 {
+		dc.Conn.SetWriteDeadline(time.Now().Add(dc.timeout))
+	}
+	return dc.Conn.Write(p)
+}
+
+// RedisPassword returns the password for Redis.  So that the secret does not have to be in cfg.json it is taken from
+// the environment variable named by RedisAuthEnv, or the file named by RedisAuthFile, before falling back to RedisAuth.
+func RedisPassword(gCfg *GlobalConfigType) (string, error) {
+	return secret(gCfg.RedisAuth, gCfg.RedisAuthFile, gCfg.RedisAuthEnv)
+}
+
+// AdminAPIToken returns the token for the admin API from AdminTokenEnv, AdminTokenFile or AdminToken, in that
+// order.  "" means the admin API is off.
+func AdminAPIToken(gCfg *GlobalConfigType) (string, error) {
+	return secret(gCfg.AdminToken, gCfg.AdminTokenFile, gCfg.AdminTokenEnv)
+}
+
+// secret reads a secret from the environment variable 'env' if it is set, else the file 'fn', else 'value'.
+func secret(value, fn, env string) (string, error) {
+	if env != "" {
+		if s := os.Getenv(env); s != "" {
+			return s, nil
+		}
+	}
+	if fn != "" {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return value, nil
+}
+
+// RedisTLSConfig builds the TLS configuration for connecting to Redis.  RedisTLSCAFile is a PEM file of the CA
+// certificates to trust (the system CAs are used if it is not set), RedisTLSCertFile and RedisTLSKeyFile are a client
+// certificate and key, and RedisTLSServerName overrides the name checked in the server certificate.
+func RedisTLSConfig(gCfg *GlobalConfigType) (cfg *tls.Config, err error) {
+	cfg = &tls.Config{
+		ServerName:         gCfg.RedisTLSServerName,
+		InsecureSkipVerify: gCfg.RedisTLSInsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if gCfg.RedisTLSCAFile != "" {
+		data, e := ioutil.ReadFile(gCfg.RedisTLSCAFile)
+		if e != nil {
+			return nil, e
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("No certificates found in RedisTLSCAFile " + gCfg.RedisTLSCAFile)
+		}
+	}
+	if gCfg.RedisTLSCertFile != "" || gCfg.RedisTLSKeyFile != "" {
+		cert, e := tls.LoadX509KeyPair(gCfg.RedisTLSCertFile, gCfg.RedisTLSKeyFile)
+		if e != nil {
+			return nil, e
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+// Cmd runs a command on a connection from the pool.  If a connection can not be made the command is retried on a
+// new connection.  If the connection fails after the command was sent it may have run, so only the read only
+// commands in retryCmds are retried; the others, such as LPUSH or a script, would run twice.  Errors from Redis
+// itself, like WRONGTYPE, are not retried.
+func (rc *RedisConn) Cmd(cmd string, args ...interface{}) (resp *redis.Resp) {
+	rc.retry(func() error {
+		resp = rc.be.Cmd(cmd, args...)
+		if resp.Err != nil && !resp.IsType(redis.AppErr) && (isDialError(resp.Err) || retryCmds[strings.ToUpper(cmd)]) {
+			return resp.Err
+		}
+		return nil
+	})
+	return
+}
+
+// retryCmds are the commands that are safe to send again if the connection fails after they were sent.  They do
+// not change anything, so running one twice is the same as running it once.
+var retryCmds = map[string]bool{
+	"PING": true, "INFO": true, "TYPE": true, "EXISTS": true, "TTL": true, "PTTL": true, "SCAN": true,
+	"GET": true, "MGET": true, "GETBIT": true, "BITCOUNT": true,
+	"SISMEMBER": true, "SMEMBERS": true, "SCARD": true, "SSCAN": true,
+	"HGET": true, "HMGET": true, "HGETALL": true, "HEXISTS": true, "HLEN": true, "HSCAN": true,
+	"LLEN": true, "LRANGE": true, "LINDEX": true,
+}
+
+// isDialError is true if err is from connecting, so the command was never sent.
+func isDialError(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
+
+// retry calls fn until it succeeds, with a doubling backoff between tries, up to RedisRetries times.
+func (rc *RedisConn) retry(fn func() error) (err error) {
+	backoff := 100 * time.Millisecond
+	for try := 0; ; try++ {
+		err = fn()
+		if err == nil {
+			return
+		}
+		rc.metrics.RedisError()
+		if try >= rc.gCfg.RedisRetries {
+			return
+		}
+		Log(LogRedis).Warn("connection failed, retrying", "retry", try+1, "retries", rc.gCfg.RedisRetries, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-rc.done:
+			return
+		}
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// Ping checks that Redis is reachable.
+func (rc *RedisConn) Ping() (err error) {
+	err = rc.be.Cmd("PING").Err
+	rc.lock.Lock()
+	rc.lastErr = err
+	if err == nil {
+		rc.lastOk = time.Now()
+	}
+	rc.lock.Unlock()
+	return
+}
+
+// Status returns the result of the last health check and the time Redis was last reachable.
+func (rc *RedisConn) Status() (lastErr error, lastOk time.Time) {
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+	return rc.lastErr, rc.lastOk
+}
+
+// healthCheck PINGs Redis every 'interval'.  When the PING fails all of the idle connections are closed so that
+// they will be re-dialed - after a Redis restart every idle connection in the pool is dead.
+func (rc *RedisConn) healthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := rc.Ping(); err != nil {
+				rc.metrics.RedisError()
+				Log(LogRedis).Error("health check failed, reconnecting", "error", err)
+				rc.be.Reset()
+			}
+		case <-rc.done:
+			return
+		}
+	}
+}
+
+// Close stops the health check and closes all of the connections.
+func (rc *RedisConn) Close() {
+	close(rc.done)
+	rc.be.Close()
+}
+
+// HashTagKey puts the RedisHashTag in front of a key.  With Redis Cluster, keys with the same hash tag are stored in
+// the same slot, which is needed for the Lua scripts that use more than one key (the document keys and the list).
+func HashTagKey(key string, gCfg *GlobalConfigType) string {
+	if gCfg.RedisHashTag == "" {
+		return key
+	}
+	return "{" + gCfg.RedisHashTag + "}" + key
+}
+
+// poolBackend is a pool of connections to a single Redis server.
+type poolBackend struct {
+	p *pool.Pool
+}
+
+func (pb poolBackend) Cmd(cmd string, args ...interface{}) *redis.Resp { return pb.p.Cmd(cmd, args...) }
+func (pb poolBackend) Reset()                                          { pb.p.Empty() }
+func (pb poolBackend) Close()                                          { pb.p.Empty() }
+
+// sentinelBackend sends commands to the current master for 'name'.  The sentinel client follows fail-overs.
+type sentinelBackend struct {
+	c    *sentinel.Client
+	name string
+}
+
+// dialSentinel connects to the first of the sentinels in addrs that answers.
+func dialSentinel(name string, addrs []string, size int, df pool.DialFunc) (sb *sentinelBackend, err error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("RedisSentinelAddrs must be set when using RedisSentinelMaster")
+	}
+	for _, addr := range addrs {
+		var c *sentinel.Client
+		c, err = sentinel.NewClientCustom("tcp", addr, size, df, name)
+		if err == nil {
+			return &sentinelBackend{c: c, name: name}, nil
+		}
+		Log(LogRedis).Error("unable to connect to the sentinel", "addr", addr, "error", err)
+	}
+	return
+}
+
+func (sb *sentinelBackend) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	client, err := sb.c.GetMaster(sb.name)
+	if err != nil {
+		return &redis.Resp{Err: err}
+	}
+	defer sb.c.PutMaster(sb.name, client)
+	return client.Cmd(cmd, args...)
+}
+func (sb *sentinelBackend) Reset() {}
+func (sb *sentinelBackend) Close() { sb.c.Close() }
+
+// clusterBackend sends each command to the node that has the slot for its key.
+type clusterBackend struct {
+	c *cluster.Cluster
+}
+
+// dialCluster connects to the cluster using the first of the seed nodes that answers.
+func dialCluster(nodes []string, size int, timeout time.Duration, df pool.DialFunc) (cb *clusterBackend, err error) {
+	for _, addr := range nodes {
+		var c *cluster.Cluster
+		c, err = cluster.NewWithOpts(cluster.Opts{Addr: addr, PoolSize: size, Timeout: timeout, Dialer: cluster.DialFunc(df)})
+		if err == nil {
+			return &clusterBackend{c: c}, nil
+		}
+		Log(LogRedis).Error("unable to connect to the cluster node", "addr", addr, "error", err)
+	}
+	return
+}
+
+// Cmd routes on the first argument.  For EVAL and EVALSHA that is the script, so those are routed on the first key.
+// SCAN is routed on the MATCH pattern, which has the hash tag in it, so it runs on the node with our keys.
+func (cb *clusterBackend) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	key := ""
+	switch strings.ToUpper(cmd) {
+	case "EVAL", "EVALSHA":
+		if len(args) > 2 {
+			key, _ = args[2].(string)
+		}
+	case "SCAN":
+		for ii := 0; ii+1 < len(args); ii++ {
+			if s, ok := args[ii].(string); ok && strings.ToUpper(s) == "MATCH" {
+				key, _ = args[ii+1].(string)
+			}
+		}
+	}
+	if key == "" {
+		return cb.c.Cmd(cmd, args...)
+	}
+	client, err := cb.c.GetForKey(key)
+	if err != nil {
+		return &redis.Resp{Err: err}
+	}
+	defer cb.c.Put(client)
+	return client.Cmd(cmd, args...)
+}
+func (cb *clusterBackend) Reset() {}
+func (cb *clusterBackend) Close() { cb.c.Close() }
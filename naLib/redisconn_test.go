@@ -0,0 +1,203 @@
+package naLib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pschlump/radix.v2/redis"
+)
+
+// Tests:
+//
+//	func NewRedisConn(gCfg *GlobalConfigType) (rc *RedisConn, err error) {
+//	func (rc *RedisConn) Cmd(cmd string, args ...interface{}) (resp *redis.Resp) {
+//	func (rc *RedisConn) Ping() (err error) {
+//
+// test depends on connecting to Redis and the ../cfg.json file
+func Test_NewRedisConn(t *testing.T) {
+	gCfg := GlobalConfigType{
+		RedisHost:     "127.0.0.1",
+		RedisPort:     "6379",
+		RedisPoolSize: 4,
+		RedisTimeout:  5,
+		RedisRetries:  1,
+	}
+	ReadConfigFile("../cfg.json", &gCfg)
+
+	rc, err := NewRedisConn(&gCfg)
+	if err != nil {
+		t.Errorf("NewRedisConn error- failed to connect- %s\n", err)
+		return
+	}
+	defer rc.Close()
+
+	if err := rc.Ping(); err != nil {
+		t.Errorf("Ping error- %s\n", err)
+	}
+	if lastErr, lastOk := rc.Status(); lastErr != nil || lastOk.IsZero() {
+		t.Errorf("Status error- %s %s\n", lastErr, lastOk)
+	}
+
+	// The pool can be used from many goroutines at once.
+	key := "Test_NewRedisConn:1"
+	rc.Cmd("DEL", key)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := rc.Cmd("SADD", key, fmt.Sprintf("%d", i)).Err; err != nil {
+				t.Errorf("Cmd error- %s\n", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	n, err := rc.Cmd("SCARD", key).Int()
+	if err != nil || n != 20 {
+		t.Errorf("Cmd error- expected 20 got %d, %s\n", n, err)
+	}
+
+	found, err := IsInRedisSet(rc, "7", key)
+	if err != nil || !found {
+		t.Errorf("IsInRedisSet error- %v\n", err)
+	}
+
+	rc.Cmd("DEL", key)
+}
+
+// func HashTagKey(key string, gCfg *GlobalConfigType) string {
+func Test_HashTagKey(t *testing.T) {
+	gCfg := GlobalConfigType{}
+	if s := HashTagKey("na:downloaded-files", &gCfg); s != "na:downloaded-files" {
+		t.Errorf("HashTagKey error- got %s\n", s)
+	}
+	gCfg.RedisHashTag = "news"
+	if s := HashTagKey("na:downloaded-files", &gCfg); s != "{news}na:downloaded-files" {
+		t.Errorf("HashTagKey error- got %s\n", s)
+	}
+}
+
+func Test_NewRedisConnCluster(t *testing.T) {
+	gCfg := GlobalConfigType{RedisClusterNodes: []string{"127.0.0.1:7000"}}
+	if _, err := NewRedisConn(&gCfg); err != ErrClusterNeedsHashTag {
+		t.Errorf("NewRedisConn error- expected ErrClusterNeedsHashTag got %v\n", err)
+	}
+}
+
+// func RedisPassword(gCfg *GlobalConfigType) (string, error) {
+func Test_RedisPassword(t *testing.T) {
+	os.Mkdir("./testdata", 0700)
+	ioutil.WriteFile("./testdata/redis-pw", []byte("from-file\n"), 0600)
+
+	gCfg := GlobalConfigType{RedisAuth: "from-cfg"}
+	if pw, err := RedisPassword(&gCfg); err != nil || pw != "from-cfg" {
+		t.Errorf("RedisPassword error- expected from-cfg got %s %v\n", pw, err)
+	}
+	gCfg.RedisAuthFile = "./testdata/redis-pw"
+	if pw, err := RedisPassword(&gCfg); err != nil || pw != "from-file" {
+		t.Errorf("RedisPassword error- expected from-file got %s %v\n", pw, err)
+	}
+	gCfg.RedisAuthEnv = "TEST_REDIS_PASSWORD"
+	os.Setenv("TEST_REDIS_PASSWORD", "from-env")
+	if pw, err := RedisPassword(&gCfg); err != nil || pw != "from-env" {
+		t.Errorf("RedisPassword error- expected from-env got %s %v\n", pw, err)
+	}
+	os.Unsetenv("TEST_REDIS_PASSWORD")
+	gCfg.RedisAuthFile = "./testdata/missing"
+	if _, err := RedisPassword(&gCfg); err == nil {
+		t.Errorf("RedisPassword error- expected an error for a missing file\n")
+	}
+
+	os.RemoveAll("./testdata")
+}
+
+// func RedisTLSConfig(gCfg *GlobalConfigType) (cfg *tls.Config, err error) {
+func Test_RedisTLSConfig(t *testing.T) {
+	os.Mkdir("./testdata", 0700)
+
+	// Self signed certificate to use as both the CA and the client certificate.
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis.test"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate error- %s\n", err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile("./testdata/ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile("./testdata/key.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	gCfg := GlobalConfigType{
+		RedisTLS:           true,
+		RedisTLSCAFile:     "./testdata/ca.pem",
+		RedisTLSCertFile:   "./testdata/ca.pem",
+		RedisTLSKeyFile:    "./testdata/key.pem",
+		RedisTLSServerName: "redis.test",
+	}
+	cfg, err := RedisTLSConfig(&gCfg)
+	if err != nil {
+		t.Errorf("RedisTLSConfig error- %s\n", err)
+	} else if cfg.RootCAs == nil || len(cfg.Certificates) != 1 || cfg.ServerName != "redis.test" {
+		t.Errorf("RedisTLSConfig error- %+v\n", cfg)
+	}
+
+	gCfg.RedisTLSCAFile = "./testdata/key.pem"
+	if _, err := RedisTLSConfig(&gCfg); err == nil {
+		t.Errorf("RedisTLSConfig error- expected an error for a CA file with no certificates\n")
+	}
+
+	os.RemoveAll("./testdata")
+}
+
+// countingBackend fails every command with err and counts them.
+type countingBackend struct {
+	err   error
+	calls int
+}
+
+func (cb *countingBackend) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	cb.calls++
+	return &redis.Resp{Err: cb.err}
+}
+func (cb *countingBackend) Reset() {}
+func (cb *countingBackend) Close() {}
+
+// func (rc *RedisConn) Cmd(cmd string, args ...interface{}) (resp *redis.Resp) {
+func Test_RedisConnRetry(t *testing.T) {
+	gCfg := GlobalConfigType{RedisRetries: 2}
+	lost := &countingBackend{err: io.EOF} // the connection failed after the command was sent
+	rc := &RedisConn{gCfg: &gCfg, be: lost, done: make(chan bool), metrics: NewMetrics(&gCfg)}
+	if rc.Cmd("LPUSH", "list", "doc").Err == nil || lost.calls != 1 {
+		t.Errorf("Cmd error- expected LPUSH to be sent once got %d\n", lost.calls)
+	}
+	lost.calls = 0
+	if rc.Cmd("get", "key").Err == nil || lost.calls != 3 {
+		t.Errorf("Cmd error- expected GET to be tried 3 times got %d\n", lost.calls)
+	}
+
+	dial := &countingBackend{err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	rc.be = dial
+	if rc.Cmd("LPUSH", "list", "doc").Err == nil || dial.calls != 3 {
+		t.Errorf("Cmd error- expected LPUSH to be tried 3 times when it could not connect got %d\n", dial.calls)
+	}
+}
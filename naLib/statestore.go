@@ -0,0 +1,389 @@
+package naLib
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pschlump/radix.v2/redis"
+	"github.com/pschlump/radix.v2/util"
+)
+
+// State backends, StateBackend in the configuration.
+const (
+	StateRedis  = "redis"  // All state in Redis (the default), needed when more than one aggregator runs
+	StateBolt   = "bolt"   // The aggregator's own state in an embedded bbolt database in StateFile
+	StateMemory = "memory" // The aggregator's own state in memory, lost when the program exits - for tests and one off runs
+)
+
+// StateStore is where the aggregator keeps its state: which archives have been downloaded, which documents have
+// been loaded, the quarantine and the run history.  The names passed in are the keys from Keyspace.  The list of
+// documents for the consumers, RedisKeyNewsXML, is always in Redis, since that is where the consumers read it; the
+// bolt and memory stores pass the list methods for it on to Redis, see outputList.  Every method is atomic, so more
+// than one goroutine (or, with Redis, more than one process) can share a store.
+type StateStore interface {
+	// AddNew adds each of 'members' to the set and returns true for each one that was not already in it.
+	AddNew(set string, members []string) (added []bool, err error)
+	// Remove removes each of 'members' from the set.
+	Remove(set string, members []string) error
+	// IsMember returns true if 'member' is in the set.
+	IsMember(set, member string) (bool, error)
+	// Members calls fn with each member of the set, in no particular order, until fn returns an error.
+	Members(set string, fn func(member string) error) error
+	// SetField sets field to value in the hash.
+	SetField(hash, field, value string) error
+	// GetField returns the value of field in the hash, ok is false if it is not there.
+	GetField(hash, field string) (value string, ok bool, err error)
+	// RemoveFields removes each of 'fields' from the hash.
+	RemoveFields(hash string, fields []string) error
+	// Fields calls fn with each field and value in the hash, in no particular order, until fn returns an error.
+	Fields(hash string, fn func(field, value string) error) error
+	// Count returns the number of members in a set or fields in a hash, 0 if it does not exist.
+	Count(name string) (int, error)
+	// SetIfNotExists sets key to value only if it does not exist (or has expired), and returns true if it was set.
+	// A ttl of 0 never expires.
+	SetIfNotExists(key, value string, ttl time.Duration) (bool, error)
+	// AcquireLease takes the lease 'name' for 'owner' for ttl.  It returns true if the lease was free, had expired or
+	// was already held by owner (in which case it is extended).
+	AcquireLease(name, owner string, ttl time.Duration) (bool, error)
+	// ReleaseLease gives up the lease if it is held by owner.
+	ReleaseLease(name, owner string) error
+	// Incr adds n to the counter and returns the new value; Incr(name, 0) reads it.
+	Incr(counter string, n int64) (int64, error)
+	// Push checks each document's Key and pushes the Data of the ones not already loaded onto the list, see
+	// RedisLoadBatch.  The returned isNew has true for each document that was pushed.
+	Push(list string, docs []LoadDoc) (isNew []bool, err error)
+	// Loaded returns true for each document that Push would skip as already loaded, without changing anything.
+	// This is for a dry run.
+	Loaded(docs []LoadDoc) (loaded []bool, err error)
+	// Enqueue pushes data onto the list without checking if it has already been loaded, see the "replay" command.
+	Enqueue(list string, data [][]byte) error
+	// Pop removes and returns the oldest document on the list.  ok is false if the list is empty.
+	Pop(list string) (data []byte, ok bool, err error)
+	// Len returns the length of the list.
+	Len(list string) (int, error)
+	// Recent returns up to n of the newest entries on the list, newest first, without removing them.
+	Recent(list string, n int) ([][]byte, error)
+	// Trim removes the oldest documents from the list until it has no more than max, and returns how many were removed.
+	Trim(list string, max int) (dropped int, err error)
+	// Expire deletes the keys whose TTL has passed and returns how many were deleted.  Expired keys are never
+	// returned, this only frees the space.  Redis does it by itself, so for Redis it does nothing.
+	Expire() (removed int, err error)
+	// Close releases the store.
+	Close() error
+}
+
+// NewStateStore opens the StateStore for StateBackend.  Every backend connects to Redis, for the output list.
+func NewStateStore(gCfg *GlobalConfigType) (StateStore, error) {
+	switch gCfg.StateBackend {
+	case "", StateRedis, StateBolt, StateMemory:
+	default:
+		return nil, fmt.Errorf("Invalid StateBackend %q, should be %s, %s or %s", gCfg.StateBackend, StateRedis, StateBolt, StateMemory)
+	}
+	rc, err := NewRedisConn(gCfg)
+	if err != nil {
+		return nil, err
+	}
+	switch gCfg.StateBackend {
+	case StateBolt:
+		bs, err := NewBoltStore(gCfg.StateFile, rc, gCfg)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		return bs, nil
+	case StateMemory:
+		return NewMemoryStore(rc, gCfg), nil
+	}
+	return NewRedisStore(rc, gCfg), nil
+}
+
+// outputList sends the list methods for the output list, RedisKeyNewsXML, from the bolt and memory stores on to
+// Redis, so that the consumers can read the documents.  Other lists, the run history, stay in the store.  Without a
+// Redis client, in tests, the output list is kept in the store too.
+type outputList struct {
+	key string      // RedisKeyNewsXML from the Keyspace
+	rs  *RedisStore // nil to keep the output list in the store
+}
+
+func newOutputList(out util.Cmder, gCfg *GlobalConfigType) outputList {
+	ol := outputList{key: NewKeyspace(gCfg).NewsXML()}
+	if out != nil {
+		ol.rs = NewRedisStore(out, gCfg)
+	}
+	return ol
+}
+
+// redis returns the RedisStore to use for 'list', or nil if the list is in the store.
+func (ol outputList) redis(list string) *RedisStore {
+	if ol.rs != nil && list == ol.key {
+		return ol.rs
+	}
+	return nil
+}
+
+func (ol outputList) Close() error {
+	if ol.rs != nil {
+		return ol.rs.Close()
+	}
+	return nil
+}
+
+// skipPush is true if the dbSkipPushOfContent debug flag is on: documents are marked as loaded but not pushed.
+func skipPush(list string, n int, gCfg *GlobalConfigType) bool {
+	if IsDbOn("dbSkipPushOfContent", gCfg) {
+		Log(LogLoad).Debug("debug flag dbSkipPushOfContent is on, not pushing", "key", list, "documents", n)
+		return true
+	}
+	return false
+}
+
+// RedisStore is the StateStore for Redis.
+type RedisStore struct {
+	client util.Cmder
+	gCfg   *GlobalConfigType
+}
+
+// NewRedisStore returns a StateStore that uses 'client'.  Closing the store closes the client if it has a Close method.
+func NewRedisStore(client util.Cmder, gCfg *GlobalConfigType) *RedisStore {
+	return &RedisStore{client: client, gCfg: gCfg}
+}
+
+// Client returns the Redis client, for the commands that only work with Redis.
+func (rs *RedisStore) Client() util.Cmder { return rs.client }
+
+func (rs *RedisStore) AddNew(set string, members []string) (added []bool, err error) {
+	if len(members) == 0 {
+		return
+	}
+	args := make([]interface{}, 0, len(members)+1)
+	args = append(args, set)
+	for _, m := range members {
+		args = append(args, m)
+	}
+	rv, err := util.LuaEval(rs.client, addNewMembersScript, 1, args...).Array()
+	if err != nil {
+		Log(LogRedis).Error("SADD failed", "key", set, "members", members, "error", err)
+		return nil, err
+	}
+	added = make([]bool, len(members))
+	for ii, a := range rv {
+		if n, _ := a.Int(); n == 1 && ii < len(members) {
+			added[ii] = true
+		}
+	}
+	return
+}
+
+func (rs *RedisStore) Remove(set string, members []string) (err error) {
+	if len(members) == 0 {
+		return
+	}
+	args := make([]interface{}, 0, len(members)+1)
+	args = append(args, set)
+	for _, m := range members {
+		args = append(args, m)
+	}
+	err = rs.client.Cmd("SREM", args...).Err
+	if err != nil {
+		Log(LogRedis).Error("SREM failed", "key", set, "members", members, "error", err)
+	}
+	return
+}
+
+func (rs *RedisStore) IsMember(set, member string) (bool, error) {
+	return IsInRedisSet(rs.client, member, set)
+}
+
+func (rs *RedisStore) Members(set string, fn func(member string) error) error {
+	return scan(rs.client, "SSCAN", set, "*", func(members []string) error {
+		for _, m := range members {
+			if e := fn(m); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+func (rs *RedisStore) SetField(hash, field, value string) (err error) {
+	err = rs.client.Cmd("HSET", hash, field, value).Err
+	if err != nil {
+		Log(LogRedis).Error("HSET failed", "key", hash, "field", field, "error", err)
+	}
+	return
+}
+
+func (rs *RedisStore) GetField(hash, field string) (value string, ok bool, err error) {
+	r := rs.client.Cmd("HGET", hash, field)
+	if r.Err != nil || r.IsType(redis.Nil) {
+		return "", false, r.Err
+	}
+	value, err = r.Str()
+	return value, err == nil, err
+}
+
+func (rs *RedisStore) RemoveFields(hash string, fields []string) (err error) {
+	if len(fields) == 0 {
+		return
+	}
+	args := make([]interface{}, 0, len(fields)+1)
+	args = append(args, hash)
+	for _, f := range fields {
+		args = append(args, f)
+	}
+	err = rs.client.Cmd("HDEL", args...).Err
+	if err != nil {
+		Log(LogRedis).Error("HDEL failed", "key", hash, "fields", fields, "error", err)
+	}
+	return
+}
+
+func (rs *RedisStore) Fields(hash string, fn func(field, value string) error) error {
+	return scan(rs.client, "HSCAN", hash, "*", func(fields []string) error {
+		for ii := 0; ii+1 < len(fields); ii += 2 { // HSCAN returns field, value pairs
+			if e := fn(fields[ii], fields[ii+1]); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+func (rs *RedisStore) Count(name string) (int, error) {
+	return util.LuaEval(rs.client, countScript, 1, name).Int()
+}
+
+// countScript returns the size of the set or hash KEYS[1].
+const countScript = `
+local t = redis.call('TYPE', KEYS[1]).ok
+if t == 'set' then
+	return redis.call('SCARD', KEYS[1])
+elseif t == 'hash' then
+	return redis.call('HLEN', KEYS[1])
+end
+return 0
+`
+
+func (rs *RedisStore) SetIfNotExists(key, value string, ttl time.Duration) (bool, error) {
+	args := []interface{}{key, value, "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", int64(ttl/time.Millisecond))
+	}
+	r := rs.client.Cmd("SET", args...)
+	if r.Err != nil {
+		Log(LogRedis).Error("SET NX failed", "key", key, "error", r.Err)
+		return false, r.Err
+	}
+	return !r.IsType(redis.Nil), nil
+}
+
+func (rs *RedisStore) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+	n, err := util.LuaEval(rs.client, acquireLeaseScript, 1, name, owner, int64(ttl/time.Millisecond)).Int()
+	if err != nil {
+		Log(LogRedis).Error("lease failed", "key", name, "error", err)
+	}
+	return n == 1, err
+}
+
+// acquireLeaseScript sets KEYS[1] to the owner ARGV[1] for ARGV[2] milliseconds if it is free or already held by ARGV[1].
+const acquireLeaseScript = `
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 1
+end
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`
+
+func (rs *RedisStore) ReleaseLease(name, owner string) (err error) {
+	err = util.LuaEval(rs.client, releaseLeaseScript, 1, name, owner).Err
+	if err != nil {
+		Log(LogRedis).Error("lease release failed", "key", name, "error", err)
+	}
+	return
+}
+
+// releaseLeaseScript deletes KEYS[1] if it is held by ARGV[1].
+const releaseLeaseScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+
+func (rs *RedisStore) Incr(counter string, n int64) (int64, error) {
+	return rs.client.Cmd("INCRBY", counter, n).Int64()
+}
+
+func (rs *RedisStore) Push(list string, docs []LoadDoc) (isNew []bool, err error) {
+	return RedisLoadBatch(rs.client, list, docs, rs.gCfg)
+}
+
+func (rs *RedisStore) Loaded(docs []LoadDoc) (loaded []bool, err error) {
+	return RedisCheckBatch(rs.client, docs, rs.gCfg)
+}
+
+func (rs *RedisStore) Enqueue(list string, data [][]byte) (err error) {
+	if len(data) == 0 {
+		return
+	}
+	args := make([]interface{}, 0, len(data)+1)
+	args = append(args, list)
+	for _, d := range data {
+		args = append(args, d)
+	}
+	err = rs.client.Cmd("LPUSH", args...).Err
+	if err != nil {
+		Log(LogRedis).Error("LPUSH failed", "key", list, "documents", len(data), "error", err)
+	}
+	return
+}
+
+func (rs *RedisStore) Pop(list string) (data []byte, ok bool, err error) {
+	r := rs.client.Cmd("RPOP", list)
+	if r.Err != nil || r.IsType(redis.Nil) {
+		return nil, false, r.Err
+	}
+	data, err = r.Bytes()
+	return data, err == nil, err
+}
+
+func (rs *RedisStore) Len(list string) (int, error) {
+	return rs.client.Cmd("LLEN", list).Int()
+}
+
+func (rs *RedisStore) Recent(list string, n int) ([][]byte, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	return rs.client.Cmd("LRANGE", list, 0, n-1).ListBytes() // LPUSH puts the newest on the left
+}
+
+func (rs *RedisStore) Expire() (int, error) { return 0, nil }
+
+func (rs *RedisStore) Trim(list string, max int) (dropped int, err error) {
+	dropped, err = util.LuaEval(rs.client, trimScript, 1, list, max).Int()
+	if err != nil {
+		Log(LogRedis).Error("LTRIM failed", "key", list, "error", err)
+	}
+	return
+}
+
+// trimScript trims the list KEYS[1] to ARGV[1] entries, keeping the newest, and returns the number removed.
+const trimScript = `
+local n = redis.call('LLEN', KEYS[1]) - tonumber(ARGV[1])
+if n > 0 then
+	redis.call('LTRIM', KEYS[1], 0, tonumber(ARGV[1]) - 1)
+	return n
+end
+return 0
+`
+
+func (rs *RedisStore) Close() error {
+	if c, ok := rs.client.(interface{ Close() }); ok {
+		c.Close()
+	}
+	return nil
+}
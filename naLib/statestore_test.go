@@ -0,0 +1,307 @@
+package naLib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pschlump/radix.v2/util"
+)
+
+// testStateStore runs the same checks against each of the StateStore implementations.
+func testStateStore(t *testing.T, name string, store StateStore) {
+	set, hash, list := name+":set", name+":hash", name+":list"
+
+	added, err := store.AddNew(set, []string{"a.zip", "b.zip"})
+	if err != nil || len(added) != 2 || !added[0] || !added[1] {
+		t.Errorf("%s AddNew error- got %v, %v\n", name, added, err)
+	}
+	added, err = store.AddNew(set, []string{"b.zip", "c.zip"})
+	if err != nil || len(added) != 2 || added[0] || !added[1] {
+		t.Errorf("%s AddNew error- expected [false true] got %v, %v\n", name, added, err)
+	}
+	if found, _ := store.IsMember(set, "a.zip"); !found {
+		t.Errorf("%s IsMember error- a.zip not found\n", name)
+	}
+	if found, _ := store.IsMember(set, "d.zip"); found {
+		t.Errorf("%s IsMember error- d.zip found\n", name)
+	}
+
+	var members []string
+	store.Members(set, func(m string) error { members = append(members, m); return nil })
+	sort.Strings(members)
+	if strings.Join(members, ",") != "a.zip,b.zip,c.zip" {
+		t.Errorf("%s Members error- got %s\n", name, members)
+	}
+
+	if err = store.SetField(hash, "x.zip", "MaxRatio"); err != nil {
+		t.Errorf("%s SetField error- %s\n", name, err)
+	}
+	fields := make(map[string]string)
+	store.Fields(hash, func(f, v string) error { fields[f] = v; return nil })
+	if len(fields) != 1 || fields["x.zip"] != "MaxRatio" {
+		t.Errorf("%s Fields error- got %v\n", name, fields)
+	}
+	if v, ok, err := store.GetField(hash, "x.zip"); err != nil || !ok || v != "MaxRatio" {
+		t.Errorf("%s GetField error- got %q %v %v\n", name, v, ok, err)
+	}
+	if _, ok, _ := store.GetField(hash, "y.zip"); ok {
+		t.Errorf("%s GetField error- found y.zip\n", name)
+	}
+	if n, _ := store.Count(set); n != 3 {
+		t.Errorf("%s Count error- expected 3 in the set, got %d\n", name, n)
+	}
+	if n, _ := store.Count(hash); n != 1 {
+		t.Errorf("%s Count error- expected 1 in the hash, got %d\n", name, n)
+	}
+	if n, _ := store.Count(name + ":none"); n != 0 {
+		t.Errorf("%s Count error- expected 0, got %d\n", name, n)
+	}
+	if err = store.Remove(set, []string{"a.zip", "d.zip"}); err != nil {
+		t.Errorf("%s Remove error- %s\n", name, err)
+	}
+	if found, _ := store.IsMember(set, "a.zip"); found {
+		t.Errorf("%s Remove error- a.zip still found\n", name)
+	}
+	if n, _ := store.Count(set); n != 2 {
+		t.Errorf("%s Remove error- expected 2 left in the set, got %d\n", name, n)
+	}
+	store.Remove(name+":none", []string{"a.zip"})
+	store.SetField(hash, "y.zip", "MaxEntries")
+	if err = store.RemoveFields(hash, []string{"x.zip", "z.zip"}); err != nil {
+		t.Errorf("%s RemoveFields error- %s\n", name, err)
+	}
+	if _, ok, _ := store.GetField(hash, "x.zip"); ok {
+		t.Errorf("%s RemoveFields error- x.zip still found\n", name)
+	}
+	if n, _ := store.Count(hash); n != 1 {
+		t.Errorf("%s RemoveFields error- expected 1 left in the hash, got %d\n", name, n)
+	}
+	store.RemoveFields(name+":none", []string{"x.zip"})
+
+	if ok, _ := store.SetIfNotExists(name+":key", "1", 0); !ok {
+		t.Errorf("%s SetIfNotExists error- first set failed\n", name)
+	}
+	if ok, _ := store.SetIfNotExists(name+":key", "2", 0); ok {
+		t.Errorf("%s SetIfNotExists error- second set should fail\n", name)
+	}
+	if ok, _ := store.SetIfNotExists(name+":ttl", "1", 50*time.Millisecond); !ok {
+		t.Errorf("%s SetIfNotExists error- set with ttl failed\n", name)
+	}
+
+	if ok, _ := store.AcquireLease(name+":lease", "owner-1", time.Minute); !ok {
+		t.Errorf("%s AcquireLease error- owner-1 should get the lease\n", name)
+	}
+	if ok, _ := store.AcquireLease(name+":lease", "owner-2", time.Minute); ok {
+		t.Errorf("%s AcquireLease error- owner-2 should not get the lease\n", name)
+	}
+	if ok, _ := store.AcquireLease(name+":lease", "owner-1", time.Minute); !ok {
+		t.Errorf("%s AcquireLease error- owner-1 should be able to renew\n", name)
+	}
+	store.ReleaseLease(name+":lease", "owner-2") // not the owner, does nothing
+	if ok, _ := store.AcquireLease(name+":lease", "owner-2", time.Minute); ok {
+		t.Errorf("%s ReleaseLease error- released by the wrong owner\n", name)
+	}
+	store.ReleaseLease(name+":lease", "owner-1")
+	if ok, _ := store.AcquireLease(name+":lease", "owner-2", time.Minute); !ok {
+		t.Errorf("%s AcquireLease error- owner-2 should get the released lease\n", name)
+	}
+
+	if n, _ := store.Incr(name+":counter", 5); n != 5 {
+		t.Errorf("%s Incr error- expected 5 got %d\n", name, n)
+	}
+	if n, _ := store.Incr(name+":counter", 0); n != 5 {
+		t.Errorf("%s Incr error- expected 5 got %d\n", name, n)
+	}
+
+	docs := []LoadDoc{
+		{Key: name + ":doc:a", Name: "a.xml", Data: []byte("A")},
+		{Key: name + ":doc:b", Name: "b.xml", Data: []byte("B")},
+		{Key: name + ":doc:a", Name: "a.xml", Data: []byte("A")},
+	}
+	isNew, err := store.Push(list, docs)
+	if err != nil || len(isNew) != 3 || !isNew[0] || !isNew[1] || isNew[2] {
+		t.Errorf("%s Push error- expected [true true false] got %v, %v\n", name, isNew, err)
+	}
+	if loaded, err := store.Loaded([]LoadDoc{docs[1], {Key: name + ":doc:c", Name: "c.xml"}}); err != nil || len(loaded) != 2 || !loaded[0] || loaded[1] {
+		t.Errorf("%s Loaded error- expected [true false] got %v, %v\n", name, loaded, err)
+	}
+	store.Push(list, []LoadDoc{{Key: name + ":doc:c", Name: "c.xml", Data: []byte("C")}})
+	if n, _ := store.Len(list); n != 3 {
+		t.Errorf("%s Len error- expected 3 got %d\n", name, n)
+	}
+	if recent, err := store.Recent(list, 2); err != nil || len(recent) != 2 || string(recent[0]) != "C" || string(recent[1]) != "B" {
+		t.Errorf("%s Recent error- expected [C B] got %q %v\n", name, recent, err)
+	}
+	if n, _ := store.Trim(list, 2); n != 1 {
+		t.Errorf("%s Trim error- expected 1 dropped got %d\n", name, n)
+	}
+	data, ok, err := store.Pop(list)
+	if err != nil || !ok || string(data) != "B" {
+		t.Errorf("%s Pop error- expected B (A was trimmed) got %s %v %v\n", name, data, ok, err)
+	}
+	store.Pop(list)
+	store.Enqueue(list, [][]byte{[]byte("A")}) // already loaded, but Enqueue does not check
+	if data, _, _ = store.Pop(list); string(data) != "A" {
+		t.Errorf("%s Enqueue error- expected A got %s\n", name, data)
+	}
+	if _, ok, _ = store.Pop(list); ok {
+		t.Errorf("%s Pop error- expected an empty list\n", name)
+	}
+}
+
+// testExpire checks that Expire deletes the keys whose TTL has passed and leaves the rest, for the stores that do not
+// expire keys themselves.
+func testExpire(t *testing.T, name string, store StateStore) {
+	store.SetIfNotExists(name+":short", "1", time.Millisecond)
+	store.SetIfNotExists(name+":long", "1", time.Hour)
+	store.SetIfNotExists(name+":forever", "1", 0)
+	time.Sleep(5 * time.Millisecond)
+
+	if n, err := store.Expire(); err != nil || n != 1 {
+		t.Errorf("%s Expire error- expected 1 got %d, %v\n", name, n, err)
+	}
+	if n, err := store.Expire(); err != nil || n != 0 {
+		t.Errorf("%s Expire error- expected 0 the second time got %d, %v\n", name, n, err)
+	}
+	for _, k := range []string{":long", ":forever"} {
+		if isNew, _ := store.SetIfNotExists(name+k, "2", 0); isNew {
+			t.Errorf("%s Expire error- %s was deleted\n", name, k)
+		}
+	}
+	if isNew, _ := store.SetIfNotExists(name+":short", "2", 0); !isNew {
+		t.Errorf("%s Expire error- :short is still set\n", name)
+	}
+}
+
+// func NewMemoryStore(out util.Cmder, gCfg *GlobalConfigType) *MemoryStore {
+func Test_MemoryStore(t *testing.T) {
+	store := NewMemoryStore(nil, &GlobalConfigType{})
+	testStateStore(t, "Test_MemoryStore", store)
+	testExpire(t, "Test_MemoryStore", store)
+	store.Close()
+}
+
+// func NewBoltStore(fn string, out util.Cmder, gCfg *GlobalConfigType) (bs *BoltStore, err error) {
+func Test_BoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "Test_BoltStore")
+	if err != nil {
+		t.Fatalf("TempDir error- %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state.db")
+
+	store, err := NewBoltStore(fn, nil, &GlobalConfigType{})
+	if err != nil {
+		t.Fatalf("NewBoltStore error- %s", err)
+	}
+	testStateStore(t, "Test_BoltStore", store)
+	testExpire(t, "Test_BoltStore", store)
+	store.Close()
+
+	// the state is still there after the database is opened again
+	store, err = NewBoltStore(fn, nil, &GlobalConfigType{})
+	if err != nil {
+		t.Fatalf("NewBoltStore error- reopen %s", err)
+	}
+	if found, _ := store.IsMember("Test_BoltStore:set", "b.zip"); !found {
+		t.Errorf("BoltStore error- b.zip not found after reopen\n")
+	}
+	store.Close()
+}
+
+// func NewRedisStore(client util.Cmder, gCfg *GlobalConfigType) *RedisStore {
+//
+// test depends on connecting to Redis and the ../cfg.json file
+func Test_RedisStore(t *testing.T) {
+	gCfg := GlobalConfigType{
+		RedisHost: "127.0.0.1",
+		RedisPort: "6379",
+	}
+	ReadConfigFile("../cfg.json", &gCfg)
+
+	client, err := RedisClient(gCfg.RedisHost, gCfg.RedisPort, gCfg.RedisAuth)
+	if err != nil {
+		t.Errorf("RedisClient error- failed to connect- %s\n", err)
+		return
+	}
+	name := "Test_RedisStore"
+	del := []interface{}{name + ":set", name + ":hash", name + ":key", name + ":ttl", name + ":lease", name + ":counter",
+		name + ":list", name + ":doc:a", name + ":doc:b", name + ":doc:c"}
+	client.Cmd("DEL", del...)
+	testStateStore(t, name, NewRedisStore(client, &gCfg))
+	client.Cmd("DEL", del...)
+	client.Close()
+}
+
+// testOutput checks that a store with a Redis client pushes the output list to Redis and keeps the other lists.
+func testOutput(t *testing.T, name string, store StateStore, client util.Cmder, gCfg *GlobalConfigType) {
+	ks := NewKeyspace(gCfg)
+	docs := []LoadDoc{
+		{Key: ks.Document("a.xml"), Name: "a.xml", Data: []byte("A")},
+		{Key: ks.Document("b.xml"), Name: "b.xml", Data: []byte("B")},
+	}
+	if isNew, err := store.Push(ks.NewsXML(), docs); err != nil || len(isNew) != 2 || !isNew[0] || !isNew[1] {
+		t.Errorf("%s Push error- expected [true true] got %v, %v\n", name, isNew, err)
+	}
+	if n, _ := client.Cmd("LLEN", ks.NewsXML()).Int(); n != 2 {
+		t.Errorf("%s Push error- expected 2 documents in Redis got %d\n", name, n)
+	}
+	if n, _ := store.Len(ks.NewsXML()); n != 2 {
+		t.Errorf("%s Len error- expected 2 got %d\n", name, n)
+	}
+	if data, ok, _ := store.Pop(ks.NewsXML()); !ok || string(data) != "A" {
+		t.Errorf("%s Pop error- expected A from Redis got %s\n", name, data)
+	}
+
+	store.Enqueue(ks.RunHistory(), [][]byte{[]byte("run")})
+	if n, _ := client.Cmd("EXISTS", ks.RunHistory()).Int(); n != 0 {
+		t.Errorf("%s Enqueue error- the run history should not be in Redis\n", name)
+	}
+	if n, _ := store.Len(ks.RunHistory()); n != 1 {
+		t.Errorf("%s Enqueue error- expected the run history in the store got %d\n", name, n)
+	}
+
+	gCfg.DebugFlags = map[string]bool{"dbSkipPushOfContent": true}
+	if isNew, err := store.Push(ks.NewsXML(), []LoadDoc{{Key: ks.Document("c.xml"), Name: "c.xml", Data: []byte("C")}}); err != nil || !isNew[0] {
+		t.Errorf("%s Push error- expected c.xml marked as loaded got %v, %v\n", name, isNew, err)
+	}
+	gCfg.DebugFlags = nil
+	if n, _ := client.Cmd("LLEN", ks.NewsXML()).Int(); n != 1 {
+		t.Errorf("%s Push error- dbSkipPushOfContent expected 1 document in Redis got %d\n", name, n)
+	}
+}
+
+// test depends on connecting to Redis and the ../cfg.json file
+func Test_StateStoreOutput(t *testing.T) {
+	gCfg := GlobalConfigType{
+		RedisHost: "127.0.0.1",
+		RedisPort: "6379",
+	}
+	ReadConfigFile("../cfg.json", &gCfg)
+	gCfg.RedisPrefix, gCfg.RedisHashTag, gCfg.RedisKeyNewsXML, gCfg.DebugFlags = "Test_StateStoreOutput", "", "NEWS_XML", nil
+
+	client, err := RedisClient(gCfg.RedisHost, gCfg.RedisPort, gCfg.RedisAuth)
+	if err != nil {
+		t.Errorf("RedisClient error- failed to connect- %s\n", err)
+		return
+	}
+	defer client.Close()
+	ks := NewKeyspace(&gCfg)
+	client.Cmd("DEL", ks.NewsXML(), ks.RunHistory())
+	defer client.Cmd("DEL", ks.NewsXML(), ks.RunHistory())
+
+	testOutput(t, "Test_StateStoreOutput memory", NewMemoryStore(client, &gCfg), client, &gCfg)
+	client.Cmd("DEL", ks.NewsXML())
+
+	bs, err := NewBoltStore(filepath.Join(t.TempDir(), "state.db"), client, &gCfg)
+	if err != nil {
+		t.Fatalf("NewBoltStore error- %s", err)
+	}
+	defer bs.db.Close()
+	testOutput(t, "Test_StateStoreOutput bolt", bs, client, &gCfg)
+}
@@ -0,0 +1,277 @@
+package pipeline
+
+//
+// A staged pipeline for processing archives.  Each stage runs in its own set of goroutines and the stages are
+// connected with bounded channels, so archive N+1 can be downloading while the documents from archive N are
+// still being loaded.  The stages are:
+//
+//	download -> extract -> load
+//
+// Canceling the context stops all of the stages.  Work that is already in a stage is allowed to finish the
+// function it is in, but nothing new is started.  Closing Config.Stop is the gentler version: no new archives
+// are started, and the ones that have been are finished.  Archives that were not finished are listed in
+// Stats.Unfinished so they can be resumed, and archives that had a download, extract or load fail are listed in
+// Stats.Failed so they can be tried again.
+//
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Archive is a downloaded archive waiting to be extracted.
+type Archive struct {
+	Name string // Name of the archive in the directory listing
+	Path string // Where it was downloaded to
+}
+
+// Document is one document read out of an archive, waiting to be loaded.
+type Document struct {
+	Archive string // Name of the archive the document came from
+	Name    string // Name of the document in the archive
+	Data    []byte
+}
+
+// Config sets the number of goroutines for each stage and the size of the buffers between stages.
+// Values less than 1 are treated as 1 for the workers and 0 for the buffers.
+type Config struct {
+	DownloadWorkers int
+	ExtractWorkers  int
+	LoadWorkers     int
+	ArchiveBuffer   int             // Downloaded archives waiting to be extracted
+	DocumentBuffer  int             // Documents waiting to be loaded
+	LoadBatch       int             // Maximum number of documents passed to each call of the LoadFunc
+	Stop            <-chan struct{} // If closed, no more archives are sent to the download stage
+}
+
+// DownloadFunc downloads the archive 'name'.
+type DownloadFunc func(ctx context.Context, name string) (Archive, error)
+
+// ExtractFunc reads the documents out of an archive and calls emit for each one.  If emit returns an
+// error, the context has been canceled, and the ExtractFunc should return.
+type ExtractFunc func(ctx context.Context, a Archive, emit func(Document) error) error
+
+// LoadFunc loads a batch of documents, up to Config.LoadBatch of them.  If an error is returned the entire
+// batch is counted as failed.
+type LoadFunc func(ctx context.Context, docs []Document) error
+
+// Stats are the counts from a single Run.
+type Stats struct {
+	Archives       int64 // Archives sent to the download stage
+	Downloaded     int64
+	DownloadFailed int64
+	Extracted      int64
+	ExtractFailed  int64
+	Documents      int64 // Documents sent to the load stage
+	Loaded         int64
+	LoadFailed     int64
+	Canceled       bool
+	Unfinished     []string // Archives that were not sent, or were canceled part way through, in the order given
+	Failed         []string // Finished archives where a download, extract or load failed, in the order given
+}
+
+// Run passes each of the archive names through the download, extract and load stages and waits for
+// all of them to finish, or for ctx to be canceled.  Errors from the stages are counted in the returned
+// Stats - the stage functions are expected to report their own errors.
+func Run(ctx context.Context, cfg Config, names []string, download DownloadFunc, extract ExtractFunc, load LoadFunc) (st Stats) {
+	nameCh := make(chan string)
+	archiveCh := make(chan Archive, max(cfg.ArchiveBuffer, 0))
+	docCh := make(chan Document, max(cfg.DocumentBuffer, 0))
+
+	pr := &progress{pending: make(map[string]int), extracted: make(map[string]bool), done: make(map[string]bool), failed: make(map[string]bool)}
+
+	go func() {
+		defer close(nameCh)
+		for _, name := range names {
+			select {
+			case nameCh <- name:
+				atomic.AddInt64(&st.Archives, 1)
+			case <-ctx.Done():
+				return
+			case <-cfg.Stop:
+				return
+			}
+		}
+	}()
+
+	stage(cfg.DownloadWorkers, func() { close(archiveCh) }, func() {
+		for name := range nameCh {
+			select {
+			case <-cfg.Stop: // the name may have been sent at the same time Stop was closed
+				continue
+			default:
+			}
+			a, err := download(ctx, name)
+			if err != nil {
+				atomic.AddInt64(&st.DownloadFailed, 1)
+				if ctx.Err() == nil {
+					pr.fail(name)
+					pr.finish(name)
+				}
+				continue
+			}
+			atomic.AddInt64(&st.Downloaded, 1)
+			select {
+			case archiveCh <- a:
+			case <-ctx.Done():
+			}
+		}
+	})
+
+	emit := func(d Document) error {
+		select {
+		case docCh <- d:
+			atomic.AddInt64(&st.Documents, 1)
+			pr.sent(d.Archive)
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	stage(cfg.ExtractWorkers, func() { close(docCh) }, func() {
+		for a := range archiveCh {
+			if ctx.Err() != nil {
+				continue
+			}
+			err := extract(ctx, a, emit)
+			if err != nil && ctx.Err() == nil {
+				pr.fail(a.Name)
+			}
+			if err == nil || ctx.Err() == nil {
+				pr.extractDone(a.Name)
+			}
+			if err != nil {
+				atomic.AddInt64(&st.ExtractFailed, 1)
+				continue
+			}
+			atomic.AddInt64(&st.Extracted, 1)
+		}
+	})
+
+	var done sync.WaitGroup
+	done.Add(1)
+	stage(cfg.LoadWorkers, done.Done, func() {
+		for batch := range batches(docCh, max(cfg.LoadBatch, 1)) {
+			if ctx.Err() != nil {
+				continue
+			}
+			err := load(ctx, batch)
+			if err != nil && ctx.Err() == nil {
+				for _, d := range batch {
+					pr.fail(d.Archive)
+				}
+			}
+			if err == nil || ctx.Err() == nil {
+				pr.loaded(batch)
+			}
+			if err != nil {
+				atomic.AddInt64(&st.LoadFailed, int64(len(batch)))
+				continue
+			}
+			atomic.AddInt64(&st.Loaded, int64(len(batch)))
+		}
+	})
+	done.Wait()
+
+	st.Canceled = ctx.Err() != nil
+	for _, name := range names {
+		if !pr.done[name] {
+			st.Unfinished = append(st.Unfinished, name)
+		} else if pr.failed[name] {
+			st.Failed = append(st.Failed, name)
+		}
+	}
+	return
+}
+
+// progress keeps track of which archives have been finished.  An archive is finished when the download failed, or
+// when extracting it has returned and every document it sent has been loaded (or failed to load).  Work stopped by
+// canceling the context does not count.  An archive is failed if any stage failed for it.
+type progress struct {
+	lock      sync.Mutex
+	pending   map[string]int // Documents sent to the load stage and not loaded yet, by archive
+	extracted map[string]bool
+	done      map[string]bool
+	failed    map[string]bool
+}
+
+func (pr *progress) fail(name string) {
+	pr.lock.Lock()
+	pr.failed[name] = true
+	pr.lock.Unlock()
+}
+
+func (pr *progress) finish(name string) {
+	pr.lock.Lock()
+	pr.done[name] = true
+	pr.lock.Unlock()
+}
+
+func (pr *progress) sent(name string) {
+	pr.lock.Lock()
+	pr.pending[name]++
+	pr.lock.Unlock()
+}
+
+func (pr *progress) extractDone(name string) {
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	pr.extracted[name] = true
+	if pr.pending[name] == 0 {
+		pr.done[name] = true
+	}
+}
+
+func (pr *progress) loaded(batch []Document) {
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	for _, d := range batch {
+		pr.pending[d.Archive]--
+		if pr.pending[d.Archive] == 0 && pr.extracted[d.Archive] {
+			pr.done[d.Archive] = true
+		}
+	}
+}
+
+// batches groups the documents from docCh into batches of up to n documents.  A batch is sent on as soon as no more
+// documents are waiting, so a slow extract stage does not hold documents back waiting for a full batch.
+func batches(docCh <-chan Document, n int) <-chan []Document {
+	out := make(chan []Document)
+	go func() {
+		defer close(out)
+		for d := range docCh {
+			batch := []Document{d}
+		fill:
+			for len(batch) < n {
+				select {
+				case d, ok := <-docCh:
+					if !ok {
+						break fill
+					}
+					batch = append(batch, d)
+				default:
+					break fill
+				}
+			}
+			out <- batch
+		}
+	}()
+	return out
+}
+
+// stage starts n goroutines running work and calls finish once all of them have returned.
+func stage(n int, finish func(), work func()) {
+	var wg sync.WaitGroup
+	for i := 0; i < max(n, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		finish()
+	}()
+}
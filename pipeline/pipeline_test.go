@@ -0,0 +1,221 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// func Run(ctx context.Context, cfg Config, names []string, download DownloadFunc, extract ExtractFunc, load LoadFunc) (st Stats) {
+func Test_Run(t *testing.T) {
+	var mu sync.Mutex
+	var loaded []string
+
+	download := func(ctx context.Context, name string) (Archive, error) {
+		if name == "bad.zip" {
+			return Archive{}, errors.New("404")
+		}
+		return Archive{Name: name, Path: "/tmp/" + name}, nil
+	}
+	extract := func(ctx context.Context, a Archive, emit func(Document) error) error {
+		for i := 0; i < 3; i++ {
+			if err := emit(Document{Archive: a.Name, Name: fmt.Sprintf("%d.xml", i), Data: []byte(a.Path)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	load := func(ctx context.Context, docs []Document) error {
+		d := docs[0]
+		if d.Name == "2.xml" && d.Archive == "c.zip" {
+			return errors.New("load failed")
+		}
+		mu.Lock()
+		loaded = append(loaded, d.Archive+"/"+d.Name)
+		mu.Unlock()
+		return nil
+	}
+
+	cfg := Config{DownloadWorkers: 2, ExtractWorkers: 2, LoadWorkers: 3, ArchiveBuffer: 1, DocumentBuffer: 2}
+	st := Run(context.Background(), cfg, []string{"a.zip", "bad.zip", "b.zip", "c.zip"}, download, extract, load)
+
+	if st.Archives != 4 || st.Downloaded != 3 || st.DownloadFailed != 1 || st.Extracted != 3 {
+		t.Errorf("Test_Run: unexpected archive stats %+v", st)
+	}
+	if st.Documents != 9 || st.Loaded != 8 || st.LoadFailed != 1 || st.Canceled || len(st.Unfinished) != 0 {
+		t.Errorf("Test_Run: unexpected document stats %+v", st)
+	}
+	if len(st.Failed) != 2 || st.Failed[0] != "bad.zip" || st.Failed[1] != "c.zip" {
+		t.Errorf("Test_Run: expected bad.zip and c.zip failed, got %s", st.Failed)
+	}
+	sort.Strings(loaded)
+	if len(loaded) != 8 || loaded[0] != "a.zip/0.xml" || loaded[7] != "c.zip/1.xml" {
+		t.Errorf("Test_Run: loaded %s", loaded)
+	}
+}
+
+// A batch that fails to load fails every archive that has a document in it, and the archives are still finished.
+func Test_RunLoadFailed(t *testing.T) {
+	download := func(ctx context.Context, name string) (Archive, error) {
+		return Archive{Name: name}, nil
+	}
+	extract := func(ctx context.Context, a Archive, emit func(Document) error) error {
+		return emit(Document{Archive: a.Name})
+	}
+	load := func(ctx context.Context, docs []Document) error {
+		for _, d := range docs {
+			if d.Archive == "b.zip" {
+				return errors.New("connection reset")
+			}
+		}
+		return nil
+	}
+
+	cfg := Config{LoadBatch: 1}
+	st := Run(context.Background(), cfg, []string{"a.zip", "b.zip", "c.zip"}, download, extract, load)
+	if st.LoadFailed != 1 || st.Loaded != 2 || len(st.Unfinished) != 0 {
+		t.Errorf("Test_RunLoadFailed: unexpected stats %+v", st)
+	}
+	if len(st.Failed) != 1 || st.Failed[0] != "b.zip" {
+		t.Errorf("Test_RunLoadFailed: expected b.zip failed, got %s", st.Failed)
+	}
+}
+
+// The download of the 2nd archive has to happen while the 1st archive is still being loaded.
+func Test_RunOverlap(t *testing.T) {
+	downloaded2 := make(chan bool)
+
+	download := func(ctx context.Context, name string) (Archive, error) {
+		if name == "2.zip" {
+			close(downloaded2)
+		}
+		return Archive{Name: name}, nil
+	}
+	extract := func(ctx context.Context, a Archive, emit func(Document) error) error {
+		return emit(Document{Archive: a.Name})
+	}
+	load := func(ctx context.Context, docs []Document) error {
+		if docs[0].Archive == "1.zip" {
+			select {
+			case <-downloaded2:
+			case <-time.After(5 * time.Second):
+				return errors.New("2.zip was not downloaded while 1.zip was loading")
+			}
+		}
+		return nil
+	}
+
+	st := Run(context.Background(), Config{}, []string{"1.zip", "2.zip"}, download, extract, load)
+	if st.Loaded != 2 {
+		t.Errorf("Test_RunOverlap: %+v", st)
+	}
+}
+
+func Test_RunBatch(t *testing.T) {
+	download := func(ctx context.Context, name string) (Archive, error) {
+		return Archive{Name: name}, nil
+	}
+	extract := func(ctx context.Context, a Archive, emit func(Document) error) error {
+		for i := 0; i < 1000; i++ {
+			if err := emit(Document{Archive: a.Name}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var mu sync.Mutex
+	largest := 0
+	load := func(ctx context.Context, docs []Document) error {
+		mu.Lock()
+		if len(docs) > largest {
+			largest = len(docs)
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond) // let documents back up so the batches fill
+		return nil
+	}
+
+	cfg := Config{LoadWorkers: 2, DocumentBuffer: 100, LoadBatch: 50}
+	st := Run(context.Background(), cfg, []string{"a.zip", "b.zip"}, download, extract, load)
+	if st.Loaded != 2000 || st.Documents != 2000 {
+		t.Errorf("Test_RunBatch: %+v", st)
+	}
+	if largest < 2 || largest > 50 {
+		t.Errorf("Test_RunBatch: largest batch %d", largest)
+	}
+}
+
+func Test_RunCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var names []string
+	for i := 0; i < 100; i++ {
+		names = append(names, fmt.Sprintf("%d.zip", i))
+	}
+	download := func(ctx context.Context, name string) (Archive, error) {
+		return Archive{Name: name}, nil
+	}
+	extract := func(ctx context.Context, a Archive, emit func(Document) error) error {
+		for {
+			if err := emit(Document{Archive: a.Name}); err != nil {
+				return err
+			}
+		}
+	}
+	n := 0
+	load := func(ctx context.Context, docs []Document) error {
+		n++
+		if n == 10 {
+			cancel()
+		}
+		return nil
+	}
+
+	finished := make(chan Stats)
+	go func() {
+		finished <- Run(ctx, Config{}, names, download, extract, load)
+	}()
+	select {
+	case st := <-finished:
+		if !st.Canceled || st.Archives == 100 || len(st.Unfinished) != 100 {
+			t.Errorf("Test_RunCancel: %+v", st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Test_RunCancel: pipeline did not stop")
+	}
+}
+
+// After Stop is closed the archive that is being worked on is finished, and the rest are not started.
+func Test_RunStop(t *testing.T) {
+	stop := make(chan struct{})
+	download := func(ctx context.Context, name string) (Archive, error) {
+		if name == "a.zip" {
+			close(stop)
+		}
+		return Archive{Name: name}, nil
+	}
+	extract := func(ctx context.Context, a Archive, emit func(Document) error) error {
+		for i := 0; i < 3; i++ {
+			if err := emit(Document{Archive: a.Name, Name: fmt.Sprintf("%d.xml", i)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	load := func(ctx context.Context, docs []Document) error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+
+	st := Run(context.Background(), Config{Stop: stop}, []string{"a.zip", "b.zip", "c.zip"}, download, extract, load)
+	if st.Downloaded != 1 || st.Loaded != 3 || st.Canceled {
+		t.Errorf("Test_RunStop: unexpected stats %+v", st)
+	}
+	if len(st.Unfinished) != 2 || st.Unfinished[0] != "b.zip" || st.Unfinished[1] != "c.zip" {
+		t.Errorf("Test_RunStop: expected b.zip and c.zip unfinished, got %s", st.Unfinished)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pschlump/news-aggregator/index"
+	"github.com/pschlump/news-aggregator/naLib"
+	"github.com/pschlump/news-aggregator/unzip"
+)
+
+// A dry run, once -dry-run or rerun -dry-run, reports what a run would do without changing the state store: no
+// archives are marked as downloaded, nothing is pushed or quarantined, and there is no run lease or run history
+// record.  With -download the archives are also downloaded into a scratch directory and read to count the
+// documents that would be loaded.  Unlike dbSkipPushOfContent, a dry run can be repeated and gives the same plan.
+
+// Plan is what a run would do.
+type Plan struct {
+	Source   string
+	Found    int           // Archives in the directory listing
+	New      []string      // Archives that have not been downloaded
+	Resumed  []string      // Archives interrupted by the last shutdown that would be processed again
+	Archives []ArchivePlan // Each archive that would be processed, in order
+}
+
+// ArchivePlan is what a run would do with one archive.  The document counts are only set with -download.
+type ArchivePlan struct {
+	Archive     string
+	Quarantined string `json:",omitempty"` // Why it was rejected before, it is still downloaded if it is new
+	Documents   int    // Documents in the archive
+	NewDocs     int    // Documents that have not been loaded
+	Error       string `json:",omitempty"` // Why the archive could not be downloaded or read
+}
+
+// PlanRun works out which archives RunMainProcess would process with opts, and with 'download' which of their
+// documents it would load.  Nothing in the store is changed.
+func PlanRun(ctx context.Context, store naLib.StateStore, opts RunOptions, download bool) (p Plan, err error) {
+	ks := naLib.NewKeyspace(&gCfg)
+	p.Source = naLib.MetricsSource(&gCfg)
+	ctx = naLib.WithLogAttrs(ctx, "source", p.Source, "dry_run", true)
+	lg := naLib.Log(naLib.LogRun)
+
+	data, err := index.GetDirectory(ctx, gCfg.LoadUrl)
+	if err != nil {
+		naLib.Log(naLib.LogDownload).ErrorContext(ctx, "unable to get the directory listing", "url", gCfg.LoadUrl, "error", err)
+		return
+	}
+	fList, err := index.ParseDirectory(data)
+	if err != nil {
+		naLib.Log(naLib.LogDownload).ErrorContext(ctx, "unable to parse the directory listing", "url", gCfg.LoadUrl, "error", err)
+		return
+	}
+	p.Found = len(fList)
+
+	if len(opts.Archives) > 0 {
+		for _, fn := range opts.Archives {
+			if !naLib.InArray(fn, fList) {
+				return p, fmt.Errorf("%s is not in the directory listing at %s", fn, gCfg.LoadUrl)
+			}
+		}
+		fList = opts.Archives
+	}
+	p.New = []string{}
+	for _, fn := range fList {
+		found, err := store.IsMember(ks.Downloaded(), fn)
+		if err != nil {
+			return p, err
+		}
+		if !found {
+			p.New = append(p.New, fn)
+		}
+	}
+	if !opts.Force {
+		fList = p.New
+	}
+	if len(opts.Archives) == 0 {
+		err = store.Members(ks.Interrupted(), func(fn string) error {
+			if !naLib.InArray(fn, fList) {
+				p.Resumed = append(p.Resumed, fn)
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		fList = append(p.Resumed, fList...)
+	}
+	if naLib.IsDbOn("dbOnly1File", &gCfg) && len(fList) > 1 {
+		fList = fList[0:1]
+	}
+
+	p.Archives = make([]ArchivePlan, 0, len(fList))
+	for _, fn := range fList {
+		ap := ArchivePlan{Archive: fn}
+		if ap.Quarantined, _, err = store.GetField(ks.Quarantine(), fn); err != nil {
+			return
+		}
+		p.Archives = append(p.Archives, ap)
+	}
+	if !download || len(fList) == 0 {
+		return
+	}
+
+	dir, err := TempDir(ctx)
+	if err != nil {
+		return
+	}
+	if !naLib.IsDbOn("dbLeaveTmpDir", &gCfg) {
+		defer os.RemoveAll(dir)
+	}
+	for ii := range p.Archives {
+		if ctx.Err() != nil {
+			return p, ctx.Err()
+		}
+		ap := &p.Archives[ii]
+		if e := planArchive(ctx, store, dir, ap); e != nil {
+			lg.WarnContext(ctx, "unable to read the archive", "archive", ap.Archive, "error", e)
+			ap.Error = e.Error()
+		}
+	}
+	return
+}
+
+// planArchive downloads the archive into 'dir' and counts its documents and the ones that have not been loaded.
+func planArchive(ctx context.Context, store naLib.StateStore, dir string, ap *ArchivePlan) error {
+	ks := naLib.NewKeyspace(&gCfg)
+	fpfn, err := naLib.DownloadFile(ctx, ap.Archive, dir, &gCfg)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fpfn)
+
+	batchSize := max(gCfg.RedisBatchSize, 1)
+	batch := make([]naLib.LoadDoc, 0, batchSize)
+	check := func() error {
+		loaded, err := store.Loaded(batch)
+		if err != nil {
+			return err
+		}
+		for _, l := range loaded {
+			if !l {
+				ap.NewDocs++
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	err = unzip.WalkLimited(ctx, fpfn, ArchiveLimits(), func(xmlfn string, rd io.Reader) error {
+		if _, err := io.Copy(ioutil.Discard, rd); err != nil {
+			return err
+		}
+		ap.Documents++
+		batch = append(batch, naLib.LoadDoc{Key: ks.Document(xmlfn), Name: xmlfn})
+		if len(batch) >= batchSize {
+			return check()
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = check()
+	}
+	return err
+}
+
+// runPlan does a dry run and prints the plan.
+func runPlan(store naLib.StateStore, opts RunOptions) int {
+	p, err := PlanRun(shutdown.Ctx, store, opts, *Download)
+	if err != nil {
+		naLib.Log(naLib.LogRun).Error("dry run failed", "error", err)
+		return ExitError
+	}
+	printResult(p, func() {
+		fmt.Printf("Dry run, nothing was changed.  %d archives at %s, %d new\n", p.Found, gCfg.LoadUrl, len(p.New))
+		if len(p.Resumed) > 0 {
+			fmt.Printf("Would resume %d interrupted archives: %s\n", len(p.Resumed), p.Resumed)
+		}
+		if len(p.Archives) == 0 {
+			fmt.Printf("No new files to process\n")
+			return
+		}
+		fmt.Printf("Would process %d archives:\n", len(p.Archives))
+		var docs, newDocs int
+		for _, ap := range p.Archives {
+			line := "  " + ap.Archive
+			if *Download {
+				line += fmt.Sprintf("  %d documents, %d new", ap.Documents, ap.NewDocs)
+				docs, newDocs = docs+ap.Documents, newDocs+ap.NewDocs
+			}
+			if ap.Quarantined != "" {
+				line += "  (quarantined: " + ap.Quarantined + ")"
+			}
+			if ap.Error != "" {
+				line += "  error: " + ap.Error
+			}
+			fmt.Println(line)
+		}
+		if *Download {
+			fmt.Printf("Would load %d of %d documents\n", newDocs, docs)
+		}
+	})
+	for _, ap := range p.Archives {
+		if ap.Error != "" {
+			return ExitError
+		}
+	}
+	return ExitOK
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/pschlump/news-aggregator/naLib"
+)
+
+// stateSnapshot is everything a run can change in the state store.
+type stateSnapshot struct {
+	Downloaded, Interrupted, Reruns []string
+	Quarantine                      map[string]string
+	Loaded                          []bool
+	Queued, History                 int
+	LeaseFree                       bool
+}
+
+// snapshot reads the state that a run can change, docs are the document names to check for.
+func snapshot(t *testing.T, store naLib.StateStore, docs ...string) (s stateSnapshot) {
+	ks := naLib.NewKeyspace(&gCfg)
+	members := func(set string) (list []string) {
+		store.Members(set, func(m string) error { list = append(list, m); return nil })
+		return
+	}
+	s.Downloaded, s.Interrupted, s.Reruns = members(ks.Downloaded()), members(ks.Interrupted()), members(ks.Reruns())
+	s.Quarantine = map[string]string{}
+	store.Fields(ks.Quarantine(), func(f, v string) error { s.Quarantine[f] = v; return nil })
+	var batch []naLib.LoadDoc
+	for _, d := range docs {
+		batch = append(batch, naLib.LoadDoc{Key: ks.Document(d), Name: d})
+	}
+	s.Loaded, _ = store.Loaded(batch)
+	s.Queued, _ = store.Len(ks.NewsXML())
+	s.History, _ = store.Len(ks.RunHistory())
+	s.LeaseFree, _ = store.AcquireLease(ks.RunLease(), "snapshot", 0)
+	store.ReleaseLease(ks.RunLease(), "snapshot")
+	return
+}
+
+// func PlanRun(ctx context.Context, store naLib.StateStore, opts RunOptions, download bool) (p Plan, err error) {
+func Test_PlanRun(t *testing.T) {
+	store := testConfig(t, naLib.GlobalConfigType{RunHistory: 10})
+	ts := newTestSource(t, "1600000001.zip", "1600000002.zip", "1600000003.zip", "1600000004.zip")
+	ts.set("1600000001.zip", testArchive(t, "a.xml"))
+	ts.set("1600000002.zip", testArchive(t, "b.xml", "c.xml"))
+	ts.set("1600000003.zip", testArchive(t, "a.xml", "d.xml", "e.xml"))
+	ks := naLib.NewKeyspace(&gCfg)
+
+	// 1 has been loaded, 2 was interrupted part way through, 3 was quarantined before and 4 is missing
+	if _, err := RunMainProcess(context.Background(), store, RunOptions{Archives: []string{"1600000001.zip"}, Force: true}); err != nil {
+		t.Fatalf("Test_PlanRun: %s", err)
+	}
+	store.AddNew(ks.Interrupted(), []string{"1600000002.zip"})
+	store.SetField(ks.Quarantine(), "1600000003.zip", "MaxRatio")
+	docs := []string{"a.xml", "b.xml", "c.xml", "d.xml", "e.xml"}
+	before := snapshot(t, store, docs...)
+
+	p, err := PlanRun(context.Background(), store, RunOptions{}, true)
+	if err != nil {
+		t.Fatalf("Test_PlanRun: %s", err)
+	}
+	if p.Found != 4 || !reflect.DeepEqual(p.New, []string{"1600000002.zip", "1600000003.zip", "1600000004.zip"}) || len(p.Resumed) != 0 {
+		t.Errorf("Test_PlanRun: expected 4 found and 3 new got %+v", p)
+	}
+	ex := []ArchivePlan{
+		{Archive: "1600000002.zip", Documents: 2, NewDocs: 2},
+		{Archive: "1600000003.zip", Quarantined: "MaxRatio", Documents: 3, NewDocs: 2},
+		{Archive: "1600000004.zip"},
+	}
+	if len(p.Archives) != 3 || p.Archives[2].Error == "" {
+		t.Fatalf("Test_PlanRun: expected 3 archives and an error for 1600000004.zip got %+v", p.Archives)
+	}
+	p.Archives[2].Error = ""
+	if !reflect.DeepEqual(p.Archives, ex) {
+		t.Errorf("Test_PlanRun: expected %+v got %+v", ex, p.Archives)
+	}
+
+	if after := snapshot(t, store, docs...); !reflect.DeepEqual(before, after) {
+		t.Errorf("Test_PlanRun: the dry run changed the state\nbefore %+v\nafter  %+v", before, after)
+	}
+	if files, _ := ioutil.ReadDir(gCfg.TmpDir); len(files) != 0 {
+		t.Errorf("Test_PlanRun: expected the scratch directory removed, found %d files in TmpDir", len(files))
+	}
+
+	// the same plan again, and an archive that is not in the listing
+	if p2, _ := PlanRun(context.Background(), store, RunOptions{}, true); !reflect.DeepEqual(p2.New, p.New) || len(p2.Archives) != 3 {
+		t.Errorf("Test_PlanRun: expected the same plan the second time got %+v", p2)
+	}
+	if _, err = PlanRun(context.Background(), store, RunOptions{Archives: []string{"1600000009.zip"}}, false); err == nil {
+		t.Errorf("Test_PlanRun: expected an error for an archive not in the listing")
+	}
+
+	// a RedisBatchSize that config-check would reject still gives the same counts
+	for _, n := range []int{0, -1} {
+		gCfg.RedisBatchSize = n
+		p2, err := PlanRun(context.Background(), store, RunOptions{Archives: []string{"1600000003.zip"}, Force: true}, true)
+		if err != nil || len(p2.Archives) != 1 || p2.Archives[0].Documents != 3 || p2.Archives[0].NewDocs != 2 {
+			t.Errorf("Test_PlanRun: RedisBatchSize %d expected 3 documents, 2 new got %+v, %v", n, p2.Archives, err)
+		}
+	}
+}
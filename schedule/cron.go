@@ -0,0 +1,171 @@
+package schedule
+
+//
+// When to run.  A Schedule is either a cron expression or a fixed interval, with optional random jitter, and
+// optional windows that the runs have to start in:
+//
+//	RunSchedule  "*/30 * * * *"         every 30 minutes
+//	RunJitter    120                    plus up to 2 minutes, so a fleet does not all start at once
+//	RunWindows   [ "Mon-Fri 18:00-07:00", "Sat-Sun" ]   not during business hours
+//
+// All times are in the local time zone of the process.
+//
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed cron expression with the five standard fields:
+//
+//	minute hour day-of-month month day-of-week
+//
+// Each field is "*", a number, a range "1-5", a list "1,15" or any of those with a step "*/15", "8-18/2".
+// Months and days of the week can be names, "jan" or "mon".  Sunday is 0 or 7.  As in cron, if both the day of
+// the month and the day of the week are restricted a day that matches either one matches.  The macros @yearly
+// (@annually), @monthly, @weekly, @daily (@midnight) and @hourly can be used instead of the fields.
+type Cron struct {
+	expr                          string
+	minute, hour, dom, month, dow uint64 // bit n set if n matches
+	domStar, dowStar              bool
+}
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseCron parses a cron expression.
+func ParseCron(expr string) (c *Cron, err error) {
+	fields := strings.Fields(expr)
+	if len(fields) == 1 {
+		if m, ok := macros[strings.ToLower(fields[0])]; ok {
+			fields = strings.Fields(m)
+		}
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, minute hour day-of-month month day-of-week", expr)
+	}
+	c = &Cron{expr: expr}
+	if c.minute, err = parseField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("cron expression %q minute: %s", expr, err)
+	}
+	if c.hour, err = parseField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("cron expression %q hour: %s", expr, err)
+	}
+	if c.dom, err = parseField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("cron expression %q day of month: %s", expr, err)
+	}
+	if c.month, err = parseField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("cron expression %q month: %s", expr, err)
+	}
+	if c.dow, err = parseField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("cron expression %q day of week: %s", expr, err)
+	}
+	if c.dow&(1<<7) != 0 { // 7 is also Sunday
+		c.dow |= 1
+	}
+	c.domStar, c.dowStar = fields[2] == "*", fields[4] == "*"
+	return
+}
+
+func (c *Cron) String() string { return c.expr }
+
+// parseField returns the bits for one field.  'names' are the names for min, min+1, ...
+func parseField(field string, min, max int, names []string) (bits uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		lo, hi, step := min, max, 1
+		rng := part
+		if i := strings.Index(part, "/"); i >= 0 {
+			rng = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+		}
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			if lo, err = parseValue(bounds[0], min, max, names); err != nil {
+				return
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = parseValue(bounds[1], min, max, names); err != nil {
+					return
+				}
+			} else if step > 1 {
+				hi = max // "5/15" is 5, 20, 35, 50
+			}
+			if hi == 0 && lo > 0 && max == 7 { // a day of the week range ending on Sunday, "sat-sun"
+				hi = 7
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("range %q is backwards", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return
+}
+
+// parseValue parses a number or a name in the range min to max.
+func parseValue(s string, min, max int, names []string) (v int, err error) {
+	for ii, name := range names {
+		if strings.EqualFold(s, name) {
+			return min + ii, nil
+		}
+	}
+	v, err = strconv.Atoi(s)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("%q is not between %d and %d", s, min, max)
+	}
+	return v, nil
+}
+
+// dayMatches applies the cron rule for the two day fields.
+func (c *Cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time after 'after' that matches, to the minute.  If nothing matches in the next 5 years
+// (for example "0 0 30 2 *") the zero time is returned.
+func (c *Cron) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
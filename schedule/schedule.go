@@ -0,0 +1,77 @@
+package schedule
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// ErrNeverRuns is returned by Next when the cron expression and the windows never line up.
+var ErrNeverRuns = errors.New("the schedule never runs inside the run windows")
+
+// Schedule says when the next run is.
+type Schedule struct {
+	Cron     *Cron         // If set, runs are at the times that match
+	Interval time.Duration // If there is no Cron, runs are Interval apart, measured from the end of the last run
+	Jitter   time.Duration // Up to this much random time is added to each run, but not past the end of its window
+	Windows  Windows       // If set, runs only start inside one of these
+}
+
+// New returns the Schedule for a cron expression or, if cronExpr is "", a fixed interval.
+func New(cronExpr string, interval, jitter time.Duration, windows []string) (s *Schedule, err error) {
+	s = &Schedule{Interval: interval, Jitter: jitter}
+	if cronExpr != "" {
+		if s.Cron, err = ParseCron(cronExpr); err != nil {
+			return nil, err
+		}
+	}
+	if s.Windows, err = ParseWindows(windows); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// First returns the time of the first run for a process started at 'now'.  With an interval that is right
+// away, or when the next window opens.  With a cron expression it is the same as Next.
+func (s *Schedule) First(now time.Time) (time.Time, error) {
+	if s.Cron != nil {
+		return s.Next(now)
+	}
+	return s.jitter(s.Windows.NextStart(now))
+}
+
+// Next returns the time of the run after 'after', with jitter added.  With a cron expression this is the next
+// matching time inside a window, runs that would start outside of the windows are skipped.  With an interval it
+// is 'after' plus Interval, moved forward to the start of the next window if it is outside of them.
+func (s *Schedule) Next(after time.Time) (time.Time, error) {
+	if s.Cron == nil {
+		return s.jitter(s.Windows.NextStart(after.Add(s.Interval)))
+	}
+	t := after
+	limit := after.AddDate(1, 0, 0)
+	for {
+		t = s.Cron.Next(t)
+		if t.IsZero() || t.After(limit) {
+			return time.Time{}, ErrNeverRuns
+		}
+		if s.Windows.Contains(t) {
+			return s.jitter(t)
+		}
+	}
+}
+
+// jitter adds up to Jitter to t, which is inside the windows.  The jitter is cut short where the window closes, so
+// that a run near the end of a window still starts inside it.
+func (s *Schedule) jitter(t time.Time) (time.Time, error) {
+	if t.IsZero() {
+		return t, ErrNeverRuns
+	}
+	j := s.Jitter
+	if end := s.Windows.Until(t, t.Add(j)); end.Sub(t) < j {
+		j = end.Sub(t)
+	}
+	if j > 0 {
+		t = t.Add(time.Duration(rand.Int63n(int64(j))))
+	}
+	return t, nil
+}
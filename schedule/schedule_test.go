@@ -0,0 +1,149 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+// at returns a time in UTC, 2026-03-02 is a Monday.
+func at(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// func (c *Cron) Next(after time.Time) time.Time {
+func Test_CronNext(t *testing.T) {
+	tests := []struct {
+		expr, after, ex string
+	}{
+		{expr: "* * * * *", after: "2026-03-02 10:00", ex: "2026-03-02 10:01"},
+		{expr: "*/15 * * * *", after: "2026-03-02 10:07", ex: "2026-03-02 10:15"},
+		{expr: "5/15 * * * *", after: "2026-03-02 10:07", ex: "2026-03-02 10:20"},
+		{expr: "0 2 * * *", after: "2026-03-02 10:07", ex: "2026-03-03 02:00"},
+		{expr: "@hourly", after: "2026-03-02 10:00", ex: "2026-03-02 11:00"},
+		{expr: "30 8-18/2 * * mon-fri", after: "2026-03-06 18:30", ex: "2026-03-09 08:30"},
+		{expr: "0 0 1 jan,jul *", after: "2026-03-02 10:00", ex: "2026-07-01 00:00"},
+		{expr: "0 0 * * 7", after: "2026-03-02 10:00", ex: "2026-03-08 00:00"},
+		{expr: "0 0 13 * fri", after: "2026-03-02 10:00", ex: "2026-03-06 00:00"}, // day of month or day of week
+		{expr: "0 0 29 2 *", after: "2026-03-02 10:00", ex: "2028-02-29 00:00"},
+		{expr: "0 0 30 2 *", after: "2026-03-02 10:00", ex: ""},
+	}
+	for ii, test := range tests {
+		c, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("Test_CronNext %d: %s error %s", ii, test.expr, err)
+			continue
+		}
+		got := c.Next(at(test.after))
+		if test.ex == "" {
+			if !got.IsZero() {
+				t.Errorf("Test_CronNext %d: %s expected never got %s", ii, test.expr, got)
+			}
+		} else if !got.Equal(at(test.ex)) {
+			t.Errorf("Test_CronNext %d: %s expected %s got %s", ii, test.expr, test.ex, got)
+		}
+	}
+
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* * * foo *", "*/0 * * * *", "5-1 * * * *", "@often"} {
+		if _, err := ParseCron(bad); err == nil {
+			t.Errorf("Test_CronNext: expected an error for %q", bad)
+		}
+	}
+}
+
+// func (w Window) Contains(t time.Time) bool {
+func Test_Window(t *testing.T) {
+	tests := []struct {
+		expr, t string
+		in      bool
+		next    string
+	}{
+		{expr: "22:00-06:00", t: "2026-03-02 23:00", in: true},
+		{expr: "22:00-06:00", t: "2026-03-02 05:59", in: true},
+		{expr: "22:00-06:00", t: "2026-03-02 06:00", in: false, next: "2026-03-02 22:00"},
+		{expr: "Mon-Fri 18:00-07:00", t: "2026-03-07 06:00", in: true}, // Saturday morning, from Friday night
+		{expr: "Mon-Fri 18:00-07:00", t: "2026-03-08 06:00", in: false, next: "2026-03-09 18:00"},
+		{expr: "Sat,Sun", t: "2026-03-06 12:00", in: false, next: "2026-03-07 00:00"},
+		{expr: "Sat,Sun", t: "2026-03-08 23:59", in: true},
+		{expr: "09:00-17:00", t: "2026-03-02 17:00", in: false, next: "2026-03-03 09:00"},
+	}
+	for ii, test := range tests {
+		w, err := ParseWindow(test.expr)
+		if err != nil {
+			t.Errorf("Test_Window %d: %s error %s", ii, test.expr, err)
+			continue
+		}
+		if in := w.Contains(at(test.t)); in != test.in {
+			t.Errorf("Test_Window %d: %s Contains(%s) expected %v", ii, test.expr, test.t, test.in)
+		}
+		if test.next != "" {
+			if next := w.NextStart(at(test.t)); !next.Equal(at(test.next)) {
+				t.Errorf("Test_Window %d: %s NextStart(%s) expected %s got %s", ii, test.expr, test.t, test.next, next)
+			}
+		}
+	}
+
+	for _, bad := range []string{"", "25:00-06:00", "10:00", "Funday", "Mon 10:00-11:00 extra"} {
+		if _, err := ParseWindow(bad); err == nil {
+			t.Errorf("Test_Window: expected an error for %q", bad)
+		}
+	}
+}
+
+// func (s *Schedule) Next(after time.Time) (time.Time, error) {
+func Test_ScheduleNext(t *testing.T) {
+	night := []string{"Mon-Fri 18:00-08:00", "Sat-Sun"}
+
+	s, err := New("0 * * * *", 0, 0, night)
+	if err != nil {
+		t.Fatalf("Test_ScheduleNext: New error %s", err)
+	}
+	if next, _ := s.Next(at("2026-03-02 07:30")); !next.Equal(at("2026-03-02 18:00")) {
+		t.Errorf("Test_ScheduleNext: cron in windows expected 18:00 got %s", next)
+	}
+
+	s, _ = New("", 30*time.Minute, 0, night)
+	if first, _ := s.First(at("2026-03-02 12:00")); !first.Equal(at("2026-03-02 18:00")) {
+		t.Errorf("Test_ScheduleNext: interval First expected 18:00 got %s", first)
+	}
+	if next, _ := s.Next(at("2026-03-02 18:10")); !next.Equal(at("2026-03-02 18:40")) {
+		t.Errorf("Test_ScheduleNext: interval Next expected 18:40 got %s", next)
+	}
+
+	s, _ = New("0 12 * * *", 0, 0, []string{"Mon-Fri 18:00-08:00"})
+	if _, err := s.Next(at("2026-03-02 07:30")); err != ErrNeverRuns {
+		t.Errorf("Test_ScheduleNext: expected ErrNeverRuns got %v", err)
+	}
+
+	s, _ = New("0 * * * *", 0, 5*time.Minute, nil)
+	for i := 0; i < 20; i++ {
+		next, _ := s.Next(at("2026-03-02 07:30"))
+		if next.Before(at("2026-03-02 08:00")) || !next.Before(at("2026-03-02 08:05")) {
+			t.Errorf("Test_ScheduleNext: jitter out of range %s", next)
+		}
+	}
+
+	// jitter near the end of a window does not go past it, unless the next window follows on
+	s, _ = New("50 22 * * *", 0, 2*time.Hour, []string{"22:00-23:00"})
+	for i := 0; i < 50; i++ {
+		next, _ := s.Next(at("2026-03-02 12:00"))
+		if next.Before(at("2026-03-02 22:50")) || !next.Before(at("2026-03-02 23:00")) || !s.Windows.Contains(next) {
+			t.Errorf("Test_ScheduleNext: cron jitter past the end of the window %s", next)
+		}
+	}
+	s, _ = New("", 30*time.Minute, 2*time.Hour, []string{"Mon 22:00-23:00", "Mon 23:00-23:30"})
+	late := false
+	for i := 0; i < 50; i++ {
+		next, _ := s.Next(at("2026-03-02 22:20"))
+		if next.Before(at("2026-03-02 22:50")) || !next.Before(at("2026-03-02 23:30")) || !s.Windows.Contains(next) {
+			t.Errorf("Test_ScheduleNext: interval jitter past the end of the windows %s", next)
+		}
+		late = late || !next.Before(at("2026-03-02 23:00"))
+	}
+	if !late {
+		t.Errorf("Test_ScheduleNext: jitter never went into the window that follows on")
+	}
+}
@@ -0,0 +1,171 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a time of day, on some days of the week, that runs are allowed to start in.  It is written as
+//
+//	[days] [HH:MM-HH:MM]
+//
+// for example "Mon-Fri 18:00-07:00", "22:00-06:00" or "Sat,Sun".  The days are in the same form as the
+// day-of-week field of a cron expression, and default to every day.  Without a time the window is the whole day.
+// A window that ends before it starts goes past midnight, and belongs to the day it starts on - so with
+// "Fri 18:00-07:00" Saturday 06:00 is in the window.
+type Window struct {
+	expr       string
+	days       uint64 // bit n set for each weekday, Sunday is 0
+	start, end int    // Minutes after midnight; start == end is the whole day
+}
+
+// ParseWindow parses a window.
+func ParseWindow(expr string) (w Window, err error) {
+	w = Window{expr: expr, days: 0x7f}
+	fields := strings.Fields(expr)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("run window %q should be [days] [HH:MM-HH:MM]", expr)
+	}
+	if tm := fields[len(fields)-1]; strings.Contains(tm, ":") {
+		fields = fields[:len(fields)-1]
+		bounds := strings.Split(tm, "-")
+		if len(bounds) != 2 {
+			return w, fmt.Errorf("run window %q: time should be HH:MM-HH:MM", expr)
+		}
+		if w.start, err = parseClock(bounds[0]); err == nil {
+			w.end, err = parseClock(bounds[1])
+		}
+		if err != nil {
+			return w, fmt.Errorf("run window %q: %s", expr, err)
+		}
+	}
+	if len(fields) == 1 {
+		if w.days, err = parseField(fields[0], 0, 7, dayNames); err != nil {
+			return w, fmt.Errorf("run window %q days: %s", expr, err)
+		}
+		if w.days&(1<<7) != 0 {
+			w.days = w.days&0x7f | 1
+		}
+	}
+	return
+}
+
+// parseClock parses HH:MM into minutes after midnight.  24:00 is allowed as the end of the day.
+func parseClock(s string) (minutes int, err error) {
+	var h, m int
+	if n, e := fmt.Sscanf(s, "%d:%d", &h, &m); n != 2 || e != nil || h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("%q is not a time, HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+func (w Window) String() string { return w.expr }
+
+func (w Window) onDay(t time.Time) bool { return w.days&(1<<uint(t.Weekday())) != 0 }
+
+// Contains returns true if t is in the window.
+func (w Window) Contains(t time.Time) bool {
+	tod := t.Hour()*60 + t.Minute()
+	end := w.end
+	if end <= w.start {
+		end += 24 * 60
+	}
+	if w.onDay(t) && tod >= w.start && tod < end {
+		return true
+	}
+	// the part after midnight of a window that started the day before
+	return end > 24*60 && tod < end-24*60 && w.onDay(t.AddDate(0, 0, -1))
+}
+
+// NextStart returns the first time at or after t that is in the window.
+func (w Window) NextStart(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for i := 0; i <= 7; i++ {
+		d := day.AddDate(0, 0, i)
+		start := d.Add(time.Duration(w.start) * time.Minute)
+		if w.onDay(d) && start.After(t) {
+			return start
+		}
+	}
+	return time.Time{}
+}
+
+// End returns the time that the window closes, for a time t that is in the window.
+func (w Window) End(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	tod := t.Hour()*60 + t.Minute()
+	end := w.end
+	if end <= w.start {
+		end += 24 * 60
+	}
+	if !w.onDay(t) || tod < w.start || tod >= end {
+		end -= 24 * 60 // the part after midnight of a window that started the day before
+	}
+	return day.Add(time.Duration(end) * time.Minute)
+}
+
+// Windows is a list of Window, a time is in Windows if it is in any of them.  An empty list allows any time.
+type Windows []Window
+
+// ParseWindows parses each of the windows.
+func ParseWindows(exprs []string) (ws Windows, err error) {
+	for _, expr := range exprs {
+		w, e := ParseWindow(expr)
+		if e != nil {
+			return nil, e
+		}
+		ws = append(ws, w)
+	}
+	return
+}
+
+// Contains returns true if t is in one of the windows, or there are none.
+func (ws Windows) Contains(t time.Time) bool {
+	if len(ws) == 0 {
+		return true
+	}
+	for _, w := range ws {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Until returns the first time after t that is not in any of the windows, following windows that overlap or
+// follow on from each other.  It stops looking once it gets to limit, and returns limit if there are no windows.
+func (ws Windows) Until(t, limit time.Time) time.Time {
+	if len(ws) == 0 {
+		return limit
+	}
+	end := t
+	for end.Before(limit) && ws.Contains(end) {
+		next := end
+		for _, w := range ws {
+			if w.Contains(end) {
+				if e := w.End(end); e.After(next) {
+					next = e
+				}
+			}
+		}
+		end = next
+	}
+	return end
+}
+
+// NextStart returns the first time at or after t that is in one of the windows.
+func (ws Windows) NextStart(t time.Time) (next time.Time) {
+	if ws.Contains(t) {
+		return t
+	}
+	for _, w := range ws {
+		if s := w.NextStart(t); !s.IsZero() && (next.IsZero() || s.Before(next)) {
+			next = s
+		}
+	}
+	return
+}
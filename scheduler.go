@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pschlump/news-aggregator/naLib"
+	"github.com/pschlump/news-aggregator/schedule"
+)
+
+// RunSchedule returns the schedule for the run command: RunSchedule if it is set, otherwise every RunFreq seconds,
+// with RunJitter and RunWindows.  It is nil if neither is set, and the program runs once.
+func RunSchedule() (*schedule.Schedule, error) {
+	if gCfg.RunSchedule == "" && gCfg.RunFreq <= 0 {
+		return nil, nil
+	}
+	return schedule.New(gCfg.RunSchedule, time.Duration(gCfg.RunFreq)*time.Second, time.Duration(gCfg.RunJitter)*time.Second, gCfg.RunWindows)
+}
+
+// leaseOwner names this process in the run lease.
+var leaseOwner = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}()
+
+// ErrRunInProgress is returned when another process holds the run lease.
+var ErrRunInProgress = errors.New("another run is in progress")
+
+// withRunLease calls fn while holding the run lease, so that runs from different processes (a scheduled run and
+// a manual once, or two aggregators on the same state) do not overlap.  The lease is renewed while fn runs, and
+// expires after RunLeaseTTL seconds if the process dies.  If another process has the lease fn is not called and
+// ErrRunInProgress is returned.
+func withRunLease(store naLib.StateStore, fn func()) error {
+	key := naLib.NewKeyspace(&gCfg).RunLease()
+	ttl := time.Duration(gCfg.RunLeaseTTL) * time.Second
+	if ttl <= 0 {
+		ttl = 10 * time.Minute
+	}
+	got, err := store.AcquireLease(key, leaseOwner, ttl)
+	if err != nil {
+		naLib.Log(naLib.LogRun).Error("unable to get the run lease", "error", err)
+		return err
+	}
+	if !got {
+		return ErrRunInProgress
+	}
+	defer store.ReleaseLease(key, leaseOwner)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if ok, err := store.AcquireLease(key, leaseOwner, ttl); !ok || err != nil {
+					naLib.Log(naLib.LogRun).Error("unable to renew the run lease", "error", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	fn()
+	return nil
+}
+
+// saveNextRun records when the next run is, for the status command.  The zero time clears it.
+func saveNextRun(store naLib.StateStore, next time.Time) {
+	value := ""
+	if !next.IsZero() {
+		value = next.Format(time.RFC3339)
+	}
+	if err := store.SetField(naLib.NewKeyspace(&gCfg).Schedule(), "next", value); err != nil {
+		naLib.Log(naLib.LogRun).Error("unable to save the next run time", "error", err)
+	}
+}
+
+// NextRun returns the time of the next run, from the running process if there is one, otherwise worked out from
+// the configuration.  'source' says which.  The zero time is returned if there is no schedule.
+func NextRun(store naLib.StateStore) (next time.Time, source string) {
+	store.Fields(naLib.NewKeyspace(&gCfg).Schedule(), func(field, value string) error {
+		if field == "next" && value != "" {
+			if t, err := time.Parse(time.RFC3339, value); err == nil {
+				next, source = t, "running process"
+			}
+		}
+		return nil
+	})
+	if !next.IsZero() {
+		return
+	}
+	sched, err := RunSchedule()
+	if sched == nil || err != nil {
+		return
+	}
+	sched.Jitter = 0
+	if next, err = sched.First(time.Now()); err == nil {
+		source = "configuration"
+	}
+	return
+}
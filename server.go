@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/pschlump/news-aggregator/naLib"
+)
+
+// StartServer serves /metrics, /healthz and /readyz on HTTPAddr, if it is set, and the admin API if there is an
+// admin token.  It runs until the program exits.
+func StartServer(store naLib.StateStore) {
+	if gCfg.HTTPAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, health.Alive(time.Now()))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		var redisErr error
+		if client, ok := store.(*naLib.RedisStore); ok {
+			if rc, ok := client.Client().(*naLib.RedisConn); ok {
+				redisErr = rc.Ping()
+			}
+		}
+		rep := health.Ready(time.Now(), redisErr)
+		if shutdown.Stopping() {
+			rep.Fail("shutting down")
+		}
+		writeHealth(w, rep)
+	})
+	if token, err := naLib.AdminAPIToken(&gCfg); err != nil {
+		naLib.Log(naLib.LogHTTP).Error("unable to read the admin token, the admin API is off", "error", err)
+	} else if token != "" {
+		mux.Handle("/admin/", AdminHandler(store, token))
+	}
+	go func() {
+		lg := naLib.Log(naLib.LogHTTP)
+		lg.Info("serving /metrics, /healthz and /readyz", "addr", gCfg.HTTPAddr)
+		if err := http.ListenAndServe(gCfg.HTTPAddr, mux); err != nil {
+			lg.Error("unable to serve", "addr", gCfg.HTTPAddr, "error", err)
+		}
+	}()
+}
+
+// writeHealth sends the report as JSON, with 503 Service Unavailable if a check failed.
+func writeHealth(w http.ResponseWriter, rep naLib.HealthReport) {
+	status := http.StatusOK
+	if rep.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, rep)
+}
+
+// writeJSON sends v as JSON with the status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
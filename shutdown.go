@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pschlump/news-aggregator/naLib"
+)
+
+// Shutdown is how a run is stopped.  On the first SIGINT or SIGTERM, Stop is closed: no new archives are started
+// and the ones in progress are finished.  If they are not finished within the grace period, or a second signal
+// comes in, Ctx is canceled and everything stops at once.  Archives that did not finish are resumed at the next
+// start, see RunMainProcess.
+type Shutdown struct {
+	Stop   chan struct{}   // Closed at the first signal
+	Ctx    context.Context // Canceled when the grace period is over
+	cancel context.CancelFunc
+}
+
+// shutdown is used by all of the commands.  Only the commands that process archives listen for signals.
+var shutdown = NewShutdown()
+
+// NewShutdown returns a Shutdown that is not listening for signals.
+func NewShutdown() *Shutdown {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Shutdown{Stop: make(chan struct{}), Ctx: ctx, cancel: cancel}
+}
+
+// Notify starts listening for SIGINT and SIGTERM, with 'grace' to finish the work in progress.
+func (sd *Shutdown) Notify(grace time.Duration) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		naLib.Log(naLib.LogRun).Info("finishing the archives in progress, send the signal again to stop now", "signal", sig.String(), "grace", grace)
+		close(sd.Stop)
+		select {
+		case sig = <-ch:
+			naLib.Log(naLib.LogRun).Warn("stopping now", "signal", sig.String())
+		case <-time.After(grace):
+			naLib.Log(naLib.LogRun).Warn("shutdown grace period is over, stopping now", "grace", grace)
+		}
+		sd.cancel()
+	}()
+}
+
+// Stopping returns true once a signal has been received.
+func (sd *Shutdown) Stopping() bool {
+	select {
+	case <-sd.Stop:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pschlump/news-aggregator/naLib"
+	"github.com/pschlump/news-aggregator/pipeline"
+	"github.com/pschlump/news-aggregator/unzip"
+)
+
+// PipelineConfig returns the number of workers and buffer sizes for the pipeline from the configuration.
+func PipelineConfig() pipeline.Config {
+	return pipeline.Config{
+		DownloadWorkers: gCfg.DownloadWorkers,
+		ExtractWorkers:  gCfg.ExtractWorkers,
+		LoadWorkers:     gCfg.LoadWorkers,
+		ArchiveBuffer:   gCfg.ArchiveBuffer,
+		DocumentBuffer:  gCfg.DocumentBuffer,
+		LoadBatch:       gCfg.RedisBatchSize,
+		Stop:            shutdown.Stop,
+	}
+}
+
+// ArchiveLimits returns the limits on archive extraction from the configuration.
+func ArchiveLimits() unzip.Limits {
+	return unzip.Limits{
+		MaxEntries:    gCfg.ArchiveMaxEntries,
+		MaxEntryBytes: gCfg.ArchiveMaxEntryBytes,
+		MaxTotalBytes: gCfg.ArchiveMaxTotalBytes,
+		MaxRatio:      gCfg.ArchiveMaxRatio,
+		MaxDepth:      gCfg.ArchiveMaxDepth,
+	}
+}
+
+// DownloadStage downloads each archive into the temporary directory 'dir'.  Failures are added to the tally, if
+// there is one.
+func DownloadStage(dir string, tally *runTally) pipeline.DownloadFunc {
+	lg := naLib.Log(naLib.LogDownload)
+	return func(ctx context.Context, fn string) (a pipeline.Archive, err error) {
+		start := time.Now()
+		fpfn, err := naLib.DownloadFile(ctx, fn, dir, &gCfg)
+		if err != nil {
+			if ctx.Err() == nil {
+				lg.ErrorContext(ctx, "unable to download", "archive", fn, "error", err)
+				metrics.Failed("download")
+				tally.failed(fn, err)
+			}
+			return
+		}
+		var size int64
+		if st, e := os.Stat(fpfn); e == nil {
+			size = st.Size()
+		}
+		metrics.Downloaded(size, time.Since(start))
+		lg.DebugContext(ctx, "downloaded", "archive", fn, "bytes", size, "duration", time.Since(start))
+		return pipeline.Archive{Name: fn, Path: fpfn}, nil
+	}
+}
+
+// ExtractStage reads each document directly out of the archive and passes it on to be loaded.  Nothing is extracted
+// to disk unless dbLeaveTmpDir is on.  An archive that exceeds the limits or has unsafe entries in it is quarantined.
+func ExtractStage(store naLib.StateStore, dir string, tally *runTally) pipeline.ExtractFunc {
+	lg := naLib.Log(naLib.LogExtract)
+	return func(ctx context.Context, a pipeline.Archive, emit func(pipeline.Document) error) (err error) {
+		start := time.Now()
+		emitDoc := func(xmlfn string, rd io.Reader) error {
+			data, err := ioutil.ReadAll(rd)
+			if err != nil {
+				return err
+			}
+			return emit(pipeline.Document{Archive: a.Name, Name: xmlfn, Data: data})
+		}
+
+		leave := naLib.IsDbOn("dbLeaveTmpDir", &gCfg)
+		if leave { // this is for testing - extract to disk and leave temporary directory in place
+			err = ExtractToDisk(ctx, a, dir, emitDoc)
+		} else {
+			err = unzip.WalkLimited(ctx, a.Path, ArchiveLimits(), func(xmlfn string, rd io.Reader) error {
+				lg.DebugContext(ctx, "streaming", "archive", a.Name, "entry", xmlfn)
+				return emitDoc(xmlfn, rd)
+			})
+		}
+
+		if err != nil && ctx.Err() == nil {
+			lg.ErrorContext(ctx, "unable to read the archive", "archive", a.Name, "path", a.Path, "error", err)
+			metrics.Failed("extract")
+			tally.failed(a.Name, err)
+			switch err.(type) {
+			case *unzip.LimitError, *unzip.UnsafeEntryError:
+				naLib.QuarantineArchive(ctx, store, a.Name, a.Path, err.Error(), &gCfg) // moves the file, if QuarantineDir is set
+				return
+			}
+		} else if err == nil {
+			metrics.Extracted(time.Since(start))
+			lg.DebugContext(ctx, "extracted", "archive", a.Name, "duration", time.Since(start))
+		}
+		if !leave {
+			os.Remove(a.Path)
+		}
+		return
+	}
+}
+
+// ExtractToDisk is the debug path that extracts the archive into a temporary directory under 'dir' and then reads
+// each of the extracted files.  The extracted files are left in place so they can be looked at.
+func ExtractToDisk(ctx context.Context, a pipeline.Archive, dir string, emitDoc unzip.WalkFunc) (err error) {
+	// create temporary directory for each file to extract into - one temporary for each file
+	zipname, err := ioutil.TempDir(dir, a.Name) // don't much like this.
+	if err != nil {
+		naLib.Log(naLib.LogExtract).ErrorContext(ctx, "unable to create a temporary directory", "dir", dir, "archive", a.Name, "error", err)
+		return
+	}
+
+	// extract each .zip file - get list of file names.
+	zipList, err := unzip.UnZipLimited(ctx, a.Path, zipname, ArchiveLimits())
+	if err != nil {
+		return
+	}
+
+	naLib.Log(naLib.LogExtract).DebugContext(ctx, "extracted to disk", "archive", a.Name, "dir", zipname, "entries", zipList)
+
+	for _, xmlfn := range zipList {
+		err = emitFile(xmlfn, zipname+"/"+xmlfn, emitDoc)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// emitFile passes the extracted file 'fn' on as the document 'xmlfn'.
+func emitFile(xmlfn, fn string, emitDoc unzip.WalkFunc) error {
+	fp, err := naLib.Fopen(fn, "r")
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return emitDoc(xmlfn, fp)
+}
+
+// LoadStage pushes each document that has not already been loaded onto the RedisKeyNewsXML list.  The documents
+// come in batches of up to RedisBatchSize and each batch is checked and pushed in one round trip.  If the list is
+// over OutputHighWater, loading pauses or the oldest documents are dropped, see naLib.Backpressure.
+func LoadStage(store naLib.StateStore, bp *naLib.Backpressure, tally *runTally) pipeline.LoadFunc {
+	ks := naLib.NewKeyspace(&gCfg)
+	return func(ctx context.Context, docs []pipeline.Document) (err error) {
+		err = bp.Wait(ctx, store)
+		if err != nil {
+			return
+		}
+
+		batch := make([]naLib.LoadDoc, 0, len(docs))
+		for _, d := range docs {
+			//		if it is not already loaded
+			key := ks.Document(d.Name)
+			batch = append(batch, naLib.LoadDoc{Key: key, Name: d.Name, Data: d.Data})
+		}
+		isNew, err := store.Push(ks.NewsXML(), batch)
+		if err != nil {
+			var archives []string // a batch can have documents from more than one archive
+			for _, d := range docs {
+				if !naLib.InArray(d.Archive, archives) {
+					archives = append(archives, d.Archive)
+					tally.failed(d.Archive, err)
+				}
+			}
+			return
+		}
+		metrics.Pushed(isNew)
+		tally.loaded(isNew)
+		naLib.Log(naLib.LogLoad).DebugContext(ctx, "pushed", "documents", len(batch), "archive", docs[0].Archive)
+		_, err = bp.Trim(store)
+		return
+	}
+}
+
+// ReplayStage pushes every document onto the RedisKeyNewsXML list, including documents that have already been
+// loaded.  This is for the replay command.
+func ReplayStage(store naLib.StateStore, bp *naLib.Backpressure) pipeline.LoadFunc {
+	ks := naLib.NewKeyspace(&gCfg)
+	return func(ctx context.Context, docs []pipeline.Document) (err error) {
+		err = bp.Wait(ctx, store)
+		if err != nil {
+			return
+		}
+		data := make([][]byte, 0, len(docs))
+		for _, d := range docs {
+			data = append(data, d.Data)
+		}
+		err = store.Enqueue(ks.NewsXML(), data)
+		if err != nil {
+			return
+		}
+		_, err = bp.Trim(store)
+		return
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pschlump/news-aggregator/naLib"
+	"github.com/pschlump/news-aggregator/pipeline"
+)
+
+// func ExtractStage(store naLib.StateStore, dir string, tally *runTally) pipeline.ExtractFunc {
+func Test_ExtractStageQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	qdir := filepath.Join(dir, "quarantine")
+	store := testConfig(t, naLib.GlobalConfigType{QuarantineDir: qdir, ArchiveMaxEntries: 1}) // a.zip has 2 entries
+
+	data, err := ioutil.ReadFile("unzip/testdata/a.zip")
+	if err != nil {
+		t.Fatalf("Test_ExtractStageQuarantine: %s", err)
+	}
+	path := filepath.Join(dir, "a.zip")
+	ioutil.WriteFile(path, data, 0600)
+
+	tally := &runTally{}
+	err = ExtractStage(store, dir, tally)(context.Background(), pipeline.Archive{Name: "a.zip", Path: path}, func(pipeline.Document) error { return nil })
+	if err == nil {
+		t.Fatalf("Test_ExtractStageQuarantine: expected a limit error")
+	}
+	if _, err := os.Stat(filepath.Join(qdir, "a.zip")); err != nil {
+		t.Errorf("Test_ExtractStageQuarantine: expected the archive in QuarantineDir, %s", err)
+	}
+	if reason, ok, _ := store.GetField(naLib.NewKeyspace(&gCfg).Quarantine(), "a.zip"); !ok || reason == "" {
+		t.Errorf("Test_ExtractStageQuarantine: expected the quarantine to be recorded")
+	}
+	if _, _, errs := tally.result(nil); len(errs) != 1 {
+		t.Errorf("Test_ExtractStageQuarantine: expected 1 error in the tally got %q", errs)
+	}
+
+	// an archive that is read without a problem is removed
+	ioutil.WriteFile(path, data, 0600)
+	gCfg.ArchiveMaxEntries = 10
+	n := 0
+	err = ExtractStage(store, dir, nil)(context.Background(), pipeline.Archive{Name: "a.zip", Path: path}, func(pipeline.Document) error { n++; return nil })
+	if err != nil || n != 2 {
+		t.Errorf("Test_ExtractStageQuarantine: expected 2 documents got %d, %v", n, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Test_ExtractStageQuarantine: expected the archive to be removed, %v", err)
+	}
+}
+
+// func LoadStage(store naLib.StateStore, bp *naLib.Backpressure, tally *runTally) pipeline.LoadFunc {
+func Test_LoadStageFailed(t *testing.T) {
+	testConfig(t, naLib.GlobalConfigType{})
+	store := failingStore{naLib.NewMemoryStore(nil, &gCfg)}
+	tally := &runTally{}
+	docs := []pipeline.Document{{Archive: "a.zip", Name: "1.xml"}, {Archive: "b.zip", Name: "2.xml"}, {Archive: "a.zip", Name: "3.xml"}}
+	if err := LoadStage(store, backpressure, tally)(context.Background(), docs); err == nil {
+		t.Fatalf("Test_LoadStageFailed: expected an error")
+	}
+	if _, _, errs := tally.result(nil); len(errs) != 2 || errs[0] != "a.zip: push failed" || errs[1] != "b.zip: push failed" {
+		t.Errorf("Test_LoadStageFailed: expected a.zip and b.zip to fail got %q", errs)
+	}
+}
+
+// failingStore is a state store where Push fails.
+type failingStore struct {
+	naLib.StateStore
+}
+
+func (failingStore) Push(list string, docs []naLib.LoadDoc) ([]bool, error) {
+	return nil, errors.New("push failed")
+}
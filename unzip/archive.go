@@ -0,0 +1,174 @@
+package unzip
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Format is the type of an archive or compressed file, as found by looking at the first bytes of the file.
+type Format int
+
+const (
+	FormatUnknown Format = iota
+	FormatZip
+	FormatTar
+	FormatGzip
+	FormatBzip2
+	FormatXz
+)
+
+var ErrUnknownFormat = errors.New("Unknown archive format")
+
+var formatNames = map[Format]string{
+	FormatUnknown: "unknown",
+	FormatZip:     "zip",
+	FormatTar:     "tar",
+	FormatGzip:    "gzip",
+	FormatBzip2:   "bzip2",
+	FormatXz:      "xz",
+}
+
+func (f Format) String() string {
+	return formatNames[f]
+}
+
+// headerSize is the number of bytes needed to detect any of the formats - the tar magic is at offset 257.
+const headerSize = 512
+
+// DetectFormat looks at the first bytes of a file and returns the format.  The file extension is not used,
+// so a .zip that is really a tarball will still be read correctly.
+func DetectFormat(head []byte) Format {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return FormatZip
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return FormatGzip
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return FormatBzip2
+	case bytes.HasPrefix(head, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return FormatXz
+	case len(head) >= 262 && bytes.Equal(head[257:262], []byte("ustar")):
+		return FormatTar
+	}
+	return FormatUnknown
+}
+
+// decompress returns a reader for the decompressed contents of a gzip, bzip2 or xz stream.
+func decompress(format Format, rd io.Reader) (io.Reader, error) {
+	switch format {
+	case FormatGzip:
+		return gzip.NewReader(rd)
+	case FormatBzip2:
+		return bzip2.NewReader(rd), nil
+	case FormatXz:
+		return xz.NewReader(rd)
+	}
+	return nil, ErrUnknownFormat
+}
+
+// walkStream walks a tar file or a gzip, bzip2 or xz compressed file.  A compressed file is checked again to see if
+// it contains a tar file (.tar.gz, .tgz, .tar.bz2, .tar.xz), otherwise it is treated as a single compressed document.
+// The 'name' is the name of the archive, used to name a single compressed document.
+func (w *walker) walkStream(prefix, name string, format Format, br *bufio.Reader, raw *countingReader, depth int) (err error) {
+	if format == FormatTar {
+		return w.walkTar(prefix, br, raw, depth)
+	}
+
+	dr, err := decompress(format, br)
+	if err != nil {
+		return
+	}
+	dbr := bufio.NewReaderSize(dr, headerSize)
+	head, _ := dbr.Peek(headerSize)
+	if DetectFormat(head) == FormatTar {
+		return w.walkTar(prefix, dbr, raw, depth)
+	}
+	if len(head) == 0 {
+		return ErrEmptyArchive
+	}
+
+	name = singleFileName(name, dr)
+	w.lt.entries++
+	err = w.lt.checkEntries(w.lt.entries)
+	if err != nil {
+		return
+	}
+	return w.entry(prefix, name, &limitReader{rd: dbr, lt: w.lt, name: prefix + name, compressed: func() int64 { return raw.n }}, depth)
+}
+
+// singleFileName picks the document name for a single compressed file.  gzip can record the original name,
+// otherwise the compression extension is removed from the archive name.
+func singleFileName(inputFn string, dr io.Reader) string {
+	if gz, ok := dr.(*gzip.Reader); ok && gz.Name != "" {
+		if name, err := CleanEntryName(filepath.Base(gz.Name)); err == nil {
+			return name
+		}
+	}
+	name := filepath.Base(inputFn)
+	for _, ext := range []string{".gz", ".bz2", ".xz"} {
+		if strings.HasSuffix(name, ext) && len(name) > len(ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
+
+// walkTar calls fn for each regular file in a tar stream.  Directories are skipped; links and devices are
+// rejected with an *UnsafeEntryError.  MaxRatio is checked over the whole stream, see limitReader.
+func (w *walker) walkTar(prefix string, rd io.Reader, raw *countingReader, depth int) (err error) {
+	lt := w.lt
+	tr := tar.NewReader(rd)
+	nEntries := 0
+	var streamed int64
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return e
+		}
+		nEntries++
+		lt.entries++
+		err = lt.checkEntries(lt.entries)
+		if err != nil {
+			return
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+		case tar.TypeSymlink, tar.TypeLink:
+			return &UnsafeEntryError{Name: prefix + hdr.Name, Reason: "symbolic link"}
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			return &UnsafeEntryError{Name: prefix + hdr.Name, Reason: "not a regular file"}
+		}
+		name, e := CleanEntryName(hdr.Name)
+		if e != nil {
+			return e
+		}
+		err = lt.check(prefix+name, hdr.Size, lt.total+hdr.Size, -1)
+		if err != nil {
+			return
+		}
+		err = w.entry(prefix, name, &limitReader{rd: tr, lt: lt, name: prefix + name, compressed: func() int64 { return raw.n }, stream: &streamed}, depth)
+		if err != nil {
+			return
+		}
+	}
+	if nEntries == 0 {
+		err = ErrEmptyArchive
+	}
+	return
+}
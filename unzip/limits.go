@@ -0,0 +1,120 @@
+package unzip
+
+import (
+	"fmt"
+	"io"
+)
+
+// Limits restricts how much an archive is allowed to expand during extraction.  This protects against
+// "zip bombs" and broken uploads filling the disk or memory.  A zero value for any field means no limit.
+type Limits struct {
+	MaxEntries    int     // Maximum number of entries in the archive
+	MaxEntryBytes int64   // Maximum uncompressed size of a single entry
+	MaxTotalBytes int64   // Maximum uncompressed size of all entries added together
+	MaxRatio      float64 // Maximum ratio of uncompressed to compressed size for an entry
+	MaxDepth      int     // How many levels of archives inside of archives to expand, 0 does not expand nested archives
+}
+
+// LimitError is returned when an archive exceeds one of the Limits.
+type LimitError struct {
+	Name  string // Entry that exceeded the limit, "" if it applies to the entire archive
+	Limit string // Which limit, "MaxEntries", "MaxEntryBytes", "MaxTotalBytes" or "MaxRatio"
+	Value float64
+	Max   float64
+}
+
+func (e *LimitError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("Archive exceeds %s: %.0f > %.0f", e.Limit, e.Value, e.Max)
+	}
+	return fmt.Sprintf("Archive entry %q exceeds %s: %.0f > %.0f", e.Name, e.Limit, e.Value, e.Max)
+}
+
+// limitTracker keeps the running totals for one archive, including any nested archives.
+type limitTracker struct {
+	lim     Limits
+	total   int64
+	entries int
+}
+
+// checkEntries checks the number of entries in the archive.  For archive formats that do not have a directory
+// at the front, tar, this is called as each entry is read.  Entries in nested archives are added in.
+func (lt *limitTracker) checkEntries(n int) error {
+	if lt.lim.MaxEntries > 0 && n > lt.lim.MaxEntries {
+		return &LimitError{Limit: "MaxEntries", Value: float64(n), Max: float64(lt.lim.MaxEntries)}
+	}
+	return nil
+}
+
+// check is called with the number of bytes read so far from an entry and the compressed size of the entry.
+// It is used both with the sizes declared in the archive header and with the bytes actually read, since the
+// header can not be trusted.  If the compressed size is not known, -1, the ratio is not checked.
+func (lt *limitTracker) check(name string, n, total int64, compressed int64) error {
+	if lt.lim.MaxEntryBytes > 0 && n > lt.lim.MaxEntryBytes {
+		return &LimitError{Name: name, Limit: "MaxEntryBytes", Value: float64(n), Max: float64(lt.lim.MaxEntryBytes)}
+	}
+	if lt.lim.MaxTotalBytes > 0 && total > lt.lim.MaxTotalBytes {
+		return &LimitError{Name: name, Limit: "MaxTotalBytes", Value: float64(total), Max: float64(lt.lim.MaxTotalBytes)}
+	}
+	return lt.checkRatio(name, n, compressed)
+}
+
+// checkRatio checks the ratio of n uncompressed bytes to 'compressed' bytes.  If the compressed size is not known,
+// -1, the ratio is not checked.
+func (lt *limitTracker) checkRatio(name string, n, compressed int64) error {
+	if lt.lim.MaxRatio > 0 && compressed >= 0 {
+		if compressed < 1 {
+			compressed = 1
+		}
+		if ratio := float64(n) / float64(compressed); ratio > lt.lim.MaxRatio {
+			return &LimitError{Name: name, Limit: "MaxRatio", Value: ratio, Max: lt.lim.MaxRatio}
+		}
+	}
+	return nil
+}
+
+// limitReader counts the bytes read from an entry and fails the read as soon as a limit is exceeded.
+// The compressed function returns the number of compressed bytes the entry has used so far, or -1 if
+// that is not known.  For a compressed tar stream the decompressor reads ahead, so the compressed bytes can not
+// be split between the entries; then stream counts the bytes read from all of the entries so far, compressed
+// returns the bytes read from the whole stream, and the ratio is checked over the stream instead of the entry.
+type limitReader struct {
+	rd         io.Reader
+	lt         *limitTracker
+	name       string
+	compressed func() int64
+	stream     *int64
+	n          int64
+}
+
+func (lr *limitReader) Read(p []byte) (n int, err error) {
+	n, err = lr.rd.Read(p)
+	lr.n += int64(n)
+	lr.lt.total += int64(n)
+	var e error
+	if lr.stream == nil {
+		e = lr.lt.check(lr.name, lr.n, lr.lt.total, lr.compressed())
+	} else {
+		*lr.stream += int64(n)
+		if e = lr.lt.check(lr.name, lr.n, lr.lt.total, -1); e == nil {
+			e = lr.lt.checkRatio(lr.name, *lr.stream, lr.compressed())
+		}
+	}
+	if e != nil {
+		return n, e
+	}
+	return
+}
+
+// countingReader counts the bytes read from the underlying compressed stream so that the ratio
+// can be checked for formats that do not record a compressed size for each entry.
+type countingReader struct {
+	rd io.Reader
+	n  int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.rd.Read(p)
+	cr.n += int64(n)
+	return
+}
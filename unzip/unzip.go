@@ -2,54 +2,250 @@ package unzip
 
 import (
 	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/pschlump/news-aggregator/naLib"
 )
 
 var ErrEmptyArchive = errors.New("Empty Archive")
 
-// UnZip takes an input file name and un-zips it into the specified directory.  A list of files or an error is returned.
-// If this is an empty arcive, then an error will be returnd.
-func UnZip(inputFn string, tmpDir string) (fileList []string, err error) {
+// UnsafeEntryError is returned when an entry in an archive is rejected because it can not be safely
+// extracted, for example a name with "../" in it that would escape the temporary directory.
+type UnsafeEntryError struct {
+	Name   string // The entry name as it appears in the archive
+	Reason string // Why it was rejected
+}
+
+func (e *UnsafeEntryError) Error() string {
+	return fmt.Sprintf("Unsafe archive entry %q: %s", e.Name, e.Reason)
+}
+
+// CleanEntryName validates the name of an entry in an archive and returns a cleaned, relative, slash separated
+// name.  Absolute names, names that use ".." to move out of the extraction directory and empty names are rejected
+// with an *UnsafeEntryError.
+func CleanEntryName(name string) (clean string, err error) {
+	if name == "" || strings.IndexByte(name, 0) >= 0 {
+		return "", &UnsafeEntryError{Name: name, Reason: "empty or invalid name"}
+	}
+	s := strings.Replace(name, "\\", "/", -1)
+	if strings.HasPrefix(s, "/") || (len(s) > 1 && s[1] == ':') {
+		return "", &UnsafeEntryError{Name: name, Reason: "absolute path"}
+	}
+	for _, part := range strings.Split(s, "/") {
+		if part == ".." {
+			return "", &UnsafeEntryError{Name: name, Reason: "path escapes the extraction directory"}
+		}
+	}
+	clean = path.Clean(s)
+	if clean == "." {
+		return "", &UnsafeEntryError{Name: name, Reason: "empty or invalid name"}
+	}
+	return
+}
+
+// WalkFunc is called by Walk for each file in an archive.  The reader 'rd' is only valid until WalkFunc returns.
+// If an error is returned the walk stops and the error is returned from Walk.
+type WalkFunc func(name string, rd io.Reader) error
+
+// NestSep separates the names of nested archives in the name passed to WalkFunc, outer.zip!inner.zip!doc.xml.
+const NestSep = "!"
 
-	// Open a zip archive for reading.
-	r, err := zip.OpenReader(inputFn)
+// Walk opens the archive inputFn and calls fn for each file in it, streaming the contents directly out of the
+// archive.  Nothing is written to disk.  The format of the archive is found with DetectFormat: .zip, .tar,
+// .tar.gz, .tgz, .tar.bz2 and .tar.xz archives and single .gz, .bz2 or .xz compressed documents are supported.
+// If this is an empty archive, then ErrEmptyArchive will be returned.  Directory entries are skipped.  The name
+// passed to fn has been cleaned with CleanEntryName.  Symbolic links and entries with unsafe names stop the walk
+// with an *UnsafeEntryError.
+func Walk(inputFn string, fn WalkFunc) (err error) {
+	return WalkLimited(context.Background(), inputFn, Limits{}, fn)
+}
+
+// WalkLimited is Walk with Limits applied.  If the archive exceeds any of the limits the walk stops with a *LimitError.
+// The limits are checked against the sizes in the archive before an entry is opened and against the actual number of
+// bytes read from the entry.
+//
+// If lim.MaxDepth is more than 0 then entries that are themselves archives are walked too, up to MaxDepth levels
+// down.  The documents inside a nested archive are named with the full path to them, starting with the name of
+// inputFn, for example 1471622300928.zip!day1.zip!doc.xml.  Bytes read from nested archives count towards the
+// limits as well as the bytes of the nested archive itself.
+//
+// If ctx is canceled the walk stops before the next entry and returns ctx.Err().
+func WalkLimited(ctx context.Context, inputFn string, lim Limits, fn WalkFunc) (err error) {
+
+	fp, err := naLib.Fopen(inputFn, "r")
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+
+	w := &walker{ctx: ctx, lt: &limitTracker{lim: lim}, fn: fn, outer: filepath.Base(inputFn)}
+
+	// Look at the start of the file to find out what kind of archive it is.
+	raw := &countingReader{rd: fp}
+	br := bufio.NewReaderSize(raw, headerSize)
+	head, _ := br.Peek(headerSize)
+	format := DetectFormat(head)
+
+	switch format {
+	case FormatZip:
+		st, e := fp.Stat()
+		if e != nil {
+			return e
+		}
+		r, e := zip.NewReader(fp, st.Size())
+		if e != nil {
+			return e
+		}
+		return w.walkZip("", r, 0)
+	case FormatTar, FormatGzip, FormatBzip2, FormatXz:
+		return w.walkStream("", w.outer, format, br, raw, 0)
+	}
+	if len(head) == 0 {
+		return ErrEmptyArchive
+	}
+	return ErrUnknownFormat
+}
+
+// walker holds the state for walking one archive and the archives nested inside of it.
+type walker struct {
+	ctx   context.Context
+	lt    *limitTracker
+	fn    WalkFunc
+	outer string // Name of the top level archive, used to name documents in nested archives
+}
+
+// entry is called with each regular file found in an archive.  If nesting is allowed and the file is an archive it is
+// walked, otherwise it is passed on to the WalkFunc.  The 'prefix' is the path of archives above this one, "" at the top.
+func (w *walker) entry(prefix, name string, rd io.Reader, depth int) (err error) {
+	if err = w.ctx.Err(); err != nil {
+		return
+	}
+	if depth >= w.lt.lim.MaxDepth {
+		return w.fn(prefix+name, rd)
+	}
+
+	br := bufio.NewReaderSize(rd, headerSize)
+	head, _ := br.Peek(headerSize)
+	format := DetectFormat(head)
+	if format == FormatUnknown {
+		return w.fn(prefix+name, br)
+	}
+
+	if prefix == "" {
+		prefix = w.outer + NestSep
+	}
+	prefix = prefix + name + NestSep
+
+	switch format {
+	case FormatZip:
+		// zip needs random access, so the nested archive is read into memory - the size has already been limited.
+		data, e := ioutil.ReadAll(br)
+		if e != nil {
+			return e
+		}
+		r, e := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if e != nil {
+			return e
+		}
+		err = w.walkZip(prefix, r, depth+1)
+	default:
+		raw := &countingReader{rd: br}
+		err = w.walkStream(prefix, name, format, bufio.NewReaderSize(raw, headerSize), raw, depth+1)
+	}
+	if err == ErrEmptyArchive { // An empty nested archive just has no documents in it
+		err = nil
+	}
+	return
+}
+
+// walkZip calls fn for each file in a zip archive.
+func (w *walker) walkZip(prefix string, r *zip.Reader, depth int) (err error) {
+	if len(r.File) == 0 {
+		return ErrEmptyArchive
+	}
+
+	w.lt.entries += len(r.File)
+	err = w.lt.checkEntries(w.lt.entries)
 	if err != nil {
 		return
 	}
-	defer r.Close()
 
-	// Iterate through the files in the archive, and write each file out to the temporary directory.
 	for _, f := range r.File {
-		fileList = append(fileList, f.Name)
-		// fmt.Printf("Contents of %s:\n", f.Name)
-		fnContents := tmpDir + "/" + f.Name
-		rc, err1 := f.Open()
-		if err1 != nil {
-			err = err1
+		err = w.walkZipEntry(prefix, f, depth)
+		if err != nil {
 			return
 		}
-		// Extra block to grantee that "defer"-red close will happen every loop, not at exit of function.
-		{
-			defer rc.Close()
-			fo, err2 := naLib.Fopen(fnContents, "w")
-			if err2 != nil {
-				err = err2
-				return
-			}
-			defer fo.Close()
-			_, err = io.Copy(fo, rc)
-			if err != nil {
-				return
-			}
-		}
 	}
 
-	if len(fileList) == 0 {
-		err = ErrEmptyArchive
+	return
+}
+
+// walkZipEntry opens a single entry and passes it on - the function makes the deferred close happen for each entry.
+func (w *walker) walkZipEntry(prefix string, f *zip.File, depth int) (err error) {
+	mode := f.Mode()
+	if mode.IsDir() || strings.HasSuffix(f.Name, "/") {
+		return
+	}
+	if mode&os.ModeSymlink != 0 {
+		return &UnsafeEntryError{Name: prefix + f.Name, Reason: "symbolic link"}
+	}
+	if !mode.IsRegular() {
+		return &UnsafeEntryError{Name: prefix + f.Name, Reason: "not a regular file"}
+	}
+	name, err := CleanEntryName(f.Name)
+	if err != nil {
+		return
 	}
+	lt := w.lt
+	err = lt.check(prefix+name, int64(f.UncompressedSize64), lt.total+int64(f.UncompressedSize64), int64(f.CompressedSize64))
+	if err != nil {
+		return
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	compressed := int64(f.CompressedSize64)
+	return w.entry(prefix, name, &limitReader{rd: rc, lt: lt, name: prefix + name, compressed: func() int64 { return compressed }}, depth)
+}
+
+// UnZip takes an input file name and un-zips it into the specified directory.  A list of files or an error is returned.
+// If this is an empty arcive, then an error will be returnd.  Files in sub-folders are extracted into matching
+// sub-directories of tmpDir, and the returned names are relative to tmpDir.
+func UnZip(inputFn string, tmpDir string) (fileList []string, err error) {
+	return UnZipLimited(context.Background(), inputFn, tmpDir, Limits{})
+}
+
+// UnZipLimited is UnZip with Limits applied, see WalkLimited.
+func UnZipLimited(ctx context.Context, inputFn string, tmpDir string, lim Limits) (fileList []string, err error) {
+
+	// Iterate through the files in the archive, and write each file out to the temporary directory.
+	err = WalkLimited(ctx, inputFn, lim, func(name string, rd io.Reader) (err error) {
+		fnContents := filepath.Join(tmpDir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(fnContents), 0700)
+		if err != nil {
+			return
+		}
+		fileList = append(fileList, name)
+		fo, err := naLib.Fopen(fnContents, "w")
+		if err != nil {
+			return
+		}
+		defer fo.Close()
+		_, err = io.Copy(fo, rd)
+		return
+	})
 
 	return
 }
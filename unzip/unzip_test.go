@@ -1,8 +1,21 @@
 package unzip
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/ulikunitz/xz"
 )
 
 // func UnZip(inputFn string, tmpDir string) (fileList []string, err error) {
@@ -23,3 +36,451 @@ func Test_Unzip(t *testing.T) {
 	os.RemoveAll("./tmp")
 
 }
+
+// func Walk(inputFn string, fn WalkFunc) (err error) {
+func Test_Walk(t *testing.T) {
+
+	os.RemoveAll("./tmp")
+
+	ex := map[string]string{
+		"x1": "x1\n",
+		"x2": "x1\nx2\n",
+	}
+	n := 0
+	err := Walk("./testdata/a.zip", func(name string, rd io.Reader) error {
+		n++
+		data, err := ioutil.ReadAll(rd)
+		if err != nil {
+			return err
+		}
+		if string(data) != ex[name] {
+			t.Errorf("Test_Walk: %s expected [%s] got [%s]", name, ex[name], data)
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Errorf("Test_Walk")
+	}
+	if n != 2 {
+		t.Errorf("Test_Walk")
+	}
+	if _, err := os.Stat("./tmp"); err == nil {
+		t.Errorf("Test_Walk: should not write to disk")
+	}
+
+}
+
+// func CleanEntryName(name string) (clean string, err error) {
+func Test_CleanEntryName(t *testing.T) {
+	tests := []struct {
+		name string
+		ex   string
+		bad  bool
+	}{
+		{name: "a.xml", ex: "a.xml"},
+		{name: "sub/dir/a.xml", ex: "sub/dir/a.xml"},
+		{name: "sub\\a.xml", ex: "sub/a.xml"},
+		{name: "./sub//a.xml", ex: "sub/a.xml"},
+		{name: "../a.xml", bad: true},
+		{name: "sub/../../a.xml", bad: true},
+		{name: "/etc/passwd", bad: true},
+		{name: "C:\\x.xml", bad: true},
+		{name: "", bad: true},
+		{name: ".", bad: true},
+	}
+	for ii, test := range tests {
+		clean, err := CleanEntryName(test.name)
+		if test.bad {
+			if _, ok := err.(*UnsafeEntryError); !ok {
+				t.Errorf("Test_CleanEntryName %d: expected *UnsafeEntryError for %q, got %v", ii, test.name, err)
+			}
+		} else if err != nil || clean != test.ex {
+			t.Errorf("Test_CleanEntryName %d: expected %q got %q err=%v", ii, test.ex, clean, err)
+		}
+	}
+}
+
+// makeZip writes a test .zip file with the entries in 'files'.  Names ending in "/" are written as directories.
+func makeZip(t *testing.T, fn string, files ...string) {
+	fp, err := os.Create(fn)
+	if err != nil {
+		t.Fatalf("makeZip: %s", err)
+	}
+	defer fp.Close()
+	zw := zip.NewWriter(fp)
+	for _, name := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("makeZip: %s", err)
+		}
+		if !strings.HasSuffix(name, "/") {
+			w.Write([]byte("data:" + name))
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("makeZip: %s", err)
+	}
+}
+
+func Test_UnZipSubDirectories(t *testing.T) {
+
+	os.RemoveAll("./tmp")
+	os.Mkdir("./tmp", 0700)
+	os.Mkdir("./tmp/out", 0700)
+
+	makeZip(t, "./tmp/sub.zip", "top.xml", "sub/", "sub/dir/a.xml")
+
+	fns, err := UnZip("./tmp/sub.zip", "./tmp/out")
+	if err != nil {
+		t.Errorf("Test_UnZipSubDirectories: %s", err)
+	}
+	if len(fns) != 2 {
+		t.Errorf("Test_UnZipSubDirectories: expected 2 files, got %s", fns)
+	}
+	data, err := ioutil.ReadFile("./tmp/out/sub/dir/a.xml")
+	if err != nil || string(data) != "data:sub/dir/a.xml" {
+		t.Errorf("Test_UnZipSubDirectories: got [%s] err=%v", data, err)
+	}
+
+	os.RemoveAll("./tmp")
+}
+
+func Test_UnZipSlip(t *testing.T) {
+
+	os.RemoveAll("./tmp")
+	os.Mkdir("./tmp", 0700)
+	os.Mkdir("./tmp/out", 0700)
+
+	makeZip(t, "./tmp/slip.zip", "ok.xml", "../../evil.xml")
+
+	_, err := UnZip("./tmp/slip.zip", "./tmp/out")
+	if _, ok := err.(*UnsafeEntryError); !ok {
+		t.Errorf("Test_UnZipSlip: expected *UnsafeEntryError, got %v", err)
+	}
+	if _, err := os.Stat("../evil.xml"); err == nil {
+		os.Remove("../evil.xml")
+		t.Errorf("Test_UnZipSlip: file escaped the temporary directory")
+	}
+
+	os.RemoveAll("./tmp")
+}
+
+func Test_WalkSymlink(t *testing.T) {
+
+	os.RemoveAll("./tmp")
+	os.Mkdir("./tmp", 0700)
+
+	fp, _ := os.Create("./tmp/link.zip")
+	zw := zip.NewWriter(fp)
+	hdr := &zip.FileHeader{Name: "link.xml"}
+	hdr.SetMode(os.ModeSymlink | 0777)
+	w, _ := zw.CreateHeader(hdr)
+	w.Write([]byte("/etc/passwd"))
+	zw.Close()
+	fp.Close()
+
+	err := Walk("./tmp/link.zip", func(name string, rd io.Reader) error { return nil })
+	if _, ok := err.(*UnsafeEntryError); !ok {
+		t.Errorf("Test_WalkSymlink: expected *UnsafeEntryError, got %v", err)
+	}
+
+	os.RemoveAll("./tmp")
+}
+
+// func WalkLimited(ctx context.Context, inputFn string, lim Limits, fn WalkFunc) (err error) {
+func Test_WalkLimited(t *testing.T) {
+
+	os.RemoveAll("./tmp")
+	os.Mkdir("./tmp", 0700)
+
+	// 1MB of zeros compresses to almost nothing - a small zip bomb.
+	fp, _ := os.Create("./tmp/bomb.zip")
+	zw := zip.NewWriter(fp)
+	w, _ := zw.Create("zero.xml")
+	w.Write(make([]byte, 1024*1024))
+	w, _ = zw.Create("small.xml")
+	w.Write([]byte("small"))
+	zw.Close()
+	fp.Close()
+
+	read := func(name string, rd io.Reader) error {
+		_, err := io.Copy(ioutil.Discard, rd)
+		return err
+	}
+
+	tests := []struct {
+		lim   Limits
+		limit string
+	}{
+		{lim: Limits{}, limit: ""},
+		{lim: Limits{MaxEntries: 1}, limit: "MaxEntries"},
+		{lim: Limits{MaxEntryBytes: 1000}, limit: "MaxEntryBytes"},
+		{lim: Limits{MaxTotalBytes: 1024 * 1024}, limit: "MaxTotalBytes"},
+		{lim: Limits{MaxRatio: 100}, limit: "MaxRatio"},
+	}
+	for ii, test := range tests {
+		err := WalkLimited(context.Background(), "./tmp/bomb.zip", test.lim, read)
+		if test.limit == "" {
+			if err != nil {
+				t.Errorf("Test_WalkLimited %d: unexpected error %s", ii, err)
+			}
+			continue
+		}
+		le, ok := err.(*LimitError)
+		if !ok {
+			t.Errorf("Test_WalkLimited %d: expected *LimitError, got %v", ii, err)
+		} else if le.Limit != test.limit {
+			t.Errorf("Test_WalkLimited %d: expected %s, got %s", ii, test.limit, le.Limit)
+		}
+	}
+
+	os.RemoveAll("./tmp")
+}
+
+// tarGz returns a .tar.gz with the given names and contents, in order.
+func tarGz(t *testing.T, names []string, docs [][]byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for ii, fn := range names {
+		tw.WriteHeader(&tar.Header{Name: fn, Mode: 0600, Size: int64(len(docs[ii])), Typeflag: tar.TypeReg})
+		tw.Write(docs[ii])
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tarGz: %s", err)
+	}
+	gw.Close()
+	return buf.Bytes()
+}
+
+// A compressed tarball is checked against MaxRatio over the whole stream, since the decompressor reads ahead and
+// the compressed size of each entry is not known.
+func Test_WalkLimitedTar(t *testing.T) {
+
+	os.RemoveAll("./tmp")
+	os.Mkdir("./tmp", 0700)
+
+	// 200 ordinary documents of about 2.7KB that compress to a few times smaller
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"news", "market", "report", "city", "council", "weather", "sport", "the", "a", "of", "and", "to"}
+	var names []string
+	var docs [][]byte
+	for ii := 0; ii < 200; ii++ {
+		var doc bytes.Buffer
+		fmt.Fprintf(&doc, "<doc id=\"%d\"><title>%d</title><body>", ii, rnd.Int63())
+		for doc.Len() < 2700 {
+			fmt.Fprintf(&doc, "%s %d ", words[rnd.Intn(len(words))], rnd.Intn(100000))
+		}
+		doc.WriteString("</body></doc>")
+		names, docs = append(names, fmt.Sprintf("%03d.xml", ii)), append(docs, doc.Bytes())
+	}
+	ioutil.WriteFile("./tmp/docs.tgz", tarGz(t, names, docs), 0600)
+	ioutil.WriteFile("./tmp/bomb.tgz", tarGz(t, []string{"small.xml", "zero.xml"}, [][]byte{[]byte("small"), make([]byte, 4*1024*1024)}), 0600)
+
+	lim := Limits{MaxEntries: 1000, MaxEntryBytes: 1024 * 1024, MaxTotalBytes: 10 * 1024 * 1024, MaxRatio: 200}
+	n := 0
+	err := WalkLimited(context.Background(), "./tmp/docs.tgz", lim, func(name string, rd io.Reader) error {
+		n++
+		_, err := io.Copy(ioutil.Discard, rd)
+		return err
+	})
+	if err != nil || n != 200 {
+		t.Errorf("Test_WalkLimitedTar: expected 200 documents and no error got %d, %v", n, err)
+	}
+
+	lim.MaxEntryBytes = 0
+	err = WalkLimited(context.Background(), "./tmp/bomb.tgz", lim, func(name string, rd io.Reader) error {
+		_, err := io.Copy(ioutil.Discard, rd)
+		return err
+	})
+	if le, ok := err.(*LimitError); !ok || le.Limit != "MaxRatio" || le.Name != "zero.xml" {
+		t.Errorf("Test_WalkLimitedTar: expected MaxRatio for zero.xml got %v", err)
+	}
+
+	os.RemoveAll("./tmp")
+}
+
+// walkAll returns the name and contents of each document in an archive.
+func walkAll(inputFn string) (docs map[string]string, err error) {
+	docs = make(map[string]string)
+	err = Walk(inputFn, func(name string, rd io.Reader) error {
+		data, err := ioutil.ReadAll(rd)
+		docs[name] = string(data)
+		return err
+	})
+	return
+}
+
+// makeTar returns a tar file with x1 and x2 in it, matching testdata/a.zip.
+func makeTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, fn := range []string{"x1", "x2"} {
+		data, _ := ioutil.ReadFile("./testdata/" + fn)
+		tw.WriteHeader(&tar.Header{Name: fn, Mode: 0600, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		tw.Write(data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("makeTar: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// func DetectFormat(head []byte) Format {
+// func Walk(inputFn string, fn WalkFunc) (err error) {
+func Test_WalkFormats(t *testing.T) {
+
+	os.RemoveAll("./tmp")
+	os.Mkdir("./tmp", 0700)
+
+	tarData := makeTar(t)
+	ioutil.WriteFile("./tmp/a.tar", tarData, 0600)
+
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	gw.Write(tarData)
+	gw.Close()
+	ioutil.WriteFile("./tmp/a.tgz", gzBuf.Bytes(), 0600)
+	ioutil.WriteFile("./tmp/tarball.zip", gzBuf.Bytes(), 0600) // wrong extension, found by magic bytes
+
+	gzBuf.Reset()
+	gw = gzip.NewWriter(&gzBuf)
+	gw.Name = "x2"
+	gw.Write([]byte("x1\nx2\n"))
+	gw.Close()
+	ioutil.WriteFile("./tmp/doc.gz", gzBuf.Bytes(), 0600)
+
+	var xzBuf bytes.Buffer
+	xw, _ := xz.NewWriter(&xzBuf)
+	xw.Write(tarData)
+	xw.Close()
+	ioutil.WriteFile("./tmp/a.tar.xz", xzBuf.Bytes(), 0600)
+
+	both := map[string]string{"x1": "x1\n", "x2": "x1\nx2\n"}
+	tests := []struct {
+		fn     string
+		format Format
+		ex     map[string]string
+	}{
+		{fn: "./testdata/a.zip", format: FormatZip, ex: both},
+		{fn: "./tmp/a.tar", format: FormatTar, ex: both},
+		{fn: "./tmp/a.tgz", format: FormatGzip, ex: both},
+		{fn: "./tmp/tarball.zip", format: FormatGzip, ex: both},
+		{fn: "./tmp/doc.gz", format: FormatGzip, ex: map[string]string{"x2": "x1\nx2\n"}},
+		{fn: "./tmp/a.tar.xz", format: FormatXz, ex: both},
+		{fn: "./testdata/a.tar.bz2", format: FormatBzip2, ex: both},
+		{fn: "./testdata/x2.bz2", format: FormatBzip2, ex: map[string]string{"x2": "x1\nx2\n"}},
+	}
+	for ii, test := range tests {
+		head, _ := ioutil.ReadFile(test.fn)
+		if len(head) > 512 {
+			head = head[:512]
+		}
+		if f := DetectFormat(head); f != test.format {
+			t.Errorf("Test_WalkFormats %d: %s expected format %s got %s", ii, test.fn, test.format, f)
+		}
+		docs, err := walkAll(test.fn)
+		if err != nil {
+			t.Errorf("Test_WalkFormats %d: %s error %s", ii, test.fn, err)
+		}
+		if !reflect.DeepEqual(docs, test.ex) {
+			t.Errorf("Test_WalkFormats %d: %s expected %q got %q", ii, test.fn, test.ex, docs)
+		}
+	}
+
+	ioutil.WriteFile("./tmp/junk.zip", []byte("this is not an archive"), 0600)
+	if _, err := walkAll("./tmp/junk.zip"); err != ErrUnknownFormat {
+		t.Errorf("Test_WalkFormats: expected ErrUnknownFormat got %v", err)
+	}
+
+	os.RemoveAll("./tmp")
+}
+
+// zipBytes returns a .zip file with the given name -> contents.
+func zipBytes(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("zipBytes: %s", err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zipBytes: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func Test_WalkNested(t *testing.T) {
+
+	os.RemoveAll("./tmp")
+	os.Mkdir("./tmp", 0700)
+
+	var tgz bytes.Buffer
+	gw := gzip.NewWriter(&tgz)
+	gw.Write(makeTar(t))
+	gw.Close()
+
+	deepest := zipBytes(t, map[string][]byte{"deep.xml": []byte("deep")})
+	daily := zipBytes(t, map[string][]byte{"doc.xml": []byte("doc"), "deeper.zip": deepest})
+	weekly := zipBytes(t, map[string][]byte{"top.xml": []byte("top"), "day1.zip": daily, "day2.tgz": tgz.Bytes()})
+	ioutil.WriteFile("./tmp/week.zip", weekly, 0600)
+
+	tests := []struct {
+		depth int
+		ex    map[string]string
+	}{
+		{depth: 0, ex: map[string]string{"top.xml": "top", "day1.zip": string(daily), "day2.tgz": tgz.String()}},
+		{depth: 1, ex: map[string]string{
+			"top.xml":                      "top",
+			"week.zip!day1.zip!doc.xml":    "doc",
+			"week.zip!day1.zip!deeper.zip": string(deepest),
+			"week.zip!day2.tgz!x1":         "x1\n",
+			"week.zip!day2.tgz!x2":         "x1\nx2\n",
+		}},
+		{depth: 2, ex: map[string]string{
+			"top.xml":                               "top",
+			"week.zip!day1.zip!doc.xml":             "doc",
+			"week.zip!day1.zip!deeper.zip!deep.xml": "deep",
+			"week.zip!day2.tgz!x1":                  "x1\n",
+			"week.zip!day2.tgz!x2":                  "x1\nx2\n",
+		}},
+	}
+	for ii, test := range tests {
+		docs := make(map[string]string)
+		err := WalkLimited(context.Background(), "./tmp/week.zip", Limits{MaxDepth: test.depth}, func(name string, rd io.Reader) error {
+			data, err := ioutil.ReadAll(rd)
+			docs[name] = string(data)
+			return err
+		})
+		if err != nil {
+			t.Errorf("Test_WalkNested %d: error %s", ii, err)
+		}
+		if !reflect.DeepEqual(docs, test.ex) {
+			t.Errorf("Test_WalkNested %d: expected %q got %q", ii, test.ex, docs)
+		}
+	}
+
+	// Entries in nested archives count towards the limits.
+	err := WalkLimited(context.Background(), "./tmp/week.zip", Limits{MaxDepth: 2, MaxEntries: 5}, func(name string, rd io.Reader) error { return nil })
+	if le, ok := err.(*LimitError); !ok || le.Limit != "MaxEntries" {
+		t.Errorf("Test_WalkNested: expected MaxEntries *LimitError, got %v", err)
+	}
+
+	// Canceling the context stops the walk before the next entry.
+	ctx, cancel := context.WithCancel(context.Background())
+	n := 0
+	err = WalkLimited(ctx, "./tmp/week.zip", Limits{MaxDepth: 2}, func(name string, rd io.Reader) error {
+		n++
+		cancel()
+		return nil
+	})
+	if err != context.Canceled || n != 1 {
+		t.Errorf("Test_WalkNested: expected context.Canceled after 1 document, got %v after %d", err, n)
+	}
+
+	os.RemoveAll("./tmp")
+}